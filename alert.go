@@ -0,0 +1,335 @@
+package main
+
+// Alerts on problems seen in the readings, such as a microinverter that
+// has stopped reporting, or from rules in the config file.  Each is
+// notified once when it starts and again when it clears: logged, and
+// optionally sent by webhook, MQTT, Pushover, Telegram or email.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Alert is a problem starting, or with Resolved, clearing
+type Alert struct {
+	Site     string    `json:"site,omitempty"`
+	Name     string    `json:"name"`             // e.g. inverter-offline
+	Device   string    `json:"device,omitempty"` // e.g. an inverter's serial
+	Message  string    `json:"message"`
+	Resolved bool      `json:"resolved"`
+	Time     time.Time `json:"time"`
+}
+
+func (a Alert) key() string {
+	return a.Site + "/" + a.Name + "/" + a.Device
+}
+
+// notifier sends an alert somewhere besides the log
+type notifier func(alert Alert) error
+
+// alertCheck finds one kind of problem in an Envoy's readings
+type alertCheck struct {
+	name string
+	// check returns the alerts firing, or ok false when the readings
+	// can't tell, e.g. at night, leaving any already firing as they are
+	check func(r EnvoyReadings) (firing []Alert, ok bool)
+}
+
+type Alerter struct {
+	checks    []alertCheck
+	notifiers []notifier
+	active    map[string]Alert
+	unsent    []unsentAlert // Failed to send, to send again
+}
+
+// unsentAlert is an alert a notifier failed to send
+type unsentAlert struct {
+	alert    Alert
+	notifier int // In notifiers
+}
+
+// maxUnsent is how many unsent alerts are kept at most, dropping the oldest
+const maxUnsent = 100
+
+// NewAlerter sets up the alerts configured, notifying via mqttPub too if
+// alerts are to go to MQTT
+func NewAlerter(cfg *Config, mqttPub *MqttPublisher) *Alerter {
+	a := &Alerter{active: map[string]Alert{}}
+	if cfg.Alerts.InverterOffline > 0 {
+		a.checks = append(a.checks, inverterOfflineCheck(cfg.Alerts.InverterOffline, cfg.Latitude, cfg.Longitude))
+	}
+	if cfg.Alerts.ZeroProduction > 0 {
+		a.checks = append(a.checks, zeroProductionCheck(cfg.Alerts.ZeroProduction, cfg.Latitude, cfg.Longitude))
+	}
+	if cfg.Alerts.VoltageMin > 0 || cfg.Alerts.VoltageMax > 0 {
+		a.checks = append(a.checks, voltageCheck(cfg.Alerts.VoltageMin, cfg.Alerts.VoltageMax, cfg.Alerts.VoltageFor))
+	}
+	if cfg.Alerts.FrequencyMin > 0 || cfg.Alerts.FrequencyMax > 0 {
+		a.checks = append(a.checks, frequencyCheck(cfg.Alerts.FrequencyMin, cfg.Alerts.FrequencyMax))
+	}
+	for _, rule := range cfg.Alerts.Rules {
+		if rule.Measurement == "" {
+			rule.Measurement = cfg.Influx.Measurement
+		}
+		a.checks = append(a.checks, ruleCheck(rule, cfg.Influx))
+	}
+	if cfg.Alerts.Webhook != "" {
+		w := NewWebhookWriter(WebhookConfig{Url: cfg.Alerts.Webhook, Retries: cfg.Webhook.Retries})
+		a.notifiers = append(a.notifiers, func(alert Alert) error {
+			body, err := json.Marshal(alert)
+			if err != nil {
+				return err
+			}
+			return w.send(body)
+		})
+	}
+	if cfg.Alerts.Mqtt && mqttPub != nil {
+		a.notifiers = append(a.notifiers, func(alert Alert) error {
+			return catch(func() {
+				topic := "alerts"
+				if alert.Site != "" {
+					topic = alert.Site + "/" + topic
+				}
+				mqttPub.publish(topic, alert)
+			})
+		})
+	}
+	if cfg.Alerts.Pushover.Token != "" {
+		a.notifiers = append(a.notifiers, pushoverNotifier(cfg.Alerts.Pushover))
+	}
+	if cfg.Alerts.Telegram.Token != "" {
+		a.notifiers = append(a.notifiers, telegramNotifier(cfg.Alerts.Telegram))
+	}
+	if cfg.Alerts.Smtp.Addr != "" {
+		a.notifiers = append(a.notifiers, smtpNotifier(cfg.Alerts.Smtp))
+	}
+	return a
+}
+
+// enabled is whether any alerts are configured
+func (cfg AlertsConfig) enabled() bool {
+	return cfg.InverterOffline > 0 || cfg.ZeroProduction > 0 || cfg.VoltageMin > 0 || cfg.VoltageMax > 0 || cfg.FrequencyMin > 0 || cfg.FrequencyMax > 0 || len(cfg.Rules) > 0
+}
+
+func (a *Alerter) notify(alert Alert) error {
+	if alert.Resolved {
+		slog.Info("Alert resolved", "site", alert.Site, "alert", alert.Name, "device", alert.Device)
+	} else {
+		slog.Warn("Alert", "site", alert.Site, "alert", alert.Name, "device", alert.Device, "message", alert.Message)
+	}
+	errs := []error{}
+	for i := range a.notifiers {
+		errs = append(errs, a.send(unsentAlert{alert, i}))
+	}
+	return errors.Join(errs...)
+}
+
+// send sends an alert by one notifier, keeping it to send again if that
+// fails
+func (a *Alerter) send(u unsentAlert) error {
+	err := a.notifiers[u.notifier](u.alert)
+	if err == nil {
+		return nil
+	}
+	a.unsent = append(a.unsent, u)
+	if over := len(a.unsent) - maxUnsent; over > 0 {
+		a.unsent = a.unsent[over:]
+		slog.Warn("Too many alerts unsent, dropped the oldest", "alerts", over)
+	}
+	return fmt.Errorf("alert %s: %w", u.alert.Name, err)
+}
+
+// retry sends the alerts that failed to send, as running the checks on
+// the same readings again would find nothing new to send
+func (a *Alerter) retry() error {
+	unsent := a.unsent
+	a.unsent = nil
+	errs := []error{}
+	for _, u := range unsent {
+		errs = append(errs, a.send(u))
+	}
+	return errors.Join(errs...)
+}
+
+// Write runs the checks on each Envoy's readings, notifying alerts that
+// have started or cleared since the last poll.  An alert is active from
+// when it's first found, whether or not it's been sent; one that fails to
+// send is kept and sent again until it is.
+func (a *Alerter) Write(readings []EnvoyReadings) error {
+	// Those that failed before first, so they aren't lost once the
+	// retries are given up on
+	errs := []error{a.retry()}
+	for _, r := range readings {
+		for _, c := range a.checks {
+			firing, ok := c.check(r)
+			if !ok {
+				continue
+			}
+			still := map[string]bool{}
+			for _, alert := range firing {
+				alert.Site, alert.Name, alert.Time = r.Site, c.name, r.PollTime
+				still[alert.key()] = true
+				if _, active := a.active[alert.key()]; !active {
+					a.active[alert.key()] = alert
+					errs = append(errs, a.notify(alert))
+				}
+			}
+			for key, alert := range a.active {
+				if alert.Site == r.Site && alert.Name == c.name && !still[key] {
+					delete(a.active, key)
+					alert.Resolved, alert.Time = true, r.PollTime
+					errs = append(errs, a.notify(alert))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Flush is a no-op as alerts are sent as they happen
+func (a *Alerter) Flush() error {
+	return nil
+}
+
+func (a *Alerter) Close() error {
+	return nil
+}
+
+// inverterOfflineCheck alerts on microinverters that haven't reported for
+// window, once the sun has been up that long.  When none have reported
+// it's dusk or the whole system is down, which this can't tell apart.
+func inverterOfflineCheck(window time.Duration, lat float64, lon float64) alertCheck {
+	return alertCheck{name: "inverter-offline", check: func(r EnvoyReadings) ([]Alert, bool) {
+		if len(r.Inverters) == 0 || !isDaylight(r.PollTime, lat, lon) || !isDaylight(r.PollTime.Add(-window), lat, lon) {
+			return nil, false
+		}
+		firing := []Alert{}
+		for _, inv := range r.Inverters {
+			since := r.PollTime.Sub(time.Unix(inv.LastReportDate, 0))
+			if since > window {
+				firing = append(firing, Alert{
+					Device:  inv.SerialNumber,
+					Message: fmt.Sprintf("Microinverter %s hasn't reported for %v", inv.SerialNumber, since.Round(time.Minute)),
+				})
+			}
+		}
+		if len(firing) == len(r.Inverters) {
+			return nil, false
+		}
+		return firing, true
+	}}
+}
+
+// voltageCheck alerts when the grid voltage on a phase has been below low
+// or above high (either 0 for no limit) for duration, e.g. high enough
+// for the microinverters to throttle.  Each phase, or split-phase leg, is
+// checked if the production CT reports them, otherwise the total.
+func voltageCheck(low float64, high float64, duration time.Duration) alertCheck {
+	return rangeCheck("voltage", "Grid voltage", "V", low, high, duration, func(r EnvoyReadings) map[string]float64 {
+		phases := map[string]float64{}
+		if len(r.Production.Lines) > 1 {
+			for i, line := range r.Production.Lines {
+				phases[fmt.Sprintf("L%d", i+1)] = line.RmsVoltage
+			}
+		} else if r.Production.RmsVoltage > 0 {
+			phases["total"] = r.Production.RmsVoltage
+		}
+		return phases
+	})
+}
+
+// frequencyCheck alerts as soon as the grid frequency is found below low or
+// above high (either 0 for no limit), as the microinverters drop out or
+// cut back when it strays.  It's read from the CT meters (-meters).
+func frequencyCheck(low float64, high float64) alertCheck {
+	return rangeCheck("frequency", "Grid frequency", "Hz", low, high, 0, func(r EnvoyReadings) map[string]float64 {
+		for _, m := range r.Meters {
+			if m.Freq > 0 {
+				return map[string]float64{"": m.Freq}
+			}
+		}
+		return nil
+	})
+}
+
+// rangeCheck alerts on values, by device, that have been below low or
+// above high (either 0 for no limit) for duration.  With no values, e.g.
+// without the CTs to measure them, it can't tell.
+func rangeCheck(name string, what string, unit string, low float64, high float64, duration time.Duration, values func(r EnvoyReadings) map[string]float64) alertCheck {
+	outSince := map[string]time.Time{} // By site and device
+	return alertCheck{name: name, check: func(r EnvoyReadings) ([]Alert, bool) {
+		byDevice := values(r)
+		if len(byDevice) == 0 {
+			return nil, false
+		}
+		devices := []string{}
+		for device := range byDevice {
+			devices = append(devices, device)
+		}
+		sort.Strings(devices)
+		firing := []Alert{}
+		for _, device := range devices {
+			v, key := byDevice[device], r.Site+"/"+device
+			if (low == 0 || v >= low) && (high == 0 || v <= high) {
+				delete(outSince, key)
+				continue
+			}
+			since, ok := outSince[key]
+			if !ok {
+				since = r.PollTime
+				outSince[key] = since
+			}
+			if r.PollTime.Sub(since) < duration {
+				continue
+			}
+			direction, limit := "above", high
+			if v < low {
+				direction, limit = "below", low
+			}
+			message := what
+			if device != "" {
+				message += " (" + device + ")"
+			}
+			message += fmt.Sprintf(" is %.2f%s, %s %g%s", v, unit, direction, limit, unit)
+			if duration > 0 {
+				message += fmt.Sprintf(" for %v", r.PollTime.Sub(since).Round(time.Minute))
+			}
+			firing = append(firing, Alert{Device: device, Message: message})
+		}
+		return firing, true
+	}}
+}
+
+// zeroProductionWatts is as good as nothing, allowing for meter noise
+const zeroProductionWatts = 10
+
+// zeroProductionCheck alerts when production has been at or near zero for
+// duration with the sun up throughout, e.g. from a tripped breaker
+func zeroProductionCheck(duration time.Duration, lat float64, lon float64) alertCheck {
+	zeroSince := map[string]time.Time{} // By site
+	return alertCheck{name: "zero-production", check: func(r EnvoyReadings) ([]Alert, bool) {
+		if !isDaylight(r.PollTime, lat, lon) {
+			delete(zeroSince, r.Site)
+			return nil, false
+		}
+		if r.Production.WNow > zeroProductionWatts {
+			delete(zeroSince, r.Site)
+			return nil, true
+		}
+		since, ok := zeroSince[r.Site]
+		if !ok {
+			since = r.PollTime
+			zeroSince[r.Site] = since
+		}
+		if r.PollTime.Sub(since) < duration {
+			return nil, true
+		}
+		return []Alert{{
+			Message: fmt.Sprintf("Production has been %.0fW or less for %v in daylight", float64(zeroProductionWatts), r.PollTime.Sub(since).Round(time.Minute)),
+		}}, true
+	}}
+}
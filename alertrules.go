@@ -0,0 +1,139 @@
+package main
+
+// Threshold alerts from rules in the config file: a field of any point
+// written, compared with a value, holding for a while
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AlertRule alerts when a field of matching points compares true with
+// Value for at least For
+type AlertRule struct {
+	Name        string            `yaml:"name"`        // default e.g. "watts > 5000"
+	Measurement string            `yaml:"measurement"` // default the readings measurement
+	Tags        map[string]string `yaml:"tags"`        // only points with these tags, e.g. type: net-consumption
+	Field       string            `yaml:"field"`       // e.g. watts
+	Op          string            `yaml:"op"`          // <, <=, >, >=, == or !=
+	Value       float64           `yaml:"value"`
+	For         time.Duration     `yaml:"for"`
+}
+
+func (rule AlertRule) String() string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("%s %s %v", rule.Field, rule.Op, rule.Value)
+}
+
+// compare applies the rule's op, ok false if it isn't one
+func (rule AlertRule) compare(v float64) (result bool, ok bool) {
+	switch rule.Op {
+	case "<":
+		return v < rule.Value, true
+	case "<=":
+		return v <= rule.Value, true
+	case ">":
+		return v > rule.Value, true
+	case ">=":
+		return v >= rule.Value, true
+	case "==":
+		return v == rule.Value, true
+	case "!=":
+		return v != rule.Value, true
+	}
+	return false, false
+}
+
+// matches is whether p is one of the points the rule is about
+func (rule AlertRule) matches(p point) bool {
+	if p.measurement != rule.Measurement {
+		return false
+	}
+	for k, v := range rule.Tags {
+		if p.tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldNumber is a field's value as a number, bools as 0 or 1
+func fieldNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// pointDevice names which of a rule's points it is, from the tags other
+// than site, e.g. serial=121900000001
+func pointDevice(p point) string {
+	keys := []string{}
+	for k := range p.tags {
+		if k != "site" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+p.tags[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// ruleCheck alerts on each point matching rule whose field has compared
+// true at every poll for rule.For
+func ruleCheck(rule AlertRule, influx InfluxConfig) alertCheck {
+	trueSince := map[string]time.Time{} // By site and device
+	return alertCheck{name: rule.String(), check: func(r EnvoyReadings) ([]Alert, bool) {
+		firing := []Alert{}
+		seen := map[string]bool{}
+		for _, p := range readingsToPoints(influx, r) {
+			if !rule.matches(p) {
+				continue
+			}
+			v, ok := fieldNumber(p.fields[rule.Field])
+			if !ok {
+				continue
+			}
+			device := pointDevice(p)
+			key := r.Site + "/" + device
+			if result, _ := rule.compare(v); !result {
+				continue
+			}
+			seen[key] = true
+			since, ok := trueSince[key]
+			if !ok {
+				since = r.PollTime
+				trueSince[key] = since
+			}
+			if r.PollTime.Sub(since) >= rule.For {
+				firing = append(firing, Alert{
+					Device:  device,
+					Message: fmt.Sprintf("%s %s is %v (%s %v)", p.measurement, rule.Field, v, rule.Op, rule.Value),
+				})
+			}
+		}
+		for key := range trueSince {
+			if strings.HasPrefix(key, r.Site+"/") && !seen[key] {
+				delete(trueSince, key)
+			}
+		}
+		return firing, true
+	}}
+}
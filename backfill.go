@@ -0,0 +1,118 @@
+package main
+
+// backfill: seed InfluxDB with the production history Enlighten holds from
+// before local monitoring started, via the Enlighten v4 API.  Each day is
+// one request, for its 5 minute intervals, written at their original times.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// backfillCommand writes production from the first date given to the
+// second (default today), in the site's timezone
+func backfillCommand(args []string) {
+	cfg := loadConfig(args)
+	check(cfg.validate())
+	setupLogging(cfg.LogLevel, cfg.LogFormat)
+	ec := cfg.envoyConfigs()[0]
+	if cfg.Enlighten.ApiKey == "" || cfg.Enlighten.AccessToken == "" || cfg.Enlighten.SystemId == "" {
+		fmt.Fprintln(os.Stderr, "Give the Enlighten API key, access token and system ID with -enlighten-key, -enlighten-token and -enlighten-system")
+		os.Exit(2)
+	}
+	if len(cfg.influxConfigs()) == 0 {
+		fmt.Fprintln(os.Stderr, "backfill writes to InfluxDB, give its address with -dba")
+		os.Exit(2)
+	}
+	loc := ec.location()
+	if loc == nil {
+		loc = time.Local
+	}
+	from, to, err := backfillDays(flag.Args(), loc)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "Usage: influxEnvoyStats backfill [flags] FROM [TO], dates as YYYY-MM-DD")
+		os.Exit(2)
+	}
+
+	api := envoy.NewEnlightenAPI(cfg.Enlighten.ApiKey, cfg.Enlighten.AccessToken, cfg.Enlighten.SystemId)
+	ws := []*InfluxWriter{}
+	for _, ic := range cfg.influxConfigs() {
+		w := NewInfluxWriter(ic)
+		defer w.Close()
+		ws = append(ws, w)
+	}
+	for day := from; day.Before(to); {
+		intervals, err := api.GetProductionMicro(day)
+		var limited *envoy.RateLimitError
+		if errors.As(err, &limited) && limited.Period == "minute" {
+			slog.Info("Waiting for the Enlighten API rate limit", "until", limited.Until)
+			time.Sleep(time.Until(limited.Until) + time.Second)
+			continue
+		}
+		check(err)
+		points := cfg.Influx.addTags(cfg.Influx.mapPoints(backfillPoints(cfg.Influx.Measurement, ec.Site, intervals)))
+		for _, w := range ws {
+			w.WritePoints(points)
+		}
+		slog.Info("Backfilled", "day", day.Format(time.DateOnly), "intervals", len(intervals))
+		day = day.AddDate(0, 0, 1)
+	}
+	for _, w := range ws {
+		check(w.Flush())
+	}
+}
+
+// backfillDays is the start of the first day in args and the end of the
+// last, or now
+func backfillDays(args []string, loc *time.Location) (from time.Time, to time.Time, err error) {
+	if len(args) < 1 || len(args) > 2 {
+		return from, to, errors.New("backfill needs a date to start from, and optionally one to end on")
+	}
+	from, err = time.ParseInLocation(time.DateOnly, args[0], loc)
+	if err != nil {
+		return from, to, err
+	}
+	to = time.Now()
+	if len(args) == 2 {
+		to, err = time.ParseInLocation(time.DateOnly, args[1], loc)
+		if err != nil {
+			return from, to, err
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("%s is after %s", args[0], to.AddDate(0, 0, -1).Format(time.DateOnly))
+	}
+	return from, to, nil
+}
+
+// backfillPoints are production points like the poller's, as average
+// watts over each interval, with the energy produced in it
+func backfillPoints(measurement string, site string, intervals []envoy.Interval) []point {
+	points := []point{}
+	for _, interval := range intervals {
+		p := point{
+			measurement: measurement,
+			tags: map[string]string{
+				"type": "production",
+			},
+			fields: map[string]interface{}{
+				"watts":            interval.Powr,
+				"whInterval":       interval.Enwh,
+				"devicesReporting": interval.DevicesReporting,
+			},
+			time: time.Unix(interval.EndAt, 0),
+		}
+		if site != "" {
+			p.tags["site"] = site
+		}
+		points = append(points, p)
+	}
+	return points
+}
@@ -0,0 +1,83 @@
+package main
+
+// Envoys without working NTP stamp their readings minutes or more from the
+// real time, putting points in the past or future.  checkClock compares
+// production.json's readingTime with the poll time, warning when they're
+// too far apart, and can shift the Envoy's times to make up the difference.
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// clockSkewed is whether each Envoy's clock was last found off, by host
+var clockSkewed sync.Map
+
+// checkClock warns when r's reading time is further than the limit from
+// its poll time, then if configured, corrects r's times by the difference
+func checkClock(gw gateway, r *EnvoyReadings) {
+	limit := gw.cfg.ClockSkew
+	if limit <= 0 || r.Production.ReadingTime == 0 {
+		return
+	}
+	skew := r.PollTime.Sub(time.Unix(r.Production.ReadingTime, 0))
+	skewed := skew > limit || skew < -limit
+	previous, seen := clockSkewed.Swap(gw.client.Host, skewed)
+	switch {
+	case skewed && (!seen || !previous.(bool)):
+		slog.Warn("Envoy clock is off", "site", gw.site, "host", gw.client.Host, "behindBy", skew, "correcting", gw.cfg.FixClock)
+	case !skewed && seen && previous.(bool):
+		slog.Info("Envoy clock back in step", "site", gw.site, "host", gw.client.Host, "behindBy", skew)
+	}
+	if skewed && gw.cfg.FixClock {
+		shiftEnvoyTimes(r, skew)
+	}
+}
+
+// shiftEnvoyTimes moves every time r has from the Envoy's clock by d
+func shiftEnvoyTimes(r *EnvoyReadings, d time.Duration) {
+	s := int64(d.Round(time.Second) / time.Second)
+	shift := func(t *int64) {
+		if *t != 0 {
+			*t += s
+		}
+	}
+	shift(&r.Production.ReadingTime)
+	for i := range r.Consumption {
+		shift(&r.Consumption[i].ReadingTime)
+	}
+	for i := range r.Storage {
+		shift(&r.Storage[i].ReadingTime)
+	}
+	for i := range r.Inverters {
+		shift(&r.Inverters[i].LastReportDate)
+	}
+	for i := range r.Devstatus {
+		shift(&r.Devstatus[i].ReportDate)
+	}
+	for i := range r.Meters {
+		shift(&r.Meters[i].Timestamp)
+		for j := range r.Meters[i].Channels {
+			shift(&r.Meters[i].Channels[j].Timestamp)
+		}
+	}
+	if r.Livedata != nil {
+		shift(&r.Livedata.Meters.LastUpdate)
+	}
+	if r.Ensemble != nil {
+		for i := range r.Ensemble.Inventory {
+			for j := range r.Ensemble.Inventory[i].Devices {
+				shift(&r.Ensemble.Inventory[i].Devices[j].LastRptDate)
+			}
+		}
+	}
+	for i := range r.Inventory {
+		for j := range r.Inventory[i].Devices {
+			shift(&r.Inventory[i].Devices[j].LastRptDate)
+		}
+	}
+	if r.Home != nil {
+		shift(&r.Home.Network.LastEnlightenReportTime)
+	}
+}
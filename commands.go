@@ -0,0 +1,117 @@
+package main
+
+// Subcommands other than polling: influxEnvoyStats <command> [flags]
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"os"
+	"time"
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, `Usage: %s [command] [flags]
+
+Commands:
+  poll             Poll once and write the readings
+  serve            Keep polling at the -l interval (default 1m)
+  discover         List Envoys found on the local network via mDNS
+  token            Print an Envoy access token obtained from Enlighten: token [flags] [get|show|refresh]
+  export           Poll once and print the readings as JSON
+  simulate         Run a fake Envoy, e.g. for trying out outputs (-h for its flags)
+  backfill         Write production history from Enlighten: backfill [flags] FROM [TO]
+  validate-config  Check the config file, environment and flags
+  service          Windows service: service install [flags], service uninstall
+  healthcheck      Exit 1 unless the poller serving -health is ready: healthcheck [flags] [readyz|healthz]
+
+With no command, polls once, or keeps polling when -l is given.
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// tokenCommand prints the Envoy token for the Enlighten credentials,
+// from the token cache while it is still valid; with show, what it's for
+// and when it expires instead; or with refresh, a new one, cached in place
+// of the old
+func tokenCommand(args []string) {
+	cfg := loadConfig(args)
+	setupLogging(cfg.LogLevel, cfg.LogFormat)
+	action := flag.Arg(0)
+	if action == "" {
+		action = "get"
+	}
+	if action != "get" && action != "show" && action != "refresh" {
+		fmt.Fprintf(os.Stderr, "Unknown token command %q, expected get, show or refresh\n", action)
+		os.Exit(2)
+	}
+	envoyConfigs := cfg.envoyConfigs()
+	ec := envoyConfigs[0]
+	token := ec.Token
+	if token == "" || action == "refresh" {
+		if ec.Username == "" {
+			fmt.Fprintln(os.Stderr, "Give Enlighten credentials with -eu/-ep")
+			os.Exit(2)
+		}
+		serial := ec.Serial
+		if serial == "" {
+			serial = getSerial(envoy.NewClient(ec.Host, ""))
+		}
+		tokens := envoy.NewTokenSource(ec.Username, ec.Password, serial, tokenCacheFile(ec, serial, len(envoyConfigs) > 1))
+		var err error
+		if action == "refresh" {
+			token, err = tokens.Refresh()
+		} else {
+			token, err = tokens.Token()
+		}
+		check(err)
+	}
+	if action != "show" {
+		fmt.Println(token)
+		return
+	}
+	info, err := envoy.ParseToken(token)
+	check(err)
+	fmt.Printf("Serial:   %s\n", info.Serial)
+	fmt.Printf("Role:     %s\n", info.Role)
+	fmt.Printf("Username: %s\n", info.Username)
+	fmt.Printf("Issued:   %s\n", info.Issued.Format(time.RFC3339))
+	left := time.Until(info.Expiry)
+	if left > 0 {
+		fmt.Printf("Expires:  %s (in %d days)\n", info.Expiry.Format(time.RFC3339), int(left.Hours()/24))
+	} else {
+		fmt.Printf("Expired:  %s\n", info.Expiry.Format(time.RFC3339))
+	}
+}
+
+// exportCommand polls each Envoy once and prints its readings as a line
+// of JSON, without writing them anywhere
+func exportCommand(args []string) {
+	cfg := loadConfig(args)
+	check(cfg.validate())
+	setupLogging(cfg.LogLevel, cfg.LogFormat)
+	encoder := json.NewEncoder(os.Stdout)
+	for _, gw := range newGateways(cfg) {
+		check(encoder.Encode(pollEnvoyWithRetry(gw)))
+	}
+}
+
+func validateConfigCommand(args []string) {
+	defer func() {
+		// e.g. an unknown setting in the config file
+		if r := recover(); r != nil {
+			fmt.Fprintln(os.Stderr, r)
+			os.Exit(1)
+		}
+	}()
+	cfg := loadConfig(args)
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("Config OK")
+}
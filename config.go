@@ -0,0 +1,1225 @@
+package main
+
+// Settings come from, in increasing order of precedence: the defaults
+// below, an optional YAML config file (-config), environment variables
+// (see flagEnvVars), and command line flags.
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// secretFileFlags maps flags naming a file to read a secret from to the
+// flag the secret is for
+var secretFileFlags = map[string]string{
+	"dbp-file":   "dbp",
+	"dbt-file":   "dbt",
+	"token-file": "et",
+	"ep-file":    "ep",
+}
+
+// flagEnvVars maps flag names to the environment variable that can set them
+var flagEnvVars = map[string]string{
+	"config":           "ENVOY_CONFIG",
+	"e":                "ENVOY_HOST",
+	"et":               "ENVOY_TOKEN",
+	"eu":               "ENLIGHTEN_USERNAME",
+	"ep":               "ENLIGHTEN_PASSWORD",
+	"es":               "ENVOY_SERIAL",
+	"etc":              "ENVOY_TOKEN_CACHE",
+	"digest-user":      "ENVOY_DIGEST_USER",
+	"digest-pw":        "ENVOY_DIGEST_PASSWORD",
+	"firmware":         "ENVOY_FIRMWARE",
+	"model":            "ENVOY_MODEL",
+	"i":                "ENVOY_INVERTERS",
+	"meters":           "ENVOY_METERS",
+	"livedata":         "ENVOY_LIVEDATA",
+	"ensemble":         "ENVOY_ENSEMBLE",
+	"home":             "ENVOY_HOME",
+	"inventory":        "ENVOY_INVENTORY",
+	"devstatus":        "ENVOY_DEVSTATUS",
+	"power-mode":       "ENVOY_POWER_MODE",
+	"energy":           "ENVOY_ENERGY",
+	"stream":           "ENVOY_STREAM",
+	"l":                "POLL_INTERVAL",
+	"lat":              "LATITUDE",
+	"lon":              "LONGITUDE",
+	"ln":               "POLL_INTERVAL_NIGHT",
+	"align":            "POLL_ALIGN",
+	"jitter":           "POLL_JITTER",
+	"cron":             "POLL_CRON",
+	"log-level":        "LOG_LEVEL",
+	"log-format":       "LOG_FORMAT",
+	"r":                "ENVOY_RETRIES",
+	"rb":               "ENVOY_RETRY_BACKOFF",
+	"timeout":          "ENVOY_TIMEOUT",
+	"keepalive":        "ENVOY_KEEPALIVE",
+	"max-idle":         "ENVOY_MAX_IDLE_CONNS",
+	"parallel":         "ENVOY_PARALLEL",
+	"rate":             "ENVOY_RATE",
+	"envoy-proxy":      "ENVOY_PROXY",
+	"skew":             "ENVOY_CLOCK_SKEW",
+	"skew-fix":         "ENVOY_CLOCK_SKEW_FIX",
+	"tz":               "SITE_TIMEZONE",
+	"estimate-wh":      "ENVOY_ESTIMATE_ENERGY",
+	"dba":              "INFLUX_ADDR",
+	"dbv":              "INFLUX_VERSION",
+	"dbn":              "INFLUX_DATABASE",
+	"dbrp":             "INFLUX_RETENTION_POLICY",
+	"dbu":              "INFLUX_USERNAME",
+	"dbp":              "INFLUX_PASSWORD",
+	"dbt":              "INFLUX_TOKEN",
+	"dbo":              "INFLUX_ORG",
+	"m":                "INFLUX_MEASUREMENT",
+	"mi":               "INFLUX_INVERTER_MEASUREMENT",
+	"ms":               "INFLUX_STORAGE_MEASUREMENT",
+	"mm":               "INFLUX_METER_MEASUREMENT",
+	"mlive":            "INFLUX_LIVEDATA_MEASUREMENT",
+	"mens":             "INFLUX_ENSEMBLE_MEASUREMENT",
+	"mhome":            "INFLUX_HOME_MEASUREMENT",
+	"minv":             "INFLUX_INVENTORY_MEASUREMENT",
+	"menergy":          "INFLUX_ENERGY_MEASUREMENT",
+	"mstream":          "INFLUX_STREAM_MEASUREMENT",
+	"mself":            "INFLUX_SELF_MEASUREMENT",
+	"mgap":             "INFLUX_GAP_MEASUREMENT",
+	"mday":             "INFLUX_DAILY_MEASUREMENT",
+	"mlines":           "INFLUX_LINES_MEASUREMENT",
+	"marray":           "INFLUX_ARRAY_MEASUREMENT",
+	"a":                "INFLUX_ALL_FIELDS",
+	"derived":          "INFLUX_DERIVED",
+	"gwtags":           "INFLUX_GATEWAY_TAGS",
+	"tag":              "INFLUX_TAGS",
+	"dup":              "INFLUX_DUPLICATES",
+	"ts":               "INFLUX_TIMESTAMPS",
+	"spool":            "INFLUX_SPOOL_DIR",
+	"downsample":       "INFLUX_DOWNSAMPLE",
+	"smooth":           "INFLUX_SMOOTH",
+	"smooth-raw":       "INFLUX_SMOOTH_RAW",
+	"dbbs":             "INFLUX_BATCH_SIZE",
+	"dbfi":             "INFLUX_FLUSH_INTERVAL",
+	"dbgzip":           "INFLUX_GZIP",
+	"dbrb":             "INFLUX_RETRY_BUFFER",
+	"dbproxy":          "INFLUX_PROXY",
+	"dbcreate":         "INFLUX_CREATE",
+	"dbretention":      "INFLUX_RETENTION",
+	"dblong":           "INFLUX_LONG_TERM",
+	"dblong-every":     "INFLUX_LONG_TERM_EVERY",
+	"dblong-retention": "INFLUX_LONG_TERM_RETENTION",
+	"dbcheck":          "INFLUX_CHECK",
+	"prometheus":       "PROMETHEUS_LISTEN",
+	"health":           "HEALTH_LISTEN",
+	"http":             "HTTP_LISTEN",
+	"record":           "ENVOY_RECORD_DIR",
+	"replay":           "ENVOY_REPLAY_DIR",
+	"mqtt":             "MQTT_BROKER",
+	"mqtt-topic":       "MQTT_TOPIC",
+	"mqtt-qos":         "MQTT_QOS",
+	"mqtt-user":        "MQTT_USERNAME",
+	"mqtt-pw":          "MQTT_PASSWORD",
+	"mqtt-ha":          "MQTT_HA_PREFIX",
+	"mqtt-client-id":   "MQTT_CLIENT_ID",
+	"pg":               "POSTGRES_DSN",
+	"pg-table":         "POSTGRES_TABLE",
+	"csv":              "CSV_DIR",
+	"csv-columns":      "CSV_COLUMNS",
+	"sqlite":           "SQLITE_FILE",
+	"out":              "OUTPUT",
+	"out-queue":        "OUTPUT_QUEUE",
+	"out-retries":      "OUTPUT_RETRIES",
+	"out-backoff":      "OUTPUT_RETRY_BACKOFF",
+	"graphite":         "GRAPHITE_ADDR",
+	"graphite-prefix":  "GRAPHITE_PREFIX",
+	"otlp":             "OTLP_ENDPOINT",
+	"otlp-header":      "OTLP_HEADERS",
+	"otlp-prefix":      "OTLP_PREFIX",
+	"kafka":            "KAFKA_BROKERS",
+	"kafka-topic":      "KAFKA_TOPIC",
+	"kafka-key":        "KAFKA_KEY_BY_TYPE",
+	"nats":             "NATS_URL",
+	"nats-subject":     "NATS_SUBJECT",
+	"nats-js":          "NATS_JETSTREAM",
+	"webhook":          "WEBHOOK_URL",
+	"webhook-header":   "WEBHOOK_HEADERS",
+	"webhook-retries":  "WEBHOOK_RETRIES",
+	"pvo-key":          "PVOUTPUT_API_KEY",
+	"pvo-system":       "PVOUTPUT_SYSTEM_ID",
+	"enlighten-key":    "ENLIGHTEN_API_KEY",
+	"enlighten-token":  "ENLIGHTEN_ACCESS_TOKEN",
+	"enlighten-system": "ENLIGHTEN_SYSTEM_ID",
+	"pvo-interval":     "PVOUTPUT_INTERVAL",
+	"tariff-envoy":     "TARIFF_ENVOY",
+	"import-rate":      "TARIFF_IMPORT_RATE",
+	"export-rate":      "TARIFF_EXPORT_RATE",
+	"currency":         "TARIFF_CURRENCY",
+	"alert-inverter":   "ALERT_INVERTER_OFFLINE",
+	"alert-zero":       "ALERT_ZERO_PRODUCTION",
+	"alert-vmin":       "ALERT_VOLTAGE_MIN",
+	"alert-vmax":       "ALERT_VOLTAGE_MAX",
+	"alert-vfor":       "ALERT_VOLTAGE_FOR",
+	"alert-fmin":       "ALERT_FREQUENCY_MIN",
+	"alert-fmax":       "ALERT_FREQUENCY_MAX",
+	"alert-webhook":    "ALERT_WEBHOOK_URL",
+	"alert-mqtt":       "ALERT_MQTT",
+	"pushover-token":   "PUSHOVER_TOKEN",
+	"pushover-user":    "PUSHOVER_USER",
+	"telegram-token":   "TELEGRAM_BOT_TOKEN",
+	"telegram-chat":    "TELEGRAM_CHAT_ID",
+	"smtp":             "SMTP_ADDR",
+	"smtp-user":        "SMTP_USERNAME",
+	"smtp-pw":          "SMTP_PASSWORD",
+	"smtp-from":        "SMTP_FROM",
+	"smtp-to":          "SMTP_TO",
+}
+
+type EnvoyConfig struct {
+	Host           string `yaml:"host"`
+	Site           string `yaml:"site"` // Tag for this Envoy's readings, default its serial when polling several
+	Token          string `yaml:"token"`
+	Username       string `yaml:"username"` // Enlighten credentials, to obtain a token
+	Password       string `yaml:"password"`
+	Serial         string `yaml:"serial"`
+	TokenCache     string `yaml:"tokenCache"`
+	DigestUser     string `yaml:"digestUser"`     // Older firmware's installer or envoy login
+	DigestPassword string `yaml:"digestPassword"` // Default derived from the serial
+	Inverters      bool   `yaml:"inverters"`
+	Meters         bool   `yaml:"meters"`
+	Livedata       bool   `yaml:"livedata"`
+	Ensemble       bool   `yaml:"ensemble"`
+	Home           bool   `yaml:"home"`
+	Inventory      bool   `yaml:"inventory"`
+	Devstatus      bool   `yaml:"devstatus"` // Needs an installer login
+	PowerMode      bool   `yaml:"powerMode"` // Whether production is switched off
+	Energy         bool   `yaml:"energy"`
+	Stream         bool   `yaml:"stream"` // Stream CT meter samples between polls
+
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retryBackoff"`
+
+	Timeout      time.Duration `yaml:"timeout"`      // Per request, default depending on the endpoint
+	KeepAlive    time.Duration `yaml:"keepAlive"`    // Idle connections kept open this long
+	MaxIdleConns int           `yaml:"maxIdleConns"` // and at most this many
+	Parallel     int           `yaml:"parallel"`     // Endpoints polled at once
+	Rate         float64       `yaml:"rate"`         // Requests a second at most, 0 for no limit
+	Proxy        string        `yaml:"proxy"`        // Default from HTTP_PROXY etc., or direct
+
+	ClockSkew time.Duration `yaml:"clockSkew"` // Warn when the Envoy's clock is this far out
+	FixClock  bool          `yaml:"fixClock"`  // and then correct its times
+
+	Timezone string `yaml:"timezone"` // For daily energy, e.g. Europe/London
+
+	EstimateEnergy bool `yaml:"estimateEnergy"` // From power, for frozen counters
+
+	Firmware string `yaml:"firmware"` // auto to probe which API it has at startup, or off
+	Model    string `yaml:"model"`    // Tag, default from the part number in info.xml
+
+	given map[string]bool // Keys set in an envoys entry, so false or 0 overrides too
+}
+
+type InfluxConfig struct {
+	Version              string          `yaml:"version"` // "1" or "2", default by whether a token is given
+	Addr                 string          `yaml:"addr"`
+	Database             string          `yaml:"database"` // bucket for InfluxDB 2.x
+	RetentionPolicy      string          `yaml:"retentionPolicy"`
+	Username             string          `yaml:"username"`
+	Password             string          `yaml:"password"`
+	Token                string          `yaml:"token"` // InfluxDB 2.x API token
+	Org                  string          `yaml:"org"`
+	Proxy                string          `yaml:"proxy"` // Default from HTTP_PROXY etc., or direct
+	Check                string          `yaml:"check"` // At startup: fail, warn or off (default fail polling once, else warn)
+	Measurement          string          `yaml:"measurement"`
+	InverterMeasurement  string          `yaml:"inverterMeasurement"`
+	StorageMeasurement   string          `yaml:"storageMeasurement"`
+	MeterMeasurement     string          `yaml:"meterMeasurement"`
+	LivedataMeasurement  string          `yaml:"livedataMeasurement"`
+	EnsembleMeasurement  string          `yaml:"ensembleMeasurement"`
+	HomeMeasurement      string          `yaml:"homeMeasurement"`
+	InventoryMeasurement string          `yaml:"inventoryMeasurement"`
+	EnergyMeasurement    string          `yaml:"energyMeasurement"`
+	StreamMeasurement    string          `yaml:"streamMeasurement"`
+	SelfMeasurement      string          `yaml:"selfMeasurement"`
+	GapMeasurement       string          `yaml:"gapMeasurement"`
+	DailyMeasurement     string          `yaml:"dailyMeasurement"`
+	LinesMeasurement     string          `yaml:"linesMeasurement"`
+	ArrayMeasurement     string          `yaml:"arrayMeasurement"`
+	AllFields            bool            `yaml:"allFields"`
+	Derived              bool            `yaml:"derived"`
+	GatewayTags          bool            `yaml:"gatewayTags"` // Tag points with the Envoy's serial and firmware
+	Tags                 stringList      `yaml:"tags"`        // "key=value", on every point
+	Mapping              []MappingConfig `yaml:"mapping"`     // Renaming and routing fields
+	Duplicates           string          `yaml:"duplicates"`  // skip, restamp or write
+	Timestamps           string          `yaml:"timestamps"`  // envoy or host
+	SpoolDir             string          `yaml:"spoolDir"`
+	Downsample           time.Duration   `yaml:"downsample"` // Write a summary per series this often
+	Smooth               time.Duration   `yaml:"smooth"`     // Average power over this long
+	SmoothRaw            bool            `yaml:"smoothRaw"`  // and keep the values as read
+
+	Panels map[string]PanelConfig `yaml:"panels"` // Each microinverter's panel, by serial
+
+	// Batching and compressing writes
+	BatchSize     int           `yaml:"batchSize"`
+	FlushInterval time.Duration `yaml:"flushInterval"`
+	Gzip          bool          `yaml:"gzip"`
+	RetryBuffer   int           `yaml:"retryBuffer"` // Points kept to retry
+
+	// Creating the bucket or database at startup if it isn't there
+	Create            bool          `yaml:"create"`
+	Retention         time.Duration `yaml:"retention"` // 0 to keep readings forever
+	LongTerm          string        `yaml:"longTerm"`  // Bucket or retention policy for a downsampled copy
+	LongTermEvery     time.Duration `yaml:"longTermEvery"`
+	LongTermRetention time.Duration `yaml:"longTermRetention"`
+
+	given map[string]bool // Keys set in an influxes entry, so false or 0 overrides too
+}
+
+type PrometheusConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+type MqttConfig struct {
+	Broker        string `yaml:"broker"`
+	ClientId      string `yaml:"clientId"` // Default unique to each connection
+	Topic         string `yaml:"topic"`
+	Qos           int    `yaml:"qos"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	HomeAssistant string `yaml:"homeAssistant"` // discovery prefix
+}
+
+type PostgresConfig struct {
+	DSN   string `yaml:"dsn"`
+	Table string `yaml:"table"`
+}
+
+type CsvConfig struct {
+	Dir     string `yaml:"dir"`
+	Columns string `yaml:"columns"` // comma separated
+}
+
+type SqliteConfig struct {
+	File string `yaml:"file"`
+}
+
+type GraphiteConfig struct {
+	Addr   string `yaml:"addr"`
+	Prefix string `yaml:"prefix"`
+}
+
+type OtlpConfig struct {
+	Endpoint string     `yaml:"endpoint"` // OTLP/HTTP URL, e.g. http://localhost:4318 for its /v1/metrics
+	Headers  stringList `yaml:"headers"`  // "Name: value"
+	Prefix   string     `yaml:"prefix"`
+}
+
+type KafkaConfig struct {
+	Brokers   string `yaml:"brokers"` // comma separated host:port
+	Topic     string `yaml:"topic"`
+	KeyByType bool   `yaml:"keyByType"`
+}
+
+type NatsConfig struct {
+	Url       string `yaml:"url"`
+	Subject   string `yaml:"subject"` // template, e.g. envoy.{site}.{type}
+	JetStream bool   `yaml:"jetStream"`
+}
+
+type WebhookConfig struct {
+	Url     string     `yaml:"url"`
+	Headers stringList `yaml:"headers"` // "Name: value"
+	Retries int        `yaml:"retries"`
+}
+
+type PvoutputConfig struct {
+	ApiKey   string        `yaml:"apiKey"`
+	SystemId string        `yaml:"systemId"`
+	Interval time.Duration `yaml:"interval"` // the system's status interval
+}
+
+// TariffConfig is the rates to cost grid import and export at
+type TariffConfig struct {
+	Envoy      bool               `yaml:"envoy"`      // Use the tariff set up on the Envoy
+	ImportRate float64            `yaml:"importRate"` // per kWh
+	ExportRate float64            `yaml:"exportRate"`
+	Import     []RateSeasonConfig `yaml:"import"` // Time-of-use rates instead of importRate
+	Export     []RateSeasonConfig `yaml:"export"`
+	Currency   string             `yaml:"currency"`
+}
+
+// RateSeasonConfig is the rates from a day of the year until the next
+// season's start
+type RateSeasonConfig struct {
+	Start string           `yaml:"start"` // Month/day, e.g. 6/1 (default 1/1)
+	Days  []RateDaysConfig `yaml:"days"`
+}
+
+// RateDaysConfig is the rates on some days of the week
+type RateDaysConfig struct {
+	Days    string             `yaml:"days"` // e.g. Mon,Tue,Wed,Thu,Fri (default every day)
+	Periods []RatePeriodConfig `yaml:"periods"`
+}
+
+// RatePeriodConfig is a rate from a time of day until the next period's
+type RatePeriodConfig struct {
+	Start string  `yaml:"start"` // e.g. 16:00 (default midnight)
+	Rate  float64 `yaml:"rate"`
+}
+
+// EnlightenConfig is access to the Enlighten v4 API, for backfill
+type EnlightenConfig struct {
+	ApiKey      string `yaml:"apiKey"`
+	AccessToken string `yaml:"accessToken"`
+	SystemId    string `yaml:"systemId"`
+}
+
+type AlertsConfig struct {
+	InverterOffline time.Duration `yaml:"inverterOffline"` // Alert on inverters not reported for this long in daylight
+	ZeroProduction  time.Duration `yaml:"zeroProduction"`  // Alert on no production for this long in daylight
+	VoltageMin      float64       `yaml:"voltageMin"`      // Alert on grid voltage below this
+	VoltageMax      float64       `yaml:"voltageMax"`      // or above this
+	VoltageFor      time.Duration `yaml:"voltageFor"`      // for this long
+	FrequencyMin    float64       `yaml:"frequencyMin"`    // Alert on grid frequency below this
+	FrequencyMax    float64       `yaml:"frequencyMax"`    // or above this
+	Webhook         string        `yaml:"webhook"`
+	Mqtt            bool          `yaml:"mqtt"` // Publish to <topic>/alerts
+	Rules           []AlertRule   `yaml:"rules"`
+
+	Pushover PushoverConfig `yaml:"pushover"`
+	Telegram TelegramConfig `yaml:"telegram"`
+	Smtp     SmtpConfig     `yaml:"smtp"`
+}
+
+type Config struct {
+	Interval      time.Duration    `yaml:"interval"`
+	Latitude      float64          `yaml:"latitude"` // For polling less at night
+	Longitude     float64          `yaml:"longitude"`
+	NightInterval time.Duration    `yaml:"nightInterval"`
+	Align         bool             `yaml:"align"`  // Poll on multiples of the interval by the clock
+	Jitter        time.Duration    `yaml:"jitter"` // Delay each poll by up to this, at random
+	Cron          stringList       `yaml:"cron"`   // Poll on these schedules instead of every interval
+	LogLevel      string           `yaml:"logLevel"`
+	LogFormat     string           `yaml:"logFormat"`
+	Health        string           `yaml:"health"` // listen address for /healthz and /readyz
+	Http          string           `yaml:"http"`   // listen address for the dashboard and API
+	Record        string           `yaml:"record"` // directory to save raw Envoy responses in
+	Replay        string           `yaml:"replay"` // directory of recorded responses to write instead of polling
+	Out           string           `yaml:"out"`    // jsonl to print readings instead of writing them
+	Envoy         EnvoyConfig      `yaml:"envoy"`
+	Envoys        []EnvoyConfig    `yaml:"envoys"` // Several Envoys, each overriding settings in Envoy
+	Influx        InfluxConfig     `yaml:"influx"`
+	Influxes      []InfluxConfig   `yaml:"influxes"` // Several InfluxDBs, each overriding settings in Influx
+	Prometheus    PrometheusConfig `yaml:"prometheus"`
+	Mqtt          MqttConfig       `yaml:"mqtt"`
+	Postgres      PostgresConfig   `yaml:"postgres"`
+	Csv           CsvConfig        `yaml:"csv"`
+	Sqlite        SqliteConfig     `yaml:"sqlite"`
+	Graphite      GraphiteConfig   `yaml:"graphite"`
+	Otlp          OtlpConfig       `yaml:"otlp"`
+	Kafka         KafkaConfig      `yaml:"kafka"`
+	Nats          NatsConfig       `yaml:"nats"`
+	Webhook       WebhookConfig    `yaml:"webhook"`
+	Pvoutput      PvoutputConfig   `yaml:"pvoutput"`
+	Alerts        AlertsConfig     `yaml:"alerts"`
+	Enlighten     EnlightenConfig  `yaml:"enlighten"`
+	Tariff        TariffConfig     `yaml:"tariff"`
+
+	// Each output's queue, when polling in a loop
+	OutputQueue   int           `yaml:"outputQueue"`   // Poll cycles held while it's failing
+	OutputRetries int           `yaml:"outputRetries"` // of a failed write
+	OutputBackoff time.Duration `yaml:"outputBackoff"` // before the first retry, doubling
+
+	args []string // Command line, to read again on reload
+}
+
+// loadConfig reads settings from the command line args (those after any
+// subcommand), config file and environment
+func loadConfig(args []string) *Config {
+	cfg := &Config{args: args}
+	configFilePtr := flag.String("config", "", "YAML config file, see envoy.example.yaml (flags override its settings)")
+	flag.StringVar(&cfg.Envoy.Host, "e", "envoy", "IP or hostname of Envoy, or a comma separated list of several, or auto to find them via mDNS")
+	flag.StringVar(&cfg.Influx.Addr, "dba", "http://localhost:8086", "InfluxDB connection address (empty to not write to InfluxDB)")
+	flag.StringVar(&cfg.Influx.Database, "dbn", "solar", "Influx database name (InfluxDB 2.x bucket) to put readings in")
+	flag.StringVar(&cfg.Influx.Version, "dbv", "", "InfluxDB API version, 1 or 2 (default 2 if a token is given)")
+	flag.StringVar(&cfg.Influx.RetentionPolicy, "dbrp", "", "InfluxDB 1.x retention policy (default the database's default)")
+	flag.StringVar(&cfg.Influx.Username, "dbu", "user", "DB username (InfluxDB 1.x)")
+	flag.StringVar(&cfg.Influx.Password, "dbp", "pw", "DB password (InfluxDB 1.x)")
+	flag.StringVar(&cfg.Influx.Token, "dbt", "", "InfluxDB 2.x API token, instead of username/password")
+	flag.StringVar(&cfg.Influx.Org, "dbo", "", "InfluxDB 2.x organisation")
+	flag.StringVar(&cfg.Influx.Measurement, "m", "readings", "Influx measurement name customisation (table name equivalent)")
+	flag.BoolVar(&cfg.Influx.AllFields, "a", false, "Write all eim fields (energy, voltage, current, power factor...), not just watts")
+	flag.BoolVar(&cfg.Influx.Derived, "derived", false, "Also write grid import/export and self-consumption figures derived from the eims")
+	flag.BoolVar(&cfg.Influx.GatewayTags, "gwtags", false, "Tag every point with the Envoy's serial (envoySerial), firmware version and model, read from info.xml at startup")
+	flag.Var(&cfg.Influx.Tags, "tag", "Tag every point with key=value, e.g. orientation=south (can be repeated)")
+	flag.StringVar(&cfg.Influx.Timestamps, "ts", timestampsEnvoy, "Timestamp readings with the Envoy's reading time (envoy) or the poll time (host)")
+	flag.StringVar(&cfg.Influx.Duplicates, "dup", "skip", "Readings unchanged since the last poll: skip, restamp (write with the poll time) or write")
+	flag.BoolVar(&cfg.Envoy.Inverters, "i", false, "Also poll per-microinverter production")
+	flag.StringVar(&cfg.Influx.InverterMeasurement, "mi", "inverters", "Influx measurement name for per-microinverter readings")
+	flag.BoolVar(&cfg.Envoy.Meters, "meters", false, "Also poll per-phase CT meter readings")
+	flag.StringVar(&cfg.Influx.MeterMeasurement, "mm", "meters", "Influx measurement name for per-phase CT meter readings")
+	flag.BoolVar(&cfg.Envoy.Livedata, "livedata", false, "Also poll high resolution power flows from /ivp/livedata/status (firmware 7.x)")
+	flag.StringVar(&cfg.Influx.LivedataMeasurement, "mlive", "livedata", "Influx measurement name for livedata power flows")
+	flag.BoolVar(&cfg.Envoy.Ensemble, "ensemble", false, "Also poll Encharge battery and Enpower status from /ivp/ensemble (firmware 7.x)")
+	flag.StringVar(&cfg.Influx.EnsembleMeasurement, "mens", "ensemble", "Influx measurement name for Encharge and Enpower readings")
+	flag.BoolVar(&cfg.Envoy.Home, "home", false, "Also poll gateway status (Enlighten connection, network, database) from /home.json")
+	flag.StringVar(&cfg.Influx.HomeMeasurement, "mhome", "gateway", "Influx measurement name for gateway status")
+	flag.BoolVar(&cfg.Envoy.Inventory, "inventory", false, "Also poll each microinverter and Q-relay's status (producing, communicating...) from /inventory.json")
+	flag.BoolVar(&cfg.Envoy.Devstatus, "devstatus", false, "Also poll each microinverter's DC and AC voltage, DC current and temperature from /ivp/peb/devstatus (needs an installer login)")
+	flag.BoolVar(&cfg.Envoy.PowerMode, "power-mode", false, "Also poll whether production is switched off at the Envoy, logging when that changes (firmware 7.x)")
+	flag.StringVar(&cfg.Influx.InventoryMeasurement, "minv", "devices", "Influx measurement name for device status")
+	flag.BoolVar(&cfg.Envoy.Energy, "energy", false, "Also poll the Envoy's lifetime energy counters from /ivp/pdm/energy (firmware 7.x)")
+	flag.StringVar(&cfg.Influx.EnergyMeasurement, "menergy", "energy", "Influx measurement name for lifetime energy counters")
+	flag.BoolVar(&cfg.Envoy.Stream, "stream", false, "Also stream CT meter samples about every second from /stream/meter (needs an installer login) to InfluxDB")
+	flag.StringVar(&cfg.Influx.StreamMeasurement, "mstream", "stream", "Influx measurement name for streamed meter samples")
+	flag.StringVar(&cfg.Influx.LinesMeasurement, "mlines", "", "Influx measurement name to write each phase's share of the eims to, on multi-phase sites (default none)")
+	flag.StringVar(&cfg.Influx.ArrayMeasurement, "marray", "", "Influx measurement name to write each array's total microinverter production to, by the panels in the config file (default none)")
+	flag.StringVar(&cfg.Influx.DailyMeasurement, "mday", "", "Influx measurement name to write a summary of each day to when it's over (default none)")
+	flag.StringVar(&cfg.Influx.SelfMeasurement, "mself", "", "Influx measurement name to write the poller's own metrics to each cycle (default none)")
+	flag.StringVar(&cfg.Influx.GapMeasurement, "mgap", "", "Influx measurement name to write an event to for each gap in readings, once polling recovers (default none)")
+	flag.StringVar(&cfg.Influx.StorageMeasurement, "ms", "storage", "Influx measurement name for battery storage readings")
+	flag.StringVar(&cfg.Influx.SpoolDir, "spool", "", "Directory to keep readings in while InfluxDB is unreachable, written once it's back")
+	flag.DurationVar(&cfg.Influx.Downsample, "downsample", 0, "Write each series to InfluxDB as its mean, minimum and maximum over this period, e.g. 1m (default every reading)")
+	flag.DurationVar(&cfg.Influx.Smooth, "smooth", 0, "Write power values to InfluxDB as their moving average over this long, e.g. 30s (default as read)")
+	flag.BoolVar(&cfg.Influx.SmoothRaw, "smooth-raw", false, "With -smooth, also write each power value as read, as <field>Raw")
+	flag.IntVar(&cfg.Influx.BatchSize, "dbbs", 5000, "InfluxDB points per write batch")
+	flag.DurationVar(&cfg.Influx.FlushInterval, "dbfi", time.Second, "InfluxDB maximum time points are held back to batch them before writing")
+	flag.BoolVar(&cfg.Influx.Gzip, "dbgzip", false, "Compress writes to InfluxDB with gzip, for slow links to it")
+	flag.IntVar(&cfg.Influx.RetryBuffer, "dbrb", 50000, "InfluxDB points kept in memory to retry failed writes, without -spool; the oldest are dropped beyond this")
+	flag.StringVar(&cfg.Influx.Proxy, "dbproxy", "", "Proxy to InfluxDB through, e.g. http://proxy:3128 or socks5://jumphost:1080, or direct for none (default from HTTP_PROXY/HTTPS_PROXY/NO_PROXY)")
+	flag.BoolVar(&cfg.Influx.Create, "dbcreate", false, "Create the InfluxDB bucket (InfluxDB 1.x database) at startup if it isn't there")
+	flag.DurationVar(&cfg.Influx.Retention, "dbretention", 0, "With -dbcreate, how long the bucket or database keeps readings, e.g. 720h (default forever)")
+	flag.StringVar(&cfg.Influx.LongTerm, "dblong", "", "With -dbcreate, also create this bucket (InfluxDB 1.x retention policy) and a task copying readings' means into it, as mean_<field> on 1.x (default none)")
+	flag.DurationVar(&cfg.Influx.LongTermEvery, "dblong-every", time.Hour, "Period the means copied into the -dblong bucket are over")
+	flag.DurationVar(&cfg.Influx.LongTermRetention, "dblong-retention", 0, "How long the -dblong bucket keeps the means, e.g. 87600h (default forever)")
+	flag.StringVar(&cfg.Influx.Check, "dbcheck", "", "At startup, check InfluxDB can be written to, and if not: fail, warn, or off to not check (default fail when polling once, warn when polling in a loop)")
+	flag.StringVar(&cfg.Envoy.Token, "et", "", "Envoy access token (firmware 7.x)")
+	flag.StringVar(&cfg.Envoy.Username, "eu", "", "Enlighten username, to obtain an Envoy token (firmware 7.x)")
+	flag.StringVar(&cfg.Envoy.Password, "ep", "", "Enlighten password")
+	flag.StringVar(&cfg.Envoy.Serial, "es", "", "Envoy serial number for token request (default read from Envoy)")
+	flag.StringVar(&cfg.Envoy.TokenCache, "etc", defaultTokenCacheFile(), "File to cache the Enlighten-obtained Envoy token in")
+	flag.StringVar(&cfg.Envoy.DigestUser, "digest-user", "", "Log in to protected pages on firmware before 7.x as this user, installer or envoy")
+	flag.StringVar(&cfg.Envoy.DigestPassword, "digest-pw", "", "Password for -digest-user (default the one derived from the serial)")
+	flag.StringVar(&cfg.Envoy.Firmware, "firmware", "auto", "Probe each Envoy at startup for which API its firmware has, turning off what it lacks (auto), or use the flags as given (off)")
+	flag.StringVar(&cfg.Envoy.Model, "model", "", "Envoy model for the -gwtags model tag, e.g. \"IQ Combiner 4\" (default from its part number)")
+	flag.DurationVar(&cfg.Interval, "l", 0, "Keep polling at this interval, e.g. 30s (default poll once)")
+	flag.Float64Var(&cfg.Latitude, "lat", 0, "Latitude, to poll at the -ln interval between sunset and sunrise")
+	flag.Float64Var(&cfg.Longitude, "lon", 0, "Longitude (east positive)")
+	flag.DurationVar(&cfg.NightInterval, "ln", 10*time.Minute, "Poll interval at night when -lat/-lon are given, 0 to not poll at night")
+	flag.BoolVar(&cfg.Align, "align", false, "Poll on the clock at multiples of the interval, e.g. :00, :15, :30 and :45 with -l 15m")
+	flag.DurationVar(&cfg.Jitter, "jitter", 0, "Delay each poll by a random time up to this, e.g. 5s")
+	flag.Var(&cfg.Cron, "cron", "Keep polling on this cron schedule instead of every -l, e.g. \"* 6-21 * * *\" (can be repeated)")
+	flag.StringVar(&cfg.Health, "health", "", "Serve /healthz and /readyz on this address, e.g. :8080 (requires -l)")
+	flag.StringVar(&cfg.Record, "record", "", "Save every raw Envoy JSON response to timestamped files in this directory")
+	flag.StringVar(&cfg.Replay, "replay", "", "Write the responses saved by -record in this directory to the outputs, instead of polling")
+	flag.StringVar(&cfg.Http, "http", "", "Serve a web dashboard and JSON API of the latest readings on this address, e.g. :8000 (requires -l)")
+	flag.StringVar(&cfg.LogLevel, "log-level", "info", "Log level: debug (includes every reading), info, warn or error")
+	flag.StringVar(&cfg.LogFormat, "log-format", "text", "Log format: text or json")
+	flag.IntVar(&cfg.Envoy.Retries, "r", 3, "Retries of a failed Envoy poll")
+	flag.DurationVar(&cfg.Envoy.RetryBackoff, "rb", time.Second*2, "Wait before the first retry, doubling for each following one")
+	flag.DurationVar(&cfg.Envoy.Timeout, "timeout", 0, "Envoy request timeout (default 2s for production, 10s for inverters, 5s for the rest)")
+	flag.DurationVar(&cfg.Envoy.KeepAlive, "keepalive", 90*time.Second, "Keep connections to the Envoy open this long between requests, 0 to reconnect every time")
+	flag.IntVar(&cfg.Envoy.MaxIdleConns, "max-idle", 3, "Connections to each Envoy kept open at most")
+	flag.IntVar(&cfg.Envoy.Parallel, "parallel", 3, "Envoy endpoints (inverters, meters, inventory...) polled at once, 1 for one after another")
+	flag.Float64Var(&cfg.Envoy.Rate, "rate", 5, "Requests a second to each Envoy at most, across every endpoint and stream, 0 for no limit")
+	flag.StringVar(&cfg.Envoy.Proxy, "envoy-proxy", "", "Proxy to the Envoy through, e.g. http://proxy:3128 or socks5://jumphost:1080, or direct for none (default from HTTP_PROXY/HTTPS_PROXY/NO_PROXY)")
+	flag.DurationVar(&cfg.Envoy.ClockSkew, "skew", 15*time.Minute, "Warn when the Envoy's reading time is this far from the host's clock (0 to not check)")
+	flag.StringVar(&cfg.Envoy.Timezone, "tz", "", "Site timezone, e.g. Europe/London or Local, to also write energy since midnight there (whDay)")
+	flag.BoolVar(&cfg.Envoy.EstimateEnergy, "estimate-wh", false, "Also write production and consumption energy estimated from power, tagged estimated=true, for firmware whose whLifetime freezes")
+	flag.BoolVar(&cfg.Envoy.FixClock, "skew-fix", false, "Correct the Envoy's times by the difference when over -skew")
+	flag.StringVar(&cfg.Prometheus.Listen, "prometheus", "", "Serve Prometheus metrics on this address, e.g. :9090 (requires -l)")
+	flag.StringVar(&cfg.Mqtt.Broker, "mqtt", "", "MQTT broker URL to publish readings to, e.g. tcp://localhost:1883")
+	flag.StringVar(&cfg.Mqtt.Topic, "mqtt-topic", "envoy", "MQTT topic prefix")
+	flag.IntVar(&cfg.Mqtt.Qos, "mqtt-qos", 0, "MQTT QoS level (0, 1 or 2)")
+	flag.StringVar(&cfg.Mqtt.Username, "mqtt-user", "", "MQTT username")
+	flag.StringVar(&cfg.Mqtt.Password, "mqtt-pw", "", "MQTT password")
+	flag.StringVar(&cfg.Mqtt.ClientId, "mqtt-client-id", "", "MQTT client ID, which no other client of the broker may be using at once (default influxEnvoyStats- and a random suffix)")
+	flag.StringVar(&cfg.Mqtt.HomeAssistant, "mqtt-ha", "", "Publish Home Assistant MQTT discovery config under this prefix, e.g. homeassistant")
+	flag.StringVar(&cfg.Postgres.DSN, "pg", "", "PostgreSQL/TimescaleDB connection string to also write readings to, e.g. postgres://user:pw@localhost/solar")
+	flag.StringVar(&cfg.Postgres.Table, "pg-table", "readings", "PostgreSQL table for readings, created if needed")
+	flag.StringVar(&cfg.Csv.Dir, "csv", "", "Directory to also write readings to as a CSV file per day")
+	flag.StringVar(&cfg.Csv.Columns, "csv-columns", "time,site,measurement,type,serial,phase,source,watts", "CSV columns: time, measurement, and any tag or field names")
+	flag.StringVar(&cfg.Sqlite.File, "sqlite", "", "SQLite database file to also write readings to, created if needed")
+	flag.StringVar(&cfg.Out, "out", "", "Output format instead of the configured outputs: jsonl for a line of JSON per reading on stdout")
+	flag.IntVar(&cfg.OutputQueue, "out-queue", 60, "Poll cycles' readings held for each output while it's failing or slow, when polling in a loop, dropping the oldest beyond that")
+	flag.IntVar(&cfg.OutputRetries, "out-retries", 3, "Retries of a failed write to an output, when polling in a loop")
+	flag.DurationVar(&cfg.OutputBackoff, "out-backoff", 5*time.Second, "Wait before retrying a write to an output, doubling for each following retry")
+	flag.StringVar(&cfg.Graphite.Addr, "graphite", "", "Graphite/carbon plaintext host:port to also send readings to, e.g. localhost:2003")
+	flag.StringVar(&cfg.Graphite.Prefix, "graphite-prefix", "envoy", "Graphite metric path prefix")
+	flag.StringVar(&cfg.Otlp.Endpoint, "otlp", "", "OpenTelemetry OTLP/HTTP endpoint to also send readings and the poller's own metrics to, e.g. http://localhost:4318 (the path defaults to /v1/metrics)")
+	flag.Var(&cfg.Otlp.Headers, "otlp-header", "Header for OTLP requests, e.g. \"Authorization: Basic abc\" (can be repeated)")
+	flag.StringVar(&cfg.Otlp.Prefix, "otlp-prefix", "envoy", "OTLP metric name prefix")
+	flag.StringVar(&cfg.Kafka.Brokers, "kafka", "", "Kafka brokers to also publish readings to as JSON, comma separated host:port")
+	flag.StringVar(&cfg.Kafka.Topic, "kafka-topic", "envoy", "Kafka topic")
+	flag.BoolVar(&cfg.Kafka.KeyByType, "kafka-key", false, "Key Kafka messages by reading type (production, net-consumption...)")
+	flag.StringVar(&cfg.Nats.Url, "nats", "", "NATS server URL to also publish readings to as JSON, e.g. nats://localhost:4222")
+	flag.StringVar(&cfg.Nats.Subject, "nats-subject", "envoy.{site}.{measurement}.{type}", "NATS subject template: {site}, {measurement} or any tag name, e.g. {type} or {serial}")
+	flag.BoolVar(&cfg.Nats.JetStream, "nats-js", false, "Publish to a JetStream stream, waiting for acknowledgement")
+	flag.StringVar(&cfg.Webhook.Url, "webhook", "", "URL to also POST each poll's readings to as JSON")
+	flag.Var(&cfg.Webhook.Headers, "webhook-header", "Header for webhook requests, e.g. \"Authorization: Bearer abc\" (can be repeated)")
+	flag.IntVar(&cfg.Webhook.Retries, "webhook-retries", 3, "Retries of a failed webhook request")
+	flag.StringVar(&cfg.Pvoutput.ApiKey, "pvo-key", "", "PVOutput.org API key, to also upload production and consumption")
+	flag.StringVar(&cfg.Pvoutput.SystemId, "pvo-system", "", "PVOutput.org system ID")
+	flag.DurationVar(&cfg.Pvoutput.Interval, "pvo-interval", 5*time.Minute, "PVOutput.org status interval, as set for the system")
+	flag.BoolVar(&cfg.Tariff.Envoy, "tariff-envoy", false, "Cost grid import and export with the tariff set up on the Envoy (needs a total-consumption CT)")
+	flag.Float64Var(&cfg.Tariff.ImportRate, "import-rate", 0, "Cost grid import at this price per kWh (needs a total-consumption CT)")
+	flag.Float64Var(&cfg.Tariff.ExportRate, "export-rate", 0, "Credit grid export at this price per kWh")
+	flag.StringVar(&cfg.Tariff.Currency, "currency", "", "Currency of -import-rate and -export-rate, e.g. GBP, to tag costs with")
+	flag.DurationVar(&cfg.Alerts.InverterOffline, "alert-inverter", 0, "Alert when a microinverter hasn't reported for this long in daylight, e.g. 2h (needs -i, -lat and -lon)")
+	flag.DurationVar(&cfg.Alerts.ZeroProduction, "alert-zero", 0, "Alert when production has been at or near zero for this long in daylight, e.g. 1h (needs -lat and -lon)")
+	flag.Float64Var(&cfg.Alerts.VoltageMin, "alert-vmin", 0, "Alert when the grid voltage has been below this for -alert-vfor, e.g. 216 (needs a production CT)")
+	flag.Float64Var(&cfg.Alerts.VoltageMax, "alert-vmax", 0, "Alert when the grid voltage has been above this for -alert-vfor, e.g. 253 (needs a production CT)")
+	flag.DurationVar(&cfg.Alerts.VoltageFor, "alert-vfor", 10*time.Minute, "How long the grid voltage must stay out of range before alerting")
+	flag.Float64Var(&cfg.Alerts.FrequencyMin, "alert-fmin", 0, "Alert when the grid frequency is found below this, e.g. 49.5 (needs -meters)")
+	flag.Float64Var(&cfg.Alerts.FrequencyMax, "alert-fmax", 0, "Alert when the grid frequency is found above this, e.g. 50.5 (needs -meters)")
+	flag.StringVar(&cfg.Alerts.Webhook, "alert-webhook", "", "URL to POST alerts to as JSON, as well as logging them")
+	flag.BoolVar(&cfg.Alerts.Mqtt, "alert-mqtt", false, "Also publish alerts to MQTT, under <topic>/alerts")
+	flag.StringVar(&cfg.Alerts.Pushover.Token, "pushover-token", "", "Pushover application token, to send alerts to")
+	flag.StringVar(&cfg.Alerts.Pushover.User, "pushover-user", "", "Pushover user or group key")
+	flag.StringVar(&cfg.Alerts.Telegram.Token, "telegram-token", "", "Telegram bot token, to send alerts with")
+	flag.StringVar(&cfg.Alerts.Telegram.ChatId, "telegram-chat", "", "Telegram chat ID to send alerts to")
+	flag.StringVar(&cfg.Alerts.Smtp.Addr, "smtp", "", "SMTP server host:port, to email alerts")
+	flag.StringVar(&cfg.Alerts.Smtp.Username, "smtp-user", "", "SMTP username (default no authentication)")
+	flag.StringVar(&cfg.Alerts.Smtp.Password, "smtp-pw", "", "SMTP password")
+	flag.StringVar(&cfg.Alerts.Smtp.From, "smtp-from", "", "Email address to send alerts from")
+	flag.StringVar(&cfg.Alerts.Smtp.To, "smtp-to", "", "Email addresses to send alerts to, comma separated")
+	flag.StringVar(&cfg.Enlighten.ApiKey, "enlighten-key", "", "Enlighten v4 API key, for backfill")
+	flag.StringVar(&cfg.Enlighten.AccessToken, "enlighten-token", "", "Enlighten v4 API OAuth access token")
+	flag.StringVar(&cfg.Enlighten.SystemId, "enlighten-system", "", "Enlighten system ID")
+	secretFiles := map[string]*string{}
+	for fileFlag, secretFlag := range secretFileFlags {
+		secretFiles[secretFlag] = flag.String(fileFlag, "", "File to read -"+secretFlag+" from, e.g. a Docker or Kubernetes secret")
+	}
+	flag.CommandLine.Parse(args)
+
+	// Remember what was given on the command line, as the config file
+	// and environment overwrite it, then put the command line values back
+	setFlags := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	configFile := *configFilePtr
+	if _, set := setFlags["config"]; !set && os.Getenv(flagEnvVars["config"]) != "" {
+		configFile = os.Getenv(flagEnvVars["config"])
+	}
+	if configFile != "" {
+		yamlData, err := ioutil.ReadFile(configFile)
+		check(err)
+		decoder := yaml.NewDecoder(bytes.NewReader(yamlData))
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+		check(err)
+		markGiven(cfg, yamlData)
+	}
+
+	for name, envVar := range flagEnvVars {
+		if value, ok := os.LookupEnv(envVar); ok && name != "config" {
+			resetList(name)
+			err := flag.Set(name, value)
+			check(err)
+		} else if path, ok := os.LookupEnv(envVar + "_FILE"); ok && name != "config" {
+			resetList(name)
+			err := flag.Set(name, readSecretFile(path))
+			check(err)
+		}
+	}
+
+	for name, value := range setFlags {
+		resetList(name)
+		err := flag.Set(name, value)
+		check(err)
+	}
+	for name, path := range secretFiles {
+		if *path != "" {
+			err := flag.Set(name, readSecretFile(*path))
+			check(err)
+		}
+	}
+
+	// A cron schedule takes the place of -l, which still marks polling
+	// in a loop, and a minute is as often as it can poll
+	if len(cfg.Cron) > 0 && cfg.Interval == 0 {
+		cfg.Interval = time.Minute
+	}
+	return cfg
+}
+
+// readSecretFile is the contents of a file holding a password or the like,
+// less the trailing newline most editors add
+func readSecretFile(path string) string {
+	data, err := ioutil.ReadFile(path)
+	check(err)
+	return strings.TrimRight(string(data), "\r\n")
+}
+
+// stringList is a flag that can be given several times, or as one value
+// of newline separated items, e.g. from an environment variable
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, "\n")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, strings.Split(value, "\n")...)
+	return nil
+}
+
+// resetList empties the named flag if it's a list, so setting it replaces
+// the config file's items rather than adding to them
+func resetList(name string) {
+	if l, ok := flag.Lookup(name).Value.(*stringList); ok {
+		*l = nil
+	}
+}
+
+func defaultTokenCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "influxEnvoyStats", "envoy.token")
+}
+
+// validate reports settings that can't work, before anything is polled
+func (cfg *Config) validate() error {
+	problems := []string{}
+	if cfg.Interval < 0 || cfg.NightInterval < 0 {
+		problems = append(problems, "poll intervals can't be negative")
+	}
+	if _, err := cfg.cronSchedules(); err != nil {
+		problems = append(problems, err.Error())
+	} else if len(cfg.Cron) > 0 && cfg.nextCronPoll(time.Now()).IsZero() {
+		problems = append(problems, "-cron never polls")
+	}
+	if cfg.Jitter < 0 || cfg.Interval > 0 && cfg.Jitter >= cfg.Interval {
+		problems = append(problems, "-jitter must be less than the poll interval (-l)")
+	}
+	if cfg.Interval == 0 && cfg.Prometheus.Listen != "" {
+		problems = append(problems, "-prometheus requires a loop interval (-l)")
+	}
+	if cfg.Interval == 0 && cfg.Http != "" {
+		problems = append(problems, "-http requires a loop interval (-l)")
+	}
+	if cfg.Interval == 0 && cfg.Health != "" {
+		problems = append(problems, "-health requires a loop interval (-l)")
+	}
+	if cfg.Latitude < -90 || cfg.Latitude > 90 || cfg.Longitude < -180 || cfg.Longitude > 180 {
+		problems = append(problems, fmt.Sprintf("location %v,%v is out of range", cfg.Latitude, cfg.Longitude))
+	}
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(strings.ToUpper(cfg.LogLevel))); err != nil {
+		problems = append(problems, "unknown log level "+cfg.LogLevel+", expected debug, info, warn or error")
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		problems = append(problems, "unknown log format "+cfg.LogFormat+", expected text or json")
+	}
+	for _, ec := range cfg.envoyConfigs() {
+		if ec.Host == "" {
+			problems = append(problems, "an Envoy has no host (-e)")
+		}
+		if ec.Username != "" && ec.Password == "" {
+			problems = append(problems, "Enlighten username given for "+ec.Host+" without a password (-ep)")
+		}
+		if ec.Retries < 0 {
+			problems = append(problems, "retries (-r) can't be negative")
+		}
+		if ec.Timeout < 0 || ec.KeepAlive < 0 || ec.MaxIdleConns < 0 {
+			problems = append(problems, "-timeout, -keepalive and -max-idle can't be negative")
+		}
+		if ec.Parallel < 1 {
+			problems = append(problems, "-parallel must be at least 1")
+		}
+		if ec.Rate < 0 {
+			problems = append(problems, "-rate can't be negative")
+		}
+		if _, err := proxyFunc(ec.Proxy); err != nil {
+			problems = append(problems, "-envoy-proxy: "+err.Error())
+		}
+		if ec.Firmware != "auto" && ec.Firmware != "off" {
+			problems = append(problems, "unknown -firmware "+ec.Firmware+", expected auto or off")
+		}
+		if _, err := time.LoadLocation(ec.Timezone); err != nil {
+			problems = append(problems, "unknown timezone "+ec.Timezone+" (-tz)")
+		}
+		if ec.FixClock && ec.ClockSkew <= 0 {
+			problems = append(problems, "correcting the Envoy's clock (-skew-fix) needs a -skew limit")
+		}
+		if ec.DigestUser != "" && ec.DigestPassword == "" && ec.DigestUser != "installer" && ec.DigestUser != "envoy" {
+			problems = append(problems, "-digest-user "+ec.DigestUser+" needs a password (-digest-pw)")
+		}
+		if ec.Stream && (cfg.Interval == 0 || len(cfg.influxConfigs()) == 0 || cfg.Out != "") {
+			problems = append(problems, "-stream requires a loop interval (-l) and writes only to InfluxDB (-dba)")
+		}
+	}
+	if cfg.Tariff.Envoy && (len(cfg.Tariff.Import) > 0 || len(cfg.Tariff.Export) > 0) {
+		problems = append(problems, "use either the Envoy's tariff (-tariff-envoy) or import and export rate schedules")
+	}
+	if _, err := configSchedule(cfg.Tariff.Import); err != nil {
+		problems = append(problems, "import rates: "+err.Error())
+	}
+	if _, err := configSchedule(cfg.Tariff.Export); err != nil {
+		problems = append(problems, "export rates: "+err.Error())
+	}
+	if cfg.Influx.Downsample < 0 {
+		problems = append(problems, "-downsample can't be negative")
+	}
+	if cfg.Influx.Smooth < 0 {
+		problems = append(problems, "-smooth can't be negative")
+	}
+	for _, ic := range cfg.influxConfigs() {
+		if ic.Addr == "" {
+			problems = append(problems, "an InfluxDB in influxes has no addr")
+		}
+		if _, err := ic.apiVersion(); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if _, err := proxyFunc(ic.Proxy); err != nil {
+			problems = append(problems, "-dbproxy: "+err.Error())
+		}
+		if ic.BatchSize < 1 {
+			problems = append(problems, "-dbbs must be at least 1")
+		}
+		if ic.FlushInterval < 0 || ic.RetryBuffer < 0 {
+			problems = append(problems, "-dbfi and -dbrb can't be negative")
+		}
+		if ic.Retention != 0 && ic.Retention < time.Hour || ic.LongTermRetention != 0 && ic.LongTermRetention < time.Hour {
+			problems = append(problems, "InfluxDB retention can't be less than 1h")
+		}
+		if ic.LongTerm != "" && ic.LongTermEvery < time.Second {
+			problems = append(problems, "-dblong-every must be at least 1s")
+		}
+		if ic.LongTerm != "" && ic.LongTerm == ic.Database {
+			problems = append(problems, "-dblong must differ from -dbn")
+		}
+		switch ic.Check {
+		case "", "fail", "warn", "off":
+		default:
+			problems = append(problems, "unknown -dbcheck "+ic.Check+", expected fail, warn or off")
+		}
+	}
+	if len(cfg.influxConfigs()) > 0 {
+		switch cfg.Influx.Duplicates {
+		case "skip", "restamp", "write":
+		default:
+			problems = append(problems, "unknown duplicates mode "+cfg.Influx.Duplicates+", expected skip, restamp or write")
+		}
+	}
+	if cfg.Influx.Timestamps != timestampsEnvoy && cfg.Influx.Timestamps != timestampsHost {
+		problems = append(problems, "unknown timestamps "+cfg.Influx.Timestamps+", expected envoy or host")
+	}
+	if cfg.Postgres.DSN != "" && cfg.Postgres.Table == "" {
+		problems = append(problems, "PostgreSQL needs a table name (-pg-table)")
+	}
+	if cfg.Csv.Dir != "" && strings.TrimSpace(cfg.Csv.Columns) == "" {
+		problems = append(problems, "CSV output needs some columns (-csv-columns)")
+	}
+	if cfg.OutputQueue < 1 || cfg.OutputRetries < 0 || cfg.OutputBackoff < 0 {
+		problems = append(problems, "-out-queue must be at least 1, and -out-retries and -out-backoff can't be negative")
+	}
+	if cfg.Out != "" && cfg.Out != "jsonl" {
+		problems = append(problems, "unknown output format "+cfg.Out+", expected jsonl")
+	}
+	if cfg.Kafka.Brokers != "" && cfg.Kafka.Topic == "" {
+		problems = append(problems, "Kafka needs a topic (-kafka-topic)")
+	}
+	if cfg.Nats.Url != "" && cfg.Nats.Subject == "" {
+		problems = append(problems, "NATS needs a subject (-nats-subject)")
+	}
+	for _, tag := range cfg.Influx.Tags {
+		if key, _, ok := strings.Cut(tag, "="); !ok || strings.TrimSpace(key) == "" {
+			problems = append(problems, "tag "+tag+" isn't key=value (-tag)")
+		}
+	}
+	for _, h := range cfg.Webhook.Headers {
+		if !strings.Contains(h, ":") {
+			problems = append(problems, "webhook header "+h+" should be Name: value")
+		}
+	}
+	if cfg.Otlp.Endpoint != "" {
+		if u, err := url.Parse(cfg.Otlp.Endpoint); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			problems = append(problems, "OTLP endpoint "+cfg.Otlp.Endpoint+" should be an http or https URL (-otlp)")
+		}
+	}
+	for _, h := range cfg.Otlp.Headers {
+		if !strings.Contains(h, ":") {
+			problems = append(problems, "OTLP header "+h+" should be Name: value")
+		}
+	}
+	if cfg.Pvoutput.ApiKey != "" {
+		if cfg.Pvoutput.SystemId == "" {
+			problems = append(problems, "PVOutput needs a system ID (-pvo-system)")
+		}
+		switch cfg.Pvoutput.Interval {
+		case 5 * time.Minute, 10 * time.Minute, 15 * time.Minute:
+		default:
+			problems = append(problems, "PVOutput status interval (-pvo-interval) should be 5m, 10m or 15m")
+		}
+		if cfg.Interval == 0 || cfg.Interval > cfg.Pvoutput.Interval {
+			problems = append(problems, "PVOutput needs a loop interval (-l) no longer than its status interval")
+		}
+	}
+	if cfg.Alerts.InverterOffline > 0 {
+		if cfg.Latitude == 0 && cfg.Longitude == 0 {
+			problems = append(problems, "inverter offline alerts (-alert-inverter) need a location (-lat, -lon) to know when it's daylight")
+		}
+		inverters := false
+		for _, ec := range cfg.envoyConfigs() {
+			inverters = inverters || ec.Inverters
+		}
+		if !inverters {
+			problems = append(problems, "inverter offline alerts (-alert-inverter) need inverters polled (-i)")
+		}
+	}
+	if cfg.Influx.ArrayMeasurement != "" {
+		arrays := false
+		for _, panel := range cfg.Influx.Panels {
+			arrays = arrays || panel.Array != ""
+		}
+		if !arrays {
+			problems = append(problems, "array totals (-marray) need panels with an array under influx in the config file")
+		}
+		inverters := false
+		for _, ec := range cfg.envoyConfigs() {
+			inverters = inverters || ec.Inverters
+		}
+		if !inverters {
+			problems = append(problems, "array totals (-marray) need inverters polled (-i)")
+		}
+	}
+	if cfg.Alerts.VoltageMin < 0 || cfg.Alerts.VoltageMax < 0 || cfg.Alerts.VoltageFor < 0 {
+		problems = append(problems, "-alert-vmin, -alert-vmax and -alert-vfor can't be negative")
+	}
+	if cfg.Alerts.VoltageMax > 0 && cfg.Alerts.VoltageMin >= cfg.Alerts.VoltageMax {
+		problems = append(problems, "-alert-vmin must be below -alert-vmax")
+	}
+	if cfg.Alerts.FrequencyMin > 0 || cfg.Alerts.FrequencyMax > 0 {
+		if cfg.Alerts.FrequencyMax > 0 && cfg.Alerts.FrequencyMin >= cfg.Alerts.FrequencyMax {
+			problems = append(problems, "-alert-fmin must be below -alert-fmax")
+		}
+		meters := false
+		for _, ec := range cfg.envoyConfigs() {
+			meters = meters || ec.Meters
+		}
+		if !meters {
+			problems = append(problems, "grid frequency alerts (-alert-fmin, -alert-fmax) need the CT meters polled (-meters)")
+		}
+	}
+	if cfg.Alerts.ZeroProduction > 0 && cfg.Latitude == 0 && cfg.Longitude == 0 {
+		problems = append(problems, "zero production alerts (-alert-zero) need a location (-lat, -lon) to know when it's daylight")
+	}
+	for _, rule := range cfg.Alerts.Rules {
+		if rule.Field == "" {
+			problems = append(problems, "alert rule "+rule.String()+" has no field")
+		}
+		if _, ok := rule.compare(0); !ok {
+			problems = append(problems, "alert rule "+rule.String()+" has unknown op "+rule.Op+", expected <, <=, >, >=, == or !=")
+		}
+		if rule.For < 0 {
+			problems = append(problems, "alert rule "+rule.String()+" can't have a negative duration")
+		}
+	}
+	if cfg.Alerts.Pushover.Token != "" && cfg.Alerts.Pushover.User == "" {
+		problems = append(problems, "Pushover needs a user key (-pushover-user)")
+	}
+	if cfg.Alerts.Telegram.Token != "" && cfg.Alerts.Telegram.ChatId == "" {
+		problems = append(problems, "Telegram needs a chat ID (-telegram-chat)")
+	}
+	if cfg.Alerts.Smtp.Addr != "" && (cfg.Alerts.Smtp.From == "" || cfg.Alerts.Smtp.To == "") {
+		problems = append(problems, "email alerts need from and to addresses (-smtp-from, -smtp-to)")
+	}
+	if cfg.Alerts.Mqtt && cfg.Mqtt.Broker == "" {
+		problems = append(problems, "alerts to MQTT (-alert-mqtt) need a broker (-mqtt)")
+	}
+	if cfg.Mqtt.Qos < 0 || cfg.Mqtt.Qos > 2 {
+		problems = append(problems, fmt.Sprintf("MQTT QoS %d, expected 0, 1 or 2", cfg.Mqtt.Qos))
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// nextPollDelay is the time until the next -cron poll, or the loop
+// interval, or with a location given, the night interval or time until
+// sunrise when the sun is down at the poll time
+func (cfg *Config) nextPollDelay(from time.Time) time.Duration {
+	if len(cfg.Cron) > 0 {
+		return cfg.nextCronPoll(from).Sub(from)
+	}
+	if cfg.Latitude == 0 && cfg.Longitude == 0 {
+		return cfg.Interval
+	}
+	t := from.Add(cfg.Interval)
+	if isDaylight(t, cfg.Latitude, cfg.Longitude) {
+		return cfg.Interval
+	}
+	untilSunrise := nextSunrise(t, cfg.Latitude, cfg.Longitude).Sub(from)
+	if cfg.NightInterval > 0 && cfg.NightInterval < untilSunrise {
+		return cfg.NightInterval
+	}
+	return untilSunrise
+}
+
+// alignPoll moves a poll at t on to the next multiple of the interval
+// since midnight, with -align
+func (cfg *Config) alignPoll(t time.Time) time.Time {
+	if !cfg.Align || cfg.Interval <= 0 {
+		return t
+	}
+	// Truncate works from UTC, so shift to local time and back
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	aligned := t.Add(shift).Truncate(cfg.Interval).Add(-shift)
+	if aligned.Before(t) {
+		aligned = aligned.Add(cfg.Interval)
+	}
+	return aligned
+}
+
+// pollJitter is a random delay for a poll, up to -jitter
+func (cfg *Config) pollJitter() time.Duration {
+	if cfg.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(cfg.Jitter)))
+}
+
+// envoyConfigs lists each Envoy to poll: either those in the config
+// file's envoys list, or those in the comma separated host setting
+func (cfg *Config) envoyConfigs() []EnvoyConfig {
+	configs := []EnvoyConfig{}
+	if len(cfg.Envoys) > 0 {
+		for _, e := range cfg.Envoys {
+			configs = append(configs, mergeEnvoyConfig(cfg.Envoy, e))
+		}
+		return configs
+	}
+	for _, host := range strings.Split(cfg.Envoy.Host, ",") {
+		e := cfg.Envoy
+		e.Host = strings.TrimSpace(host)
+		configs = append(configs, e)
+	}
+	return configs
+}
+
+// markGiven notes the keys set in each envoys and influxes entry of the
+// config file, as a setting given as false, 0 or "" looks the same as one
+// not given
+func markGiven(cfg *Config, yamlData []byte) {
+	var entries struct {
+		Envoys   []map[string]interface{} `yaml:"envoys"`
+		Influxes []map[string]interface{} `yaml:"influxes"`
+	}
+	check(yaml.Unmarshal(yamlData, &entries))
+	keys := func(entry map[string]interface{}) map[string]bool {
+		given := map[string]bool{}
+		for key := range entry {
+			given[key] = true
+		}
+		return given
+	}
+	for i, entry := range entries.Envoys {
+		cfg.Envoys[i].given = keys(entry)
+	}
+	for i, entry := range entries.Influxes {
+		cfg.Influxes[i].given = keys(entry)
+	}
+}
+
+// influxConfigs lists each InfluxDB to write to: either those in the
+// config file's influxes list, or the one influx setting, unless it has no
+// address
+func (cfg *Config) influxConfigs() []InfluxConfig {
+	configs := []InfluxConfig{}
+	if len(cfg.Influxes) > 0 {
+		for _, i := range cfg.Influxes {
+			configs = append(configs, mergeInfluxConfig(cfg.Influx, i))
+		}
+		return configs
+	}
+	if cfg.Influx.Addr != "" {
+		configs = append(configs, cfg.Influx)
+	}
+	return configs
+}
+
+// mergeInfluxConfig is base with the connection settings given in override
+// replacing it; the points written are the same for every InfluxDB.  The
+// credentials are replaced together, as one InfluxDB's token and another's
+// username don't mix.
+func mergeInfluxConfig(base InfluxConfig, override InfluxConfig) InfluxConfig {
+	merged := base
+	if override.Version != "" {
+		merged.Version = override.Version
+	}
+	if override.Addr != "" {
+		merged.Addr = override.Addr
+	}
+	if override.Database != "" {
+		merged.Database = override.Database
+	}
+	if override.RetentionPolicy != "" {
+		merged.RetentionPolicy = override.RetentionPolicy
+	}
+	if override.Token != "" || override.Username != "" {
+		merged.Token, merged.Org = override.Token, override.Org
+		merged.Username, merged.Password = override.Username, override.Password
+	}
+	if override.Proxy != "" {
+		merged.Proxy = override.Proxy
+	}
+	if override.Check != "" {
+		merged.Check = override.Check
+	}
+	if override.given["spoolDir"] {
+		merged.SpoolDir = override.SpoolDir
+	}
+	if override.BatchSize != 0 {
+		merged.BatchSize = override.BatchSize
+	}
+	if override.given["flushInterval"] {
+		merged.FlushInterval = override.FlushInterval
+	}
+	if override.given["gzip"] {
+		merged.Gzip = override.Gzip
+	}
+	if override.given["retryBuffer"] {
+		merged.RetryBuffer = override.RetryBuffer
+	}
+	if override.given["create"] {
+		merged.Create = override.Create
+	}
+	if override.given["retention"] {
+		merged.Retention = override.Retention
+	}
+	if override.given["longTerm"] {
+		merged.LongTerm = override.LongTerm
+	}
+	if override.LongTermEvery != 0 {
+		merged.LongTermEvery = override.LongTermEvery
+	}
+	if override.given["longTermRetention"] {
+		merged.LongTermRetention = override.LongTermRetention
+	}
+	return merged
+}
+
+// mergeEnvoyConfig is base with any settings given in override replacing it
+func mergeEnvoyConfig(base EnvoyConfig, override EnvoyConfig) EnvoyConfig {
+	merged := base
+	if override.Host != "" {
+		merged.Host = override.Host
+	}
+	if override.Site != "" {
+		merged.Site = override.Site
+	}
+	if override.Token != "" {
+		merged.Token = override.Token
+	}
+	if override.Username != "" {
+		merged.Username = override.Username
+		merged.Password = override.Password
+	}
+	if override.Serial != "" {
+		merged.Serial = override.Serial
+	}
+	if override.TokenCache != "" {
+		merged.TokenCache = override.TokenCache
+	}
+	if override.DigestUser != "" {
+		merged.DigestUser = override.DigestUser
+		merged.DigestPassword = override.DigestPassword
+	}
+	if override.given["inverters"] {
+		merged.Inverters = override.Inverters
+	}
+	if override.given["meters"] {
+		merged.Meters = override.Meters
+	}
+	if override.given["livedata"] {
+		merged.Livedata = override.Livedata
+	}
+	if override.given["ensemble"] {
+		merged.Ensemble = override.Ensemble
+	}
+	if override.given["home"] {
+		merged.Home = override.Home
+	}
+	if override.given["inventory"] {
+		merged.Inventory = override.Inventory
+	}
+	if override.given["devstatus"] {
+		merged.Devstatus = override.Devstatus
+	}
+	if override.given["powerMode"] {
+		merged.PowerMode = override.PowerMode
+	}
+	if override.given["energy"] {
+		merged.Energy = override.Energy
+	}
+	if override.given["stream"] {
+		merged.Stream = override.Stream
+	}
+	if override.given["retries"] {
+		merged.Retries = override.Retries
+	}
+	if override.RetryBackoff != 0 {
+		merged.RetryBackoff = override.RetryBackoff
+	}
+	if override.Timeout != 0 {
+		merged.Timeout = override.Timeout
+	}
+	if override.given["keepAlive"] {
+		merged.KeepAlive = override.KeepAlive
+	}
+	if override.MaxIdleConns != 0 {
+		merged.MaxIdleConns = override.MaxIdleConns
+	}
+	if override.Parallel != 0 {
+		merged.Parallel = override.Parallel
+	}
+	if override.given["rate"] {
+		merged.Rate = override.Rate
+	}
+	if override.Proxy != "" {
+		merged.Proxy = override.Proxy
+	}
+	if override.given["clockSkew"] {
+		merged.ClockSkew = override.ClockSkew
+	}
+	if override.given["fixClock"] {
+		merged.FixClock = override.FixClock
+	}
+	if override.given["timezone"] {
+		merged.Timezone = override.Timezone
+	}
+	if override.given["estimateEnergy"] {
+		merged.EstimateEnergy = override.EstimateEnergy
+	}
+	if override.Firmware != "" {
+		merged.Firmware = override.Firmware
+	}
+	if override.Model != "" {
+		merged.Model = override.Model
+	}
+	return merged
+}
+
+// location is the site's timezone, nil if none is set
+func (ec EnvoyConfig) location() *time.Location {
+	if ec.Timezone == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(ec.Timezone)
+	check(err)
+	return loc
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseYAMLConfig reads a config file's settings over base, as loadConfig
+// does
+func parseYAMLConfig(t *testing.T, base Config, yamlData string) *Config {
+	cfg := &base
+	decoder := yaml.NewDecoder(bytes.NewReader([]byte(yamlData)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil {
+		t.Fatal(err)
+	}
+	markGiven(cfg, []byte(yamlData))
+	return cfg
+}
+
+func TestEnvoyConfigsMerge(t *testing.T) {
+	base := Config{Envoy: EnvoyConfig{Inverters: true, Retries: 2, Rate: 5, Timezone: "Europe/London", Parallel: 4}}
+	cfg := parseYAMLConfig(t, base, `
+envoys:
+  - host: envoy1
+  - host: envoy2
+    inverters: false
+    retries: 0
+    rate: 0
+    timezone: ""
+`)
+
+	configs := cfg.envoyConfigs()
+	if len(configs) != 2 {
+		t.Fatalf("%d envoys, want 2", len(configs))
+	}
+	first, second := configs[0], configs[1]
+	if first.Host != "envoy1" || !first.Inverters || first.Retries != 2 || first.Rate != 5 || first.Timezone != "Europe/London" {
+		t.Errorf("first envoy %+v, want the base settings", first)
+	}
+	if second.Host != "envoy2" || second.Inverters || second.Retries != 0 || second.Rate != 0 || second.Timezone != "" {
+		t.Errorf("second envoy %+v, want false, 0 and empty settings to override", second)
+	}
+	if second.Parallel != 4 {
+		t.Errorf("second envoy parallel %d, want the base's 4", second.Parallel)
+	}
+}
+
+func TestEnvoyConfigsHosts(t *testing.T) {
+	cfg := &Config{Envoy: EnvoyConfig{Host: "envoy1, envoy2", Retries: 3}}
+
+	configs := cfg.envoyConfigs()
+	if len(configs) != 2 || configs[0].Host != "envoy1" || configs[1].Host != "envoy2" {
+		t.Fatalf("envoys %+v, want envoy1 and envoy2", configs)
+	}
+	if configs[1].Retries != 3 {
+		t.Errorf("retries %d, want 3", configs[1].Retries)
+	}
+}
+
+func TestInfluxConfigsMerge(t *testing.T) {
+	base := Config{Influx: InfluxConfig{Addr: "http://localhost:8086", Database: "solar", RetryBuffer: 1000, Retention: 24 * time.Hour}}
+	cfg := parseYAMLConfig(t, base, `
+influxes:
+  - addr: http://influx1:8086
+  - addr: http://influx2:8086
+    database: other
+    retryBuffer: 0
+    retention: 0s
+`)
+
+	configs := cfg.influxConfigs()
+	if len(configs) != 2 {
+		t.Fatalf("%d influxes, want 2", len(configs))
+	}
+	first, second := configs[0], configs[1]
+	if first.Addr != "http://influx1:8086" || first.Database != "solar" || first.RetryBuffer != 1000 || first.Retention != 24*time.Hour {
+		t.Errorf("first influx %+v, want the base settings", first)
+	}
+	if second.Database != "other" || second.RetryBuffer != 0 || second.Retention != 0 {
+		t.Errorf("second influx %+v, want 0 settings to override", second)
+	}
+}
+
+func TestInfluxConfigsWithoutAddr(t *testing.T) {
+	cfg := &Config{Influx: InfluxConfig{Database: "solar"}}
+
+	if configs := cfg.influxConfigs(); len(configs) != 0 {
+		t.Errorf("influxes %+v, want none without an address", configs)
+	}
+}
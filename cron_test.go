@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"30-10 * * * *",
+		"* * * foo *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	for _, c := range []struct {
+		expr, from, want string
+	}{
+		{"* * * * *", "2024-03-01 10:00", "2024-03-01 10:01"},
+		{"*/5 6-21 * * *", "2024-03-01 10:02", "2024-03-01 10:05"},
+		{"*/5 6-21 * * *", "2024-03-01 21:55", "2024-03-02 06:00"},
+		{"0 * * * *", "2024-03-01 23:30", "2024-03-02 00:00"},
+		{"0 12 * * sun", "2024-03-01 10:00", "2024-03-03 12:00"},
+		{"0 12 * * 7", "2024-03-01 10:00", "2024-03-03 12:00"},
+		{"0 0 1 jan *", "2024-03-01 10:00", "2025-01-01 00:00"},
+		{"0 0 29 feb *", "2024-03-01 10:00", "2028-02-29 00:00"},
+		// Both day fields restricted runs on either
+		{"0 0 15 * mon", "2024-03-01 10:00", "2024-03-04 00:00"},
+		{"15/20 * * * *", "2024-03-01 10:40", "2024-03-01 10:55"},
+	} {
+		s, err := parseCron(c.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", c.expr, err)
+			continue
+		}
+		if got := s.next(at(c.from)); !got.Equal(at(c.want)) {
+			t.Errorf("%q after %s is %s, want %s", c.expr, c.from, got.Format("2006-01-02 15:04"), c.want)
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	s, err := parseCron("0 0 30 feb *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := s.next(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)); !next.IsZero() {
+		t.Errorf("30 February is %s, want never", next)
+	}
+}
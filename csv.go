@@ -0,0 +1,102 @@
+package main
+
+// CSV output: a row per point appended to a file per day, named by the
+// readings' local date, e.g. readings-2024-01-31.csv
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type CsvWriter struct {
+	dir     string
+	columns []string
+	influx  InfluxConfig // Measurement names and fields to write
+	dedupe  *dedupe
+}
+
+func NewCsvWriter(cfg CsvConfig, influx InfluxConfig) *CsvWriter {
+	err := os.MkdirAll(cfg.Dir, 0755)
+	check(err)
+	columns := []string{}
+	for _, c := range strings.Split(cfg.Columns, ",") {
+		columns = append(columns, strings.TrimSpace(c))
+	}
+	return &CsvWriter{dir: cfg.Dir, columns: columns, influx: influx, dedupe: newDedupe(influx.Duplicates)}
+}
+
+// row is p's values for the columns: time, measurement, or any tag or
+// field name, empty where p doesn't have it
+func (w *CsvWriter) row(p point) []string {
+	row := make([]string, len(w.columns))
+	for i, column := range w.columns {
+		switch column {
+		case "time":
+			row[i] = p.time.Format(time.RFC3339)
+		case "measurement":
+			row[i] = p.measurement
+		default:
+			if tag, ok := p.tags[column]; ok {
+				row[i] = tag
+			} else if field, ok := p.fields[column]; ok {
+				row[i] = fmt.Sprint(field)
+			}
+		}
+	}
+	return row
+}
+
+func (w *CsvWriter) Write(readings []EnvoyReadings) error {
+	days := map[string][][]string{}
+	order := []string{}
+	for _, r := range readings {
+		for _, p := range w.dedupe.filter(readingsToPoints(w.influx, r), r.PollTime) {
+			day := p.time.Local().Format("2006-01-02")
+			if _, ok := days[day]; !ok {
+				order = append(order, day)
+			}
+			days[day] = append(days[day], w.row(p))
+		}
+	}
+	for _, day := range order {
+		if err := w.append(filepath.Join(w.dir, "readings-"+day+".csv"), days[day]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append adds rows to the file, starting it with a header if it's new
+func (w *CsvWriter) append(file string, rows [][]string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	out := csv.NewWriter(f)
+	if info.Size() == 0 {
+		out.Write(w.columns)
+	}
+	out.WriteAll(rows)
+	if err := out.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Flush is a no-op as each Write goes straight to the file
+func (w *CsvWriter) Flush() error {
+	return nil
+}
+
+func (w *CsvWriter) Close() error {
+	return nil
+}
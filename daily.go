@@ -0,0 +1,55 @@
+package main
+
+// Daily energy in the site's timezone.  The Envoy's whToday resets at its
+// own midnight, which needn't match the database's day or arrive on time,
+// so with a timezone set each eim also gets whDay: energy since midnight
+// in that timezone, worked out from whLifetime, and the day it's for.
+
+import (
+	"sync"
+	"time"
+)
+
+// dayStart is an eim's lifetime energy as its day began
+type dayStart struct {
+	day          string
+	whLifetime   float64
+	lastLifetime float64 // As last seen, to start the next day from
+}
+
+var (
+	dayStartsMu sync.Mutex
+	dayStarts   = map[string]*dayStart{} // By host and eim type
+)
+
+// DayEnergy is an eim's energy so far on Day in the site's timezone
+type DayEnergy struct {
+	Day   string // e.g. 2024-01-31
+	WhDay float64
+}
+
+// dayEnergy works out r's daily energy per eim type in loc
+func dayEnergy(host string, r EnvoyReadings, loc *time.Location) map[string]DayEnergy {
+	dayStartsMu.Lock()
+	defer dayStartsMu.Unlock()
+	energy := map[string]DayEnergy{}
+	for _, eim := range r.eims() {
+		if eim.ReadingTime == 0 {
+			continue
+		}
+		day := time.Unix(eim.ReadingTime, 0).In(loc).Format("2006-01-02")
+		key := host + "/" + eim.MeasurementType
+		start, ok := dayStarts[key]
+		switch {
+		case !ok:
+			// Started mid-day: trust the Envoy's count so far
+			start = &dayStart{day: day, whLifetime: eim.WhLifetime - eim.WhToday}
+			dayStarts[key] = start
+		case start.day != day:
+			start.day, start.whLifetime = day, start.lastLifetime
+		}
+		start.lastLifetime = eim.WhLifetime
+		energy[eim.MeasurementType] = DayEnergy{Day: day, WhDay: eim.WhLifetime - start.whLifetime}
+	}
+	return energy
+}
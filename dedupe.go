@@ -0,0 +1,79 @@
+package main
+
+// The eim readingTime only moves on every few minutes on some firmware
+// (as does each inverter's lastReportDate), so polling more often would
+// write the same point again and again.  dedupe drops such repeats, or
+// re-stamps them with the poll time.
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	timestampsEnvoy = "envoy"
+	timestampsHost  = "host"
+)
+
+const (
+	duplicatesSkip    = "skip"
+	duplicatesRestamp = "restamp"
+	duplicatesWrite   = "write"
+)
+
+type dedupe struct {
+	mode string
+	last map[string]seenPoint // by series
+}
+
+// seenPoint is a series' latest point time, and the poll it was first seen
+// in, so the same poll's points written again on a retry aren't repeats
+type seenPoint struct {
+	time time.Time
+	poll time.Time
+}
+
+func newDedupe(mode string) *dedupe {
+	switch mode {
+	case duplicatesSkip, duplicatesRestamp, duplicatesWrite:
+	default:
+		panic("unknown duplicates mode " + mode + ", expected skip, restamp or write")
+	}
+	return &dedupe{mode: mode, last: map[string]seenPoint{}}
+}
+
+func seriesKey(p point) string {
+	keys := make([]string, 0, len(p.tags))
+	for k, v := range p.tags {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	return p.measurement + "," + strings.Join(keys, ",")
+}
+
+// filter drops or re-stamps the points from poll unchanged since an
+// earlier poll
+func (d *dedupe) filter(points []point, poll time.Time) []point {
+	if d.mode == duplicatesWrite {
+		return points
+	}
+	kept := make([]point, 0, len(points))
+	for _, p := range points {
+		key := seriesKey(p)
+		last, seen := d.last[key]
+		if seen && p.time.Equal(last.time) && !poll.Equal(last.poll) {
+			if d.mode == duplicatesSkip {
+				continue
+			}
+			p.time = poll
+			kept = append(kept, p)
+			continue
+		}
+		if !seen || !p.time.Equal(last.time) {
+			d.last[key] = seenPoint{time: p.time, poll: poll}
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
@@ -0,0 +1,65 @@
+package main
+
+// Grid and self-consumption figures derived from the production and
+// total-consumption eims, saving awkward queries to do the same
+
+import "github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+
+// Derived is calculated from one poll's eims
+type Derived struct {
+	ReadingTime            int64
+	GridImportWatts        float64
+	GridExportWatts        float64
+	SelfConsumptionWatts   float64
+	SelfConsumptionPercent float64 // of production used on site
+	SelfSufficiencyPercent float64 // of consumption supplied by production
+}
+
+// derive needs a total-consumption eim, so returns false without one
+func derive(r EnvoyReadings) (Derived, bool) {
+	var total *envoy.Eim
+	for i := range r.Consumption {
+		if r.Consumption[i].MeasurementType == "total-consumption" {
+			total = &r.Consumption[i]
+		}
+	}
+	if total == nil {
+		return Derived{}, false
+	}
+
+	// Production can read slightly negative at night
+	production := r.Production.WNow
+	if production < 0 {
+		production = 0
+	}
+	consumption := total.WNow
+
+	d := Derived{ReadingTime: total.ReadingTime}
+	net := consumption - production
+	if net > 0 {
+		d.GridImportWatts = net
+	} else {
+		d.GridExportWatts = -net
+	}
+	d.SelfConsumptionWatts = consumption
+	if production < consumption {
+		d.SelfConsumptionWatts = production
+	}
+	if production > 0 {
+		d.SelfConsumptionPercent = d.SelfConsumptionWatts / production * 100
+	}
+	if consumption > 0 {
+		d.SelfSufficiencyPercent = d.SelfConsumptionWatts / consumption * 100
+	}
+	return d, true
+}
+
+func (d Derived) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"gridImportWatts":        d.GridImportWatts,
+		"gridExportWatts":        d.GridExportWatts,
+		"selfConsumptionWatts":   d.SelfConsumptionWatts,
+		"selfConsumptionPercent": d.SelfConsumptionPercent,
+		"selfSufficiencyPercent": d.SelfSufficiencyPercent,
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+// Firmware detection: with -firmware auto, each Envoy is probed at startup
+// to find which API its firmware has, and which model it is, so the
+// endpoints and authentication suit it without users needing to know which
+// flags go with which firmware.
+
+import (
+	"fmt"
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+)
+
+// detectFirmware probes client's Envoy and adjusts ec to suit its firmware,
+// turning off with a warning what it doesn't have.  It fails if the
+// firmware needs a token and there's no way to get one, and gives nil if
+// the Envoy can't be probed, leaving the settings as given.
+func detectFirmware(client *envoy.Client, ec *EnvoyConfig) *envoy.Firmware {
+	fw, err := client.Detect()
+	if err != nil {
+		slog.Warn("Detecting the Envoy's firmware failed, using the settings as given", "host", ec.Host, "err", err)
+		return nil
+	}
+	slog.Info("Firmware", "host", ec.Host, "version", fw.Info.Device.Software, "model", fw.Info.Model(), "tokens", fw.Tokens, "productionJSON", fw.ProductionJSON)
+
+	off := func(enabled *bool, flag string, why string) {
+		if *enabled {
+			slog.Warn("Not polling "+flag+", "+why, "host", ec.Host, "firmware", fw.Info.Device.Software)
+			*enabled = false
+		}
+	}
+
+	if !fw.Info.Metered() {
+		model := fw.Info.Model()
+		if ec.Model != "" {
+			model = ec.Model
+		}
+		off(&ec.Meters, "-meters", "the "+model+" has no CT inputs")
+		off(&ec.Stream, "-stream", "the "+model+" has no CT inputs")
+	}
+	if fw.Tokens {
+		if ec.Token == "" && ec.Username == "" {
+			check(fmt.Errorf("%s has firmware %s - %w (-et) or Enlighten credentials (-eu/-ep)", ec.Host, fw.Info.Device.Software, envoy.ErrTokenRequired))
+		}
+		return fw
+	}
+
+	if ec.Token != "" || ec.Username != "" {
+		slog.Warn("Firmware before 7.x doesn't use tokens, ignoring -et/-eu", "host", ec.Host, "firmware", fw.Info.Device.Software)
+		ec.Token, ec.Username, ec.Password = "", "", ""
+		client.Token = ""
+	}
+	off(&ec.Livedata, "-livedata", "it needs firmware 7.x")
+	off(&ec.Ensemble, "-ensemble", "it needs firmware 7.x")
+	off(&ec.PowerMode, "-power-mode", "it needs firmware 7.x")
+	off(&ec.Energy, "-energy", "it needs firmware 7.x")
+	if !fw.ProductionJSON {
+		off(&ec.Meters, "-meters", "the firmware has only production totals")
+		off(&ec.Stream, "-stream", "the firmware has only production totals")
+	}
+	return fw
+}
+
+// selectForRole looks at whose the token is: an installer's token also
+// polls what only installers may read, which an owner's would have
+// refused every poll, so those are turned off with a warning.  streamable
+// is whether the meter stream's other needs are met.
+func selectForRole(client *envoy.Client, ec *EnvoyConfig, streamable bool) {
+	token := client.Token
+	if client.Tokens != nil {
+		var err error
+		token, err = client.Tokens.Token()
+		if err != nil {
+			slog.Warn("Getting a token to check its role failed", "host", ec.Host, "err", err)
+			return
+		}
+	}
+	info, err := envoy.ParseToken(token)
+	if err != nil || info.Role == "" {
+		return
+	}
+	slog.Info("Token", "host", ec.Host, "role", info.Role, "expires", info.Expiry)
+
+	installerOnly := []struct {
+		enabled *bool
+		flag    string
+		wanted  bool
+	}{
+		{&ec.Devstatus, "-devstatus", true},
+		{&ec.Stream, "-stream", streamable},
+	}
+	for _, e := range installerOnly {
+		switch {
+		case info.Role == "installer" && !*e.enabled && e.wanted:
+			slog.Info("Installer token, also polling "+e.flag, "host", ec.Host)
+			*e.enabled = true
+		case info.Role != "installer" && *e.enabled:
+			slog.Warn("Not polling "+e.flag+", it needs an installer token", "host", ec.Host, "role", info.Role)
+			*e.enabled = false
+		}
+	}
+}
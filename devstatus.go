@@ -0,0 +1,33 @@
+package main
+
+// Microinverters' DC and AC readings and temperature from
+// /ivp/peb/devstatus (-devstatus), to diagnose a failing panel or
+// inverter.  It needs an installer login.
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+)
+
+func pollDevstatus(gw gateway) []envoy.DeviceStatus {
+	devices, err := gw.client.GetDeviceStatus()
+	check(err)
+	for _, d := range devices {
+		slog.Debug("Device status", "site", gw.site, "serial", d.SerialNumber, "dcVoltage", d.DCVoltage, "dcCurrent", d.DCCurrent, "acVoltage", d.ACVoltage, "temperature", d.Temperature)
+	}
+	return devices
+}
+
+// devstatusFields is a microinverter's fields from devstatus, written
+// alongside those from -i
+func devstatusFields(d envoy.DeviceStatus) map[string]interface{} {
+	return map[string]interface{}{
+		"dcVoltage":     d.DCVoltage,
+		"dcCurrent":     d.DCCurrent,
+		"acVoltage":     d.ACVoltage,
+		"temperature":   d.Temperature,
+		"communicating": d.Communicating,
+		"producing":     d.Producing,
+		"recent":        d.Recent,
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+// Find Envoys on the local network from their mDNS advertisement
+
+import (
+	"flag"
+	"fmt"
+	"github.com/hashicorp/mdns"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const envoyMdnsService = "_enphase-envoy._tcp"
+
+type DiscoveredEnvoy struct {
+	Host   string
+	Name   string
+	Serial string
+	Info   []string // TXT record fields, e.g. protovers=...
+}
+
+func discoverEnvoys(timeout time.Duration) []DiscoveredEnvoy {
+	entries := make(chan *mdns.ServiceEntry, 16)
+	found := []DiscoveredEnvoy{}
+	done := make(chan struct{})
+	go func() {
+		seen := map[string]bool{}
+		for entry := range entries {
+			if !strings.Contains(entry.Name, envoyMdnsService) || entry.AddrV4 == nil || seen[entry.AddrV4.String()] {
+				continue
+			}
+			seen[entry.AddrV4.String()] = true
+			d := DiscoveredEnvoy{
+				Host: entry.AddrV4.String(),
+				Name: entry.Host,
+				Info: entry.InfoFields,
+			}
+			for _, field := range entry.InfoFields {
+				if strings.HasPrefix(field, "serialnum=") {
+					d.Serial = strings.TrimPrefix(field, "serialnum=")
+				}
+			}
+			found = append(found, d)
+		}
+		close(done)
+	}()
+
+	params := mdns.DefaultParams(envoyMdnsService)
+	params.Entries = entries
+	params.Timeout = timeout
+	params.DisableIPv6 = true
+	// The library logs harmless per-interface errors
+	logOutput := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	err := mdns.Query(params)
+	log.SetOutput(logOutput)
+	close(entries)
+	<-done
+	check(err)
+	return found
+}
+
+// discoverEnvoyHosts is for -e auto, every Envoy found on the network
+func discoverEnvoyHosts() []string {
+	found := discoverEnvoys(time.Second * 3)
+	if len(found) == 0 {
+		panic("no Envoy found via mDNS, give its address with -e")
+	}
+	hosts := []string{}
+	for _, d := range found {
+		slog.Info("Discovered Envoy", "serial", d.Serial, "host", d.Host)
+		hosts = append(hosts, d.Host)
+	}
+	return hosts
+}
+
+// discoverCommand implements "influxEnvoyStats discover"
+func discoverCommand(args []string) {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeoutPtr := flags.Duration("t", time.Second*3, "How long to wait for responses")
+	flags.Parse(args)
+
+	found := discoverEnvoys(*timeoutPtr)
+	if len(found) == 0 {
+		fmt.Println("No Envoys found")
+		return
+	}
+	for _, d := range found {
+		fmt.Printf("%s\t%s\tserial %s\t%s\n", d.Host, d.Name, d.Serial, strings.Join(d.Info, " "))
+	}
+}
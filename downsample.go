@@ -0,0 +1,152 @@
+package main
+
+// Downsampling (-downsample): polling fast, say every 5s for livedata,
+// but writing a point per series per minute, with the mean, minimum and
+// maximum of each value over it, to keep storage down without losing
+// the peaks.
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// window is a series' points in one period, being summarised
+type window struct {
+	p        point // Measurement, tags and start of the window
+	count    map[string]int
+	sum      map[string]float64
+	min, max map[string]float64
+	last     map[string]interface{} // Fields that aren't floats, e.g. counts
+}
+
+func newWindow(p point, start time.Time) *window {
+	return &window{
+		p:     point{measurement: p.measurement, tags: p.tags, time: start},
+		count: map[string]int{},
+		sum:   map[string]float64{},
+		min:   map[string]float64{},
+		max:   map[string]float64{},
+		last:  map[string]interface{}{},
+	}
+}
+
+func (w *window) add(p point) {
+	for name, value := range p.fields {
+		f, ok := value.(float64)
+		if !ok {
+			w.last[name] = value
+			continue
+		}
+		if w.count[name] == 0 || f < w.min[name] {
+			w.min[name] = f
+		}
+		if w.count[name] == 0 || f > w.max[name] {
+			w.max[name] = f
+		}
+		w.count[name]++
+		w.sum[name] += f
+	}
+}
+
+// point is the window's summary: each float field's mean, with its
+// minimum and maximum as <field>Min and <field>Max, and the last of the
+// rest
+func (w *window) point() point {
+	fields := map[string]interface{}{}
+	for name, value := range w.last {
+		fields[name] = value
+	}
+	for name, n := range w.count {
+		fields[name] = w.sum[name] / float64(n)
+		fields[name+"Min"] = w.min[name]
+		fields[name+"Max"] = w.max[name]
+	}
+	p := w.p
+	p.fields = fields
+	return p
+}
+
+// downsampler summarises each series' points over each period
+type downsampler struct {
+	period time.Duration
+
+	mu      sync.Mutex // Streams add samples alongside polls
+	windows map[string]*window
+	written map[string]time.Time // End of each series' last window written
+	latest  time.Time            // Of any point added
+}
+
+func newDownsampler(period time.Duration) *downsampler {
+	return &downsampler{period: period, windows: map[string]*window{}, written: map[string]time.Time{}}
+}
+
+// add takes points into their series' windows, returning the summaries of
+// windows that are over: those of series with a point in a later window,
+// and any ended before the latest point added
+func (d *downsampler) add(points []point) []point {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	done := []point{}
+	for _, p := range points {
+		key := seriesKey(p)
+		start := p.time.Truncate(d.period)
+		if start.Before(d.written[key]) {
+			// Late, after its window was written
+			continue
+		}
+		w := d.windows[key]
+		if w != nil && !w.p.time.Equal(start) {
+			if start.Before(w.p.time) {
+				// Out of order
+				continue
+			}
+			done = append(done, d.write(key))
+			w = nil
+		}
+		if w == nil {
+			w = newWindow(p, start)
+			d.windows[key] = w
+		}
+		w.add(p)
+		if p.time.After(d.latest) {
+			d.latest = p.time
+		}
+	}
+	return append(done, d.ended(d.latest)...)
+}
+
+// ended removes and summarises the windows over by t
+func (d *downsampler) ended(t time.Time) []point {
+	done := []point{}
+	keys := []string{}
+	for key := range d.windows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !d.windows[key].p.time.Add(d.period).After(t) {
+			done = append(done, d.write(key))
+		}
+	}
+	return done
+}
+
+// write removes and summarises key's window
+func (d *downsampler) write(key string) point {
+	w := d.windows[key]
+	delete(d.windows, key)
+	d.written[key] = w.p.time.Add(d.period)
+	return w.point()
+}
+
+// flush summarises every window so far, ended or not, e.g. on shutdown
+func (d *downsampler) flush() []point {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	done := []point{}
+	for key := range d.windows {
+		done = append(done, d.write(key))
+	}
+	return done
+}
@@ -0,0 +1,59 @@
+package main
+
+// The Envoy's lifetime energy counters from /ivp/pdm/energy.  They only
+// ever go up, so the energy between any two points is their difference,
+// however long polling stopped for in between.
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+func pollEnergy(gw gateway) *envoy.Energy {
+	energy, err := gw.client.GetEnergy()
+	check(err)
+	if pcu := energy.Production["pcu"]; pcu != nil {
+		slog.Debug("Energy", "site", gw.site, "type", "production", "source", "pcu", "whLifetime", pcu.WattHoursLifetime)
+	}
+	return energy
+}
+
+// energyPoints has a point per meter, polled at t
+func energyPoints(measurement string, energy *envoy.Energy, t time.Time) []point {
+	if energy == nil {
+		return nil
+	}
+	points := []point{}
+	add := func(typ string, counters map[string]*envoy.EnergyCounter) {
+		sources := []string{}
+		for source, c := range counters {
+			if c != nil {
+				sources = append(sources, source)
+			}
+		}
+		sort.Strings(sources)
+		for _, source := range sources {
+			c := counters[source]
+			points = append(points, point{
+				measurement: measurement,
+				tags: map[string]string{
+					"type":   typ,
+					"source": source,
+				},
+				fields: map[string]interface{}{
+					// An integer, as a counter
+					"whLifetime":      int64(c.WattHoursLifetime),
+					"whToday":         c.WattHoursToday,
+					"whLastSevenDays": c.WattHoursSevenDays,
+					"watts":           c.WattsNow,
+				},
+				time: t,
+			})
+		}
+	}
+	add("production", energy.Production)
+	add("consumption", energy.Consumption)
+	return points
+}
@@ -0,0 +1,113 @@
+package main
+
+// Encharge battery and Enpower points, one per device tagged by serial,
+// and with an Enpower, the grid relay state
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ensemble is the ensemble devices read in one poll
+type Ensemble struct {
+	Inventory []envoy.EnsembleInventory
+	Power     []envoy.EnsemblePower
+	Relay     *envoy.Relay // Only with an Enpower
+}
+
+// onGrid is the last grid state seen for each site (or host), to log changes
+var onGrid sync.Map
+
+// logGridChange logs the grid connection going down or coming back
+func logGridChange(gw gateway, relay *envoy.Relay) {
+	previous, seen := onGrid.Swap(gw.client.Host, relay.OnGrid())
+	switch {
+	case !seen:
+		slog.Info("Grid status", "site", gw.site, "onGrid", relay.OnGrid(), "relay", relay.MainsOperState)
+	case previous.(bool) && !relay.OnGrid():
+		slog.Warn("Grid disconnected, running off-grid", "site", gw.site, "relay", relay.MainsOperState)
+	case !previous.(bool) && relay.OnGrid():
+		slog.Info("Grid reconnected", "site", gw.site, "relay", relay.MainsOperState)
+	}
+}
+
+func pollEnsemble(gw gateway) *Ensemble {
+	inventory, err := gw.client.GetEnsembleInventory()
+	check(err)
+	ensemble := &Ensemble{Inventory: inventory}
+	for _, inv := range inventory {
+		if inv.Type == "ENCHARGE" && len(inv.Devices) > 0 {
+			ensemble.Power, err = gw.client.GetEnsemblePower()
+			check(err)
+		}
+		if inv.Type == "ENPOWER" && len(inv.Devices) > 0 {
+			ensemble.Relay, err = gw.client.GetRelay()
+			check(err)
+			logGridChange(gw, ensemble.Relay)
+		}
+		for _, d := range inv.Devices {
+			slog.Debug("Ensemble", "site", gw.site, "time", d.LastRptDate, "type", inv.Type, "serial", d.SerialNum, "soc", d.PercentFull, "gridMode", d.EnpwrGridMode)
+		}
+	}
+	return ensemble
+}
+
+// ensemblePoints has the relay state at pollTime, as it has no time of its own
+func ensemblePoints(measurement string, ensemble *Ensemble, pollTime time.Time) []point {
+	power := map[string]envoy.EnsemblePower{}
+	for _, p := range ensemble.Power {
+		power[p.SerialNum] = p
+	}
+
+	points := []point{}
+	for _, inv := range ensemble.Inventory {
+		for _, d := range inv.Devices {
+			fields := map[string]interface{}{
+				"communicating": d.Communicating,
+				"operating":     d.Operating,
+				"temperature":   d.Temperature,
+			}
+			switch inv.Type {
+			case "ENCHARGE":
+				fields["soc"] = d.PercentFull
+				fields["capacityWh"] = d.EnchargeCapacity
+				if p, ok := power[d.SerialNum]; ok {
+					fields["watts"] = p.RealPowerMw / 1000
+					fields["apparentPower"] = p.ApparentPowerMva / 1000
+				}
+			case "ENPOWER":
+				fields["mainsAdminState"] = d.MainsAdminState
+				fields["mainsOperState"] = d.MainsOperState
+				fields["gridMode"] = d.EnpwrGridMode
+			}
+			points = append(points, point{
+				measurement: measurement,
+				tags: map[string]string{
+					"type":   strings.ToLower(inv.Type),
+					"serial": d.SerialNum,
+				},
+				fields: fields,
+				time:   time.Unix(d.LastRptDate, 0),
+			})
+		}
+	}
+
+	if ensemble.Relay != nil {
+		points = append(points, point{
+			measurement: measurement,
+			tags: map[string]string{
+				"type": "grid",
+			},
+			fields: map[string]interface{}{
+				"onGrid":          ensemble.Relay.OnGrid(),
+				"mainsAdminState": ensemble.Relay.MainsAdminState,
+				"mainsOperState":  ensemble.Relay.MainsOperState,
+			},
+			time: pollTime,
+		})
+	}
+	return points
+}
@@ -0,0 +1,118 @@
+package main
+
+// Energy estimated from power (-estimate-wh), for firmware whose
+// whLifetime counters freeze for hours, or that has none, so energy
+// dashboards keep working.  Each poll's power is integrated over the time
+// since the one before, and the estimate follows the Envoy's counter
+// whenever that moves.
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// Longer without a poll and there's no telling what happened in between
+	maxIntegrationGap = time.Hour
+	// A counter that hasn't moved for this long, with power flowing, is
+	// taken for frozen rather than slow to update
+	counterFrozenAfter = 15 * time.Minute
+)
+
+// energyEstimate is an eim's estimated lifetime energy so far
+type energyEstimate struct {
+	whLifetime   float64   // The estimate, which only goes up
+	counter      float64   // The Envoy's whLifetime when it last moved
+	counterMoved time.Time // and when that was
+	integrated   float64   // Wh from power since then
+	lastPoll     time.Time
+	lastWatts    float64
+	frozen       bool // Logged as such
+}
+
+var (
+	estimatesMu sync.Mutex
+	estimates   = map[string]*energyEstimate{} // By host and eim type
+)
+
+// estimateEnergy works out r's estimated lifetime energy for production
+// and total consumption: the Envoy's counter when it last moved, plus the
+// power since integrated over time, never going backwards.  A counter
+// that catches up below the estimate is waited for.
+func estimateEnergy(gw gateway, r EnvoyReadings) map[string]float64 {
+	estimatesMu.Lock()
+	defer estimatesMu.Unlock()
+	energy := map[string]float64{}
+	for _, eim := range append([]envoy.Eim{r.Production}, r.Consumption...) {
+		if eim.MeasurementType != "production" && eim.MeasurementType != "total-consumption" {
+			// Net consumption goes both ways
+			continue
+		}
+		watts := eim.WNow
+		if watts < 0 {
+			watts = 0
+		}
+		key := gw.client.Host + "/" + eim.MeasurementType
+		e, ok := estimates[key]
+		if !ok {
+			estimates[key] = &energyEstimate{whLifetime: eim.WhLifetime, counter: eim.WhLifetime, counterMoved: r.PollTime, lastPoll: r.PollTime, lastWatts: watts}
+			energy[eim.MeasurementType] = eim.WhLifetime
+			continue
+		}
+		if gap := r.PollTime.Sub(e.lastPoll); gap > 0 && gap <= maxIntegrationGap {
+			e.integrated += (e.lastWatts + watts) / 2 * gap.Hours()
+		}
+		e.lastPoll, e.lastWatts = r.PollTime, watts
+
+		switch {
+		case eim.WhLifetime < e.counter:
+			// Reset, e.g. a replaced Envoy: start again from it
+			slog.Warn("Energy counter went backwards, estimating from it afresh", "site", gw.site, "type", eim.MeasurementType, "was", e.counter, "now", eim.WhLifetime)
+			*e = energyEstimate{whLifetime: eim.WhLifetime, counter: eim.WhLifetime, counterMoved: r.PollTime, lastPoll: r.PollTime, lastWatts: watts}
+		case eim.WhLifetime > e.counter:
+			if e.frozen {
+				slog.Info("Energy counter moving again", "site", gw.site, "type", eim.MeasurementType, "estimatedWh", e.integrated, "countedWh", eim.WhLifetime-e.counter)
+			}
+			e.counter, e.counterMoved, e.integrated, e.frozen = eim.WhLifetime, r.PollTime, 0, false
+			if e.counter > e.whLifetime {
+				e.whLifetime = e.counter
+			}
+		default:
+			if !e.frozen && e.integrated > 0 && r.PollTime.Sub(e.counterMoved) > counterFrozenAfter {
+				e.frozen = true
+				slog.Warn("Energy counter not moving, estimating from power", "site", gw.site, "type", eim.MeasurementType, "since", e.counterMoved)
+			}
+			if estimate := e.counter + e.integrated; estimate > e.whLifetime {
+				e.whLifetime = estimate
+			}
+		}
+		energy[eim.MeasurementType] = e.whLifetime
+	}
+	return energy
+}
+
+// estimatedEnergyPoints has a point per eim type with its estimated
+// whLifetime, tagged estimated=true to keep it apart from the Envoy's own
+func estimatedEnergyPoints(measurement string, energy map[string]float64, t time.Time) []point {
+	points := []point{}
+	for _, typ := range []string{"production", "total-consumption"} {
+		wh, ok := energy[typ]
+		if !ok {
+			continue
+		}
+		points = append(points, point{
+			measurement: measurement,
+			tags: map[string]string{
+				"type":      typ,
+				"estimated": "true",
+			},
+			fields: map[string]interface{}{
+				"whLifetime": wh,
+			},
+			time: t,
+		})
+	}
+	return points
+}
@@ -0,0 +1,68 @@
+package main
+
+// Exit codes for a single poll (no -l), so scripts run from cron can tell
+// what went wrong.  Loop mode logs failures and carries on instead.
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"net"
+	"os"
+)
+
+const (
+	exitFailed      = 1 // Anything else
+	exitConfig      = 2 // Invalid settings, as for bad flags
+	exitUnreachable = 3 // An Envoy couldn't be reached, or timed out
+	exitAuth        = 4 // A token or login was missing or rejected
+	exitResponse    = 5 // An Envoy's response couldn't be read
+	exitWrite       = 6 // Readings couldn't be written to an output
+)
+
+var errConfig = errors.New("invalid settings")
+
+// writeError is an output failing.  It doesn't unwrap, so that a network
+// error writing isn't taken for an Envoy being unreachable.
+type writeError struct {
+	err error
+}
+
+func (e writeError) Error() string {
+	return "writing readings failed: " + e.err.Error()
+}
+
+// exitCode is the code for err.  If several things failed, the first in
+// the order above, after exitFailed, wins.
+func exitCode(err error) int {
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var xmlErr *xml.SyntaxError
+	var writeErr writeError
+	switch {
+	case errors.Is(err, errConfig):
+		return exitConfig
+	case errors.As(err, &netErr):
+		return exitUnreachable
+	case errors.Is(err, envoy.ErrTokenRequired), errors.Is(err, envoy.ErrUnauthorized):
+		return exitAuth
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr), errors.As(err, &xmlErr):
+		return exitResponse
+	case errors.As(err, &writeErr):
+		return exitWrite
+	}
+	return exitFailed
+}
+
+// exitOnFailure, deferred, turns a panic into an error logged and an exit
+// code for it
+func exitOnFailure() {
+	if r := recover(); r != nil {
+		err := panicError(r)
+		slog.Error("Poll failed", "err", err)
+		os.Exit(exitCode(err))
+	}
+}
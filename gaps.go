@@ -0,0 +1,58 @@
+package main
+
+// Gaps: stretches with no readings from an Envoy, such as while it was
+// unreachable, noticed when polling recovers.  A dashboard showing no
+// production can't otherwise tell "no sun" from "no data".
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Gap is the time from the last successful poll before an outage to the
+// first after it
+type Gap struct {
+	Start time.Time
+	End   time.Time
+}
+
+// gapAfter is the gap between polls at last and now, if the poll schedule
+// would have had one succeed in between, allowing for one slow or failed
+func gapAfter(cfg *Config, last time.Time, now time.Time) *Gap {
+	if last.IsZero() || cfg.Interval == 0 {
+		return nil
+	}
+	if now.Sub(last) <= 2*cfg.nextPollDelay(last)+cfg.Jitter {
+		return nil
+	}
+	return &Gap{Start: last, End: now}
+}
+
+// checkGap adds any gap since host's previous successful poll to r, and
+// notes when this one was
+func checkGap(cfg *Config, lastPolls map[string]time.Time, host string, r *EnvoyReadings) {
+	r.Gap = gapAfter(cfg, lastPolls[host], r.PollTime)
+	lastPolls[host] = r.PollTime
+	if r.Gap != nil {
+		slog.Warn("No readings for a while", "host", host, "site", r.Site, "from", r.Gap.Start, "to", r.Gap.End, "missing", r.Gap.End.Sub(r.Gap.Start).Round(time.Second))
+	}
+}
+
+// gapPoint is a gap as an event at its start, with its end and length for
+// dashboards to shade it by, e.g. as Grafana annotations
+func gapPoint(measurement string, gap *Gap) point {
+	length := gap.End.Sub(gap.Start).Round(time.Second)
+	return point{
+		measurement: measurement,
+		tags: map[string]string{
+			"type": "gap",
+		},
+		fields: map[string]interface{}{
+			"seconds": length.Seconds(),
+			"end":     gap.End.Unix(),
+			"text":    fmt.Sprintf("No readings for %s", length),
+		},
+		time: gap.Start,
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+// Graphite/carbon output via the plaintext protocol.  Each numeric field
+// of a point is a metric named from the prefix, site, measurement, tag
+// values and field, e.g. envoy.readings.production.watts or
+// envoy.garage.inverters.121900000001.watts
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+type GraphiteWriter struct {
+	addr   string
+	prefix string
+	influx InfluxConfig // Measurement names and fields to write
+	dedupe *dedupe
+}
+
+func NewGraphiteWriter(cfg GraphiteConfig, influx InfluxConfig) *GraphiteWriter {
+	return &GraphiteWriter{addr: cfg.Addr, prefix: cfg.Prefix, influx: influx, dedupe: newDedupe(influx.Duplicates)}
+}
+
+// graphiteName makes s safe as one node of a metric path
+var graphiteName = strings.NewReplacer(".", "_", " ", "_", "/", "_").Replace
+
+// metricPath is the path for p's fields, without the field name
+func (w *GraphiteWriter) metricPath(p point) string {
+	nodes := []string{}
+	if w.prefix != "" {
+		nodes = append(nodes, w.prefix)
+	}
+	if site, ok := p.tags["site"]; ok {
+		nodes = append(nodes, graphiteName(site))
+	}
+	nodes = append(nodes, graphiteName(p.measurement))
+	keys := []string{}
+	static := w.influx.staticTags()
+	for k := range p.tags {
+		// The gateway's tags would just lengthen every path, and move
+		// it on each firmware update, as would -tag's
+		if _, ok := static[k]; !ok && k != "site" && k != "envoySerial" && k != "firmware" && k != "model" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		nodes = append(nodes, graphiteName(p.tags[k]))
+	}
+	return strings.Join(nodes, ".")
+}
+
+func (w *GraphiteWriter) Write(readings []EnvoyReadings) error {
+	var lines strings.Builder
+	for _, r := range readings {
+		for _, p := range w.dedupe.filter(readingsToPoints(w.influx, r), r.PollTime) {
+			path := w.metricPath(p)
+			for field, value := range p.fields {
+				switch value.(type) {
+				case float64, int, int64:
+					fmt.Fprintf(&lines, "%s.%s %v %d\n", path, graphiteName(field), value, p.time.Unix())
+				}
+			}
+		}
+	}
+	if lines.Len() == 0 {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", w.addr, time.Second*5)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	if _, err := conn.Write([]byte(lines.String())); err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Flush is a no-op as each Write sends its metrics
+func (w *GraphiteWriter) Flush() error {
+	return nil
+}
+
+func (w *GraphiteWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+// Health endpoints for Docker/Kubernetes:
+//  /healthz - the poll loop is still succeeding
+//  /readyz  - polled and (if writing to InfluxDB) written recently
+// and the healthcheck command to query them, for images without curl.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+type healthStatus struct {
+	Status    string    `json:"status"`
+	LastPoll  time.Time `json:"lastPoll,omitempty"`
+	LastWrite time.Time `json:"lastWrite,omitempty"`
+}
+
+func unixNanoTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// fresh is whether t is recent enough given when the next poll was due
+// after it, with two intervals' grace
+func fresh(cfg *Config, t time.Time) bool {
+	if t.IsZero() {
+		return false
+	}
+	return time.Now().Before(t.Add(cfg.nextPollDelay(t) + 2*cfg.Interval))
+}
+
+func serveHealth(addr string, cfg *Config, writing bool) {
+	respond := func(w http.ResponseWriter, ok bool) {
+		status := healthStatus{
+			Status:    "ok",
+			LastPoll:  unixNanoTime(stats.lastPoll.Load()),
+			LastWrite: unixNanoTime(stats.lastWrite.Load()),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			status.Status = "stale"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		lastPoll := unixNanoTime(stats.lastPoll.Load())
+		// Still starting up counts as healthy
+		respond(w, lastPoll.IsZero() && time.Since(startTime) < 2*cfg.Interval || fresh(cfg, lastPoll))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ok := fresh(cfg, unixNanoTime(stats.lastPoll.Load()))
+		if writing {
+			ok = ok && fresh(cfg, unixNanoTime(stats.lastWrite.Load()))
+		}
+		respond(w, ok)
+	})
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		slog.Error("Health listener stopped", "err", err)
+	}()
+}
+
+// healthcheckCommand asks the instance serving -health whether it's
+// ready, or with "healthz" just still polling, printing its status and
+// exiting 1 if not, e.g. as a Docker HEALTHCHECK.  Docker reserves other
+// exit codes, so any failure is 1.
+func healthcheckCommand(args []string) {
+	err := catch(func() {
+		cfg := loadConfig(args)
+		if cfg.Health == "" {
+			panic("give the address the poller serves health checks on with -health")
+		}
+		path := "readyz"
+		if flag.NArg() > 0 {
+			path = flag.Arg(0)
+		}
+		if path != "readyz" && path != "healthz" {
+			panic(fmt.Sprintf("unknown check %q, expected readyz or healthz", path))
+		}
+		url, err := healthURL(cfg.Health, path)
+		check(err)
+		client := &http.Client{Timeout: time.Second * 5}
+		resp, err := client.Get(url)
+		check(err)
+		defer resp.Body.Close()
+		io.Copy(os.Stdout, resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			panic(fmt.Sprintf("%s: %s", path, resp.Status))
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Health check failed:", err)
+		os.Exit(1)
+	}
+}
+
+// healthURL is the URL for a health check on a listen address, e.g.
+// http://localhost:8080/readyz for ":8080"
+func healthURL(addr string, path string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/" + path, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+// Gateway status from /home.json, for seeing why data stopped reaching
+// Enlighten: its connection, network, database and alerts
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"time"
+)
+
+func pollHome(gw gateway) *envoy.Home {
+	home, err := gw.client.GetHome()
+	check(err)
+	slog.Debug("Gateway", "site", gw.site, "webComm", home.Network.WebComm, "lastReport", home.Network.LastEnlightenReportTime, "network", home.Network.PrimaryInterface)
+	return home
+}
+
+// homePoint is polled at t, as home.json has no time of its own
+func homePoint(measurement string, home *envoy.Home, t time.Time) point {
+	fields := map[string]interface{}{
+		"webComm":                 home.Network.WebComm,
+		"everReportedToEnlighten": home.Network.EverReportedToEnlighten,
+		"lastEnlightenReport":     home.Network.LastEnlightenReportTime,
+		"dbSize":                  float64(home.DbSize),
+		"dbPercentFull":           float64(home.DbPercentFull),
+		"commDevices":             home.Comm.Num,
+		"commLevel":               home.Comm.Level,
+		"alerts":                  len(home.Alerts),
+		"updateStatus":            home.UpdateStatus,
+		"softwareBuildEpoch":      home.SoftwareBuildEpoch,
+	}
+	if iface := home.PrimaryNetwork(); iface != nil {
+		fields["networkType"] = iface.Type
+		fields["networkCarrier"] = iface.Carrier
+		fields["signalStrength"] = iface.SignalStrength
+	}
+	return point{
+		measurement: measurement,
+		tags:        map[string]string{},
+		fields:      fields,
+		time:        t,
+	}
+}
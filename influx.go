@@ -0,0 +1,718 @@
+package main
+
+// InfluxDB output.  InfluxDB 1.x (and 2.x's v1 compatibility API) is
+// written to a database and retention policy with username/password via
+// the /write endpoint; InfluxDB 2.x to an org and bucket with an API token.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"io"
+	"log/slog"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// point is a single InfluxDB point, independent of client version
+type point struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]interface{}
+	time        time.Time
+}
+
+type InfluxWriter struct {
+	cfg InfluxConfig
+
+	v1      client.Client
+	v1Write *nethttp.Client // Writes, to tell points refused from failures
+	v2      influxdb2.Client
+	v2Write api.WriteAPIBlocking // for spooled batches
+	v2Async api.WriteAPI         // batches in the background
+
+	spool  *Spool
+	dedupe *dedupe
+
+	smooth          *smoother
+	downsample      *downsampler
+	downsampleTaken bool // By the writer that took over on reload
+
+	// InfluxDB 1.x lines held back to write in fewer, larger batches
+	mu         sync.Mutex
+	pending    []string
+	lastWrite  time.Time
+	flushTimer *time.Timer // Writes them once the flush interval is up
+}
+
+// apiVersion is the configured InfluxDB API version, "1" or "2", which
+// defaults to 2 when a token is given
+func (cfg InfluxConfig) apiVersion() (string, error) {
+	version := cfg.Version
+	if version == "" {
+		version = "1"
+		if cfg.Token != "" {
+			version = "2"
+		}
+	}
+	switch version {
+	case "1":
+		if cfg.Token != "" {
+			return "", errors.New("InfluxDB 1.x mode uses username/password (-dbu/-dbp), not a token")
+		}
+	case "2":
+		if cfg.Token == "" {
+			return "", errors.New("InfluxDB 2.x mode needs an API token (-dbt)")
+		}
+		if cfg.Org == "" {
+			return "", errors.New("an InfluxDB 2.x API token needs an organisation (-dbo)")
+		}
+	default:
+		return "", fmt.Errorf("unknown InfluxDB version %q, expected 1 or 2", version)
+	}
+	return version, nil
+}
+
+func NewInfluxWriter(cfg InfluxConfig) *InfluxWriter {
+	w := &InfluxWriter{cfg: cfg, dedupe: newDedupe(cfg.Duplicates)}
+	if cfg.Smooth > 0 {
+		w.smooth = newSmoother(cfg.Smooth, cfg.SmoothRaw)
+	}
+	if cfg.Downsample > 0 {
+		w.downsample = newDownsampler(cfg.Downsample)
+	}
+	if cfg.SpoolDir != "" {
+		w.spool = NewSpool(cfg.SpoolDir)
+	}
+	version, err := cfg.apiVersion()
+	check(err)
+	proxy, err := proxyFunc(cfg.Proxy)
+	check(err)
+	if cfg.Create {
+		defer w.setup() // Once the client's made
+	}
+
+	if version == "2" {
+		options := influxdb2.DefaultOptions().
+			SetPrecision(time.Second).
+			SetBatchSize(uint(cfg.BatchSize)).
+			SetFlushInterval(uint(cfg.FlushInterval / time.Millisecond)).
+			SetUseGZip(cfg.Gzip).
+			SetRetryBufferLimit(uint(cfg.RetryBuffer))
+		// The HTTP client it would make anyway, through the proxy
+		options.HTTPClient().Transport.(*nethttp.Transport).Proxy = proxy
+		w.v2 = influxdb2.NewClientWithOptions(cfg.Addr, cfg.Token, options)
+		w.v2Write = w.v2.WriteAPIBlocking(cfg.Org, cfg.Database)
+		w.v2Async = w.v2.WriteAPI(cfg.Org, cfg.Database)
+		if w.spool != nil {
+			// Spool failed batches instead of the client's own in-memory retries
+			w.v2Async.SetWriteFailedCallback(func(batch string, err http.Error, retryAttempts uint) bool {
+				lines := strings.Split(strings.TrimSpace(batch), "\n")
+				stats.writeErrors.Add(1)
+				stats.pointsWritten.Add(-int64(len(lines)))
+				w.spool.Add(lines)
+				slog.Warn("InfluxDB write failed, spooled points", "points", len(lines), "err", err.Error())
+				return false
+			})
+		} else {
+			go func() {
+				for err := range w.v2Async.Errors() {
+					stats.writeErrors.Add(1)
+					slog.Error("InfluxDB write failed", "err", err)
+				}
+			}()
+		}
+		return w
+	}
+
+	w.v1, err = client.NewHTTPClient(client.HTTPConfig{
+		Addr:     cfg.Addr,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		Proxy:    proxy,
+	})
+	check(err)
+	w.v1Write = &nethttp.Client{Timeout: time.Second * 30, Transport: &nethttp.Transport{Proxy: proxy}}
+	if _, serverVersion, err := w.v1.Ping(time.Second * 5); err == nil && cfg.Version == "" && strings.HasPrefix(strings.TrimPrefix(serverVersion, "v"), "2.") {
+		slog.Warn("Username/password access to InfluxDB 2.x is deprecated, use an API token (-dbt) and org (-dbo)")
+	}
+	return w
+}
+
+// eimFields is just the watts, or with all set every value the eim reports
+func eimFields(reading envoy.Eim, all bool) map[string]interface{} {
+	fields := map[string]interface{}{
+		"watts": reading.WNow,
+	}
+	if all {
+		fields["whLifetime"] = reading.WhLifetime
+		fields["varhLeadLifetime"] = reading.VarhLeadLifetime
+		fields["varhLagLifetime"] = reading.VarhLagLifetime
+		fields["vahLifetime"] = reading.VahLifetime
+		fields["rmsCurrent"] = reading.RmsCurrent
+		fields["rmsVoltage"] = reading.RmsVoltage
+		fields["reactPwr"] = reading.ReactPwr
+		fields["apprntPwr"] = reading.ApprntPwr
+		fields["pwrFactor"] = reading.PwrFactor
+		fields["whToday"] = reading.WhToday
+		fields["whLastSevenDays"] = reading.WhLastSevenDays
+		fields["vahToday"] = reading.VahToday
+		fields["varhLeadToday"] = reading.VarhLeadToday
+		fields["varhLagToday"] = reading.VarhLagToday
+	}
+	return fields
+}
+
+func readingsToPoints(cfg InfluxConfig, r EnvoyReadings) []point {
+	// A reading's time from the Envoy, or with host timestamps, the poll
+	// time.  Microinverters and other devices keep their own report times.
+	readingTime := func(t int64) time.Time {
+		if cfg.Timestamps == timestampsHost {
+			return r.PollTime
+		}
+		return time.Unix(t, 0)
+	}
+
+	points := []point{}
+	for _, reading := range r.eims() {
+		fields := eimFields(reading, cfg.AllFields)
+		if d, ok := r.DayEnergy[reading.MeasurementType]; ok {
+			fields["whDay"] = d.WhDay
+			fields["day"] = d.Day
+		}
+		points = append(points, point{
+			measurement: cfg.Measurement,
+			tags: map[string]string{
+				"type": reading.MeasurementType,
+			},
+			fields: fields,
+			time:   readingTime(reading.ReadingTime),
+		})
+		if cfg.LinesMeasurement != "" && len(reading.Lines) > 1 {
+			for i, line := range reading.Lines {
+				points = append(points, point{
+					measurement: cfg.LinesMeasurement,
+					tags: map[string]string{
+						"type":  reading.MeasurementType,
+						"phase": fmt.Sprintf("L%d", i+1),
+					},
+					fields: eimFields(line, cfg.AllFields),
+					time:   readingTime(reading.ReadingTime),
+				})
+			}
+		}
+	}
+
+	points = append(points, estimatedEnergyPoints(cfg.Measurement, r.EstimatedWh, r.PollTime)...)
+	if r.Cost != nil {
+		tags := map[string]string{
+			"type": "cost",
+		}
+		if r.Cost.Currency != "" {
+			tags["currency"] = r.Cost.Currency
+		}
+		points = append(points, point{
+			measurement: cfg.Measurement,
+			tags:        tags,
+			fields:      r.Cost.fields(),
+			time:        r.PollTime,
+		})
+	}
+
+	if cfg.Derived {
+		if d, ok := derive(r); ok {
+			points = append(points, point{
+				measurement: cfg.Measurement,
+				tags: map[string]string{
+					"type": "derived",
+				},
+				fields: d.fields(),
+				time:   readingTime(d.ReadingTime),
+			})
+		}
+	}
+
+	for _, st := range r.Storage {
+		if st.ActiveCount == 0 {
+			// Reported even when there are no batteries
+			continue
+		}
+		points = append(points, point{
+			measurement: cfg.StorageMeasurement,
+			tags: map[string]string{
+				"type": st.Type,
+			},
+			fields: map[string]interface{}{
+				"watts":       st.WNow,
+				"whNow":       st.WhNow,
+				"state":       st.State,
+				"activeCount": st.ActiveCount,
+			},
+			time: readingTime(st.ReadingTime),
+		})
+	}
+
+	devstatus := map[string]envoy.DeviceStatus{}
+	for _, d := range r.Devstatus {
+		devstatus[d.SerialNumber] = d
+	}
+	for _, inv := range r.Inverters {
+		fields := map[string]interface{}{
+			"watts":          inv.LastReportWatts,
+			"maxWatts":       inv.MaxReportWatts,
+			"lastReportDate": inv.LastReportDate,
+		}
+		if d, ok := devstatus[inv.SerialNumber]; ok {
+			for k, v := range devstatusFields(d) {
+				fields[k] = v
+			}
+			delete(devstatus, inv.SerialNumber)
+		}
+		points = append(points, point{
+			measurement: cfg.InverterMeasurement,
+			tags: map[string]string{
+				"serial": inv.SerialNumber,
+			},
+			fields: fields,
+			time:   time.Unix(inv.LastReportDate, 0),
+		})
+		// And how long ago that was, at the poll time, so an inverter
+		// that's stopped reporting shows up as such
+		points = append(points, point{
+			measurement: cfg.InverterMeasurement,
+			tags: map[string]string{
+				"type":   "age",
+				"serial": inv.SerialNumber,
+			},
+			fields: map[string]interface{}{
+				"reportAge": r.PollTime.Sub(time.Unix(inv.LastReportDate, 0)).Seconds(),
+			},
+			time: r.PollTime,
+		})
+	}
+	// Without -i, devstatus has points of its own
+	for _, d := range r.Devstatus {
+		if _, ok := devstatus[d.SerialNumber]; !ok {
+			continue
+		}
+		t := r.PollTime
+		if d.ReportDate != 0 {
+			t = time.Unix(d.ReportDate, 0)
+		}
+		points = append(points, point{
+			measurement: cfg.InverterMeasurement,
+			tags: map[string]string{
+				"serial": d.SerialNumber,
+			},
+			fields: devstatusFields(d),
+			time:   t,
+		})
+	}
+	if cfg.ArrayMeasurement != "" {
+		points = append(points, arrayPoints(cfg.ArrayMeasurement, cfg.Panels, r.Inverters, r.PollTime)...)
+	}
+	for _, meter := range r.Meters {
+		points = append(points, point{
+			measurement: cfg.MeterMeasurement,
+			tags: map[string]string{
+				"type":  meter.MeasurementType,
+				"phase": "total",
+			},
+			fields: meterChannelFields(meter.MeterChannel),
+			time:   readingTime(meter.Timestamp),
+		})
+		for i, channel := range meter.Channels {
+			points = append(points, point{
+				measurement: cfg.MeterMeasurement,
+				tags: map[string]string{
+					"type":  meter.MeasurementType,
+					"phase": fmt.Sprintf("L%d", i+1),
+				},
+				fields: meterChannelFields(channel),
+				time:   readingTime(channel.Timestamp),
+			})
+		}
+	}
+
+	if r.Livedata != nil {
+		points = append(points, livedataPoints(cfg.LivedataMeasurement, r.Livedata, readingTime(r.Livedata.Meters.LastUpdate))...)
+	}
+	if r.Ensemble != nil {
+		points = append(points, ensemblePoints(cfg.EnsembleMeasurement, r.Ensemble, r.PollTime)...)
+	}
+	if r.Home != nil {
+		points = append(points, homePoint(cfg.HomeMeasurement, r.Home, r.PollTime))
+	}
+	if r.PowerMode != nil {
+		points = append(points, powerModePoint(cfg.Measurement, r.PowerMode, r.PollTime))
+	}
+	points = append(points, inventoryPoints(cfg.InventoryMeasurement, r.Inventory, r.PollTime)...)
+	points = append(points, energyPoints(cfg.EnergyMeasurement, r.Energy, r.PollTime)...)
+	if r.Gap != nil && cfg.GapMeasurement != "" {
+		points = append(points, gapPoint(cfg.GapMeasurement, r.Gap))
+	}
+	if r.Rollup != nil && cfg.DailyMeasurement != "" {
+		points = append(points, rollupPoint(cfg.DailyMeasurement, r.Rollup))
+	}
+
+	if r.Site != "" {
+		for _, p := range points {
+			p.tags["site"] = r.Site
+		}
+	}
+	if r.Serial != "" {
+		for _, p := range points {
+			p.tags["envoySerial"] = r.Serial
+			p.tags["firmware"] = r.Firmware
+			p.tags["model"] = r.Model
+		}
+	}
+	cfg.addPanelTags(points)
+	return cfg.addTags(cfg.mapPoints(points))
+}
+
+// staticTags is the -tag tags by key
+func (cfg InfluxConfig) staticTags() map[string]string {
+	tags := map[string]string{}
+	for _, tag := range cfg.Tags {
+		if key, value, ok := strings.Cut(tag, "="); ok {
+			tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return tags
+}
+
+// addTags adds the -tag tags to points, leaving any of their own alone
+func (cfg InfluxConfig) addTags(points []point) []point {
+	tags := cfg.staticTags()
+	for _, p := range points {
+		for k, v := range tags {
+			if _, ok := p.tags[k]; !ok {
+				p.tags[k] = v
+			}
+		}
+	}
+	return points
+}
+
+// Write sends the readings, then the poller's own metrics if configured,
+// to InfluxDB.  With a spool configured, any earlier unwritten batches go
+// first, and on failure the readings are spooled rather than lost.
+func (w *InfluxWriter) Write(readings []EnvoyReadings) error {
+	return catch(func() {
+		// All at once, as one poll's batch
+		points := []point{}
+		for _, r := range readings {
+			points = append(points, w.downsampled(w.smoothed(w.dedupe.filter(readingsToPoints(w.cfg, r), r.PollTime)))...)
+		}
+		if w.cfg.SelfMeasurement != "" {
+			points = append(points, w.cfg.addTags(w.cfg.mapPoints([]point{stats.point(w.cfg.SelfMeasurement)}))...)
+		}
+		w.WritePoints(points)
+	})
+}
+
+// WritePoints is Write for points already converted from readings
+func (w *InfluxWriter) WritePoints(points []point) {
+	if len(points) == 0 {
+		return
+	}
+	lines := toLineProtocol(points)
+	if w.v2Async != nil {
+		w.writeAsync(lines)
+		return
+	}
+
+	// Write straight away if the flush interval has passed since the last
+	// write, or there's a batch's worth; otherwise hold the points back
+	// until it has, when the timer writes them
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, lines...)
+	wait := time.Until(w.lastWrite.Add(w.cfg.FlushInterval))
+	if len(w.pending) >= w.cfg.BatchSize || wait <= 0 {
+		w.writePending()
+		return
+	}
+	if w.flushTimer == nil {
+		w.flushTimer = time.AfterFunc(wait, w.flushLater)
+	}
+}
+
+// flushLater writes the points held back once the flush interval is up.
+// If that fails they're kept, to write with the next points.
+func (w *InfluxWriter) flushLater() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushTimer = nil
+	if err := catch(w.writePending); err != nil {
+		slog.Error("InfluxDB write failed", "err", err)
+	}
+}
+
+// retry writes the points held back after a failed write, as the readings
+// they came from have already been smoothed and downsampled
+func (w *InfluxWriter) retry() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return catch(w.writePending)
+}
+
+// smoothed is points, with -smooth their power fields averaged over the
+// window
+func (w *InfluxWriter) smoothed(points []point) []point {
+	if w.smooth == nil {
+		return points
+	}
+	return w.smooth.smooth(points)
+}
+
+// downsampled is points, or with -downsample, the summaries of any periods
+// they complete
+func (w *InfluxWriter) downsampled(points []point) []point {
+	if w.downsample == nil {
+		return points
+	}
+	return w.downsample.add(points)
+}
+
+// takeOver carries on from old on reload: writing the points it has held
+// back, and skipping those it has already written
+func (w *InfluxWriter) takeOver(old *InfluxWriter) {
+	if old.downsample != nil && w.downsample != nil && old.downsample.period == w.downsample.period {
+		// Shared, as streams go on writing to old
+		w.downsample = old.downsample
+		old.downsampleTaken = true
+	}
+	if old.smooth != nil && w.smooth != nil && old.smooth.window == w.smooth.window && old.smooth.keepRaw == w.smooth.keepRaw {
+		// Shared too, with its lock
+		w.smooth = old.smooth
+	}
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(old.pending) > 0 {
+		w.pending = append(old.pending, w.pending...)
+		w.lastWrite = old.lastWrite
+		old.pending = nil
+	}
+	if old.dedupe.mode == w.dedupe.mode {
+		w.dedupe = old.dedupe
+	}
+}
+
+// writePending writes the points held back.  If that fails they're
+// spooled if there's a spool, or else kept to try again, up to the retry
+// buffer's worth.
+func (w *InfluxWriter) writePending() {
+	if w.flushTimer != nil {
+		w.flushTimer.Stop()
+		w.flushTimer = nil
+	}
+	lines := w.pending
+	if len(lines) == 0 {
+		return
+	}
+	w.lastWrite = time.Now()
+	if w.spool == nil {
+		err := w.writeLines(lines)
+		if err != nil && !errors.Is(err, errRejected) {
+			if over := len(w.pending) - w.cfg.RetryBuffer; over > 0 {
+				w.pending = w.pending[over:]
+				slog.Warn("InfluxDB retry buffer full, dropped the oldest points", "points", over)
+			}
+			check(err)
+		}
+		w.pending = nil
+		if err != nil {
+			slog.Error("InfluxDB refused points, dropped them", "points", len(lines), "err", err)
+			check(err)
+		}
+		return
+	}
+
+	w.pending = nil
+	err := w.spool.Flush(w.writeSpooled)
+	if err == nil {
+		err = w.writeLines(lines)
+	}
+	if errors.Is(err, errRejected) {
+		slog.Error("InfluxDB refused points, dropped them", "points", len(lines), "err", err)
+		check(err)
+	} else if err != nil {
+		w.spool.Add(lines)
+		slog.Warn("InfluxDB write failed, spooled points", "points", len(lines), "err", err)
+	}
+}
+
+// writeSpooled writes a spooled batch, dropping it if InfluxDB refuses it,
+// as it always would, rather than hold up those after it
+func (w *InfluxWriter) writeSpooled(lines []string) error {
+	err := w.writeLines(lines)
+	if errors.Is(err, errRejected) {
+		slog.Error("InfluxDB refused spooled points, dropped them", "points", len(lines), "err", err)
+		return nil
+	}
+	return err
+}
+
+// writeAsync queues lines with the InfluxDB 2.x batching writer, which
+// reports failures in the background
+func (w *InfluxWriter) writeAsync(lines []string) {
+	if w.spool != nil {
+		if err := w.spool.Flush(w.writeSpooled); err != nil {
+			w.spool.Add(lines)
+			slog.Warn("InfluxDB write failed, spooled points", "points", len(lines), "err", err)
+			return
+		}
+	}
+	for _, line := range lines {
+		w.v2Async.WriteRecord(line)
+	}
+	stats.pointsWritten.Add(int64(len(lines)))
+	stats.lastWrite.Store(time.Now().UnixNano())
+}
+
+func toLineProtocol(points []point) []string {
+	lines := make([]string, 0, len(points))
+	for _, p := range points {
+		pt := influxdb2.NewPoint(p.measurement, p.tags, p.fields, p.time)
+		line := strings.TrimSuffix(write.PointToLineProtocol(pt, time.Second), "\n")
+		if len(p.tags) == 0 {
+			line = dropTagSeparator(line)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// dropTagSeparator removes the comma the client puts after the measurement
+// even when there are no tags, which InfluxDB rejects
+func dropTagSeparator(line string) string {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++ // Escaped, part of the name
+		case ',':
+			return line[:i] + line[i+1:]
+		}
+	}
+	return line
+}
+
+// writeLines writes synchronously, keeping count of the outcome
+func (w *InfluxWriter) writeLines(lines []string) error {
+	err := w.writeLinesOnce(lines)
+	if err != nil {
+		stats.writeErrors.Add(1)
+	} else {
+		stats.pointsWritten.Add(int64(len(lines)))
+		stats.lastWrite.Store(time.Now().UnixNano())
+	}
+	return err
+}
+
+func (w *InfluxWriter) writeLinesOnce(lines []string) error {
+	if w.v2 != nil {
+		err := w.v2Write.WriteRecord(context.Background(), lines...)
+		var httpErr *http.Error
+		if errors.As(err, &httpErr) && httpErr.StatusCode != 0 {
+			return &influxWriteError{status: httpErr.StatusCode, message: httpErr.Message}
+		}
+		return err
+	}
+
+	body := &bytes.Buffer{}
+	var out io.Writer = body
+	if w.cfg.Gzip {
+		out = gzip.NewWriter(body)
+	}
+	io.WriteString(out, strings.Join(lines, "\n")+"\n")
+	if gz, ok := out.(*gzip.Writer); ok {
+		gz.Close()
+	}
+	params := url.Values{"db": {w.cfg.Database}, "precision": {"s"}}
+	if w.cfg.RetentionPolicy != "" {
+		params.Set("rp", w.cfg.RetentionPolicy)
+	}
+	req, err := nethttp.NewRequest("POST", strings.TrimSuffix(w.cfg.Addr, "/")+"/write?"+params.Encode(), body)
+	if err != nil {
+		return err
+	}
+	if w.cfg.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if w.cfg.Username != "" {
+		req.SetBasicAuth(w.cfg.Username, w.cfg.Password)
+	}
+	resp, err := w.v1Write.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 300 {
+		return &influxWriteError{status: resp.StatusCode, message: influxMessage(message)}
+	}
+	return nil
+}
+
+// influxWriteError is a write InfluxDB answered with an error status
+type influxWriteError struct {
+	status  int
+	message string
+}
+
+func (e *influxWriteError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.status, nethttp.StatusText(e.status), e.message)
+}
+
+// Is matches errRejected when retrying wouldn't help, e.g. a field type
+// conflict or a missing database, as opposed to InfluxDB being overloaded
+// or down
+func (e *influxWriteError) Is(target error) bool {
+	return target == errRejected && e.status < 500 && e.status != nethttp.StatusTooManyRequests
+}
+
+// Flush writes any points held back for batching
+func (w *InfluxWriter) Flush() error {
+	if w.downsample != nil && !w.downsampleTaken {
+		// The periods so far, rather than lose them
+		if err := catch(func() { w.WritePoints(w.downsample.flush()) }); err != nil {
+			return err
+		}
+	}
+	if w.v2Async != nil {
+		w.v2Async.Flush()
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return catch(w.writePending)
+}
+
+func (w *InfluxWriter) Close() error {
+	w.mu.Lock()
+	if w.flushTimer != nil {
+		w.flushTimer.Stop()
+	}
+	w.mu.Unlock()
+	if w.v2 != nil {
+		// Also flushes anything still batched
+		w.v2.Close()
+		return nil
+	}
+	return w.v1.Close()
+}
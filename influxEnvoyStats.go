@@ -5,6 +5,8 @@
 
 // API path used by the webpage provided by Envoy is e.g.:
 //  http://envoy/production.json?details=1
+// Per-microinverter readings come from:
+//  http://envoy/api/v1/production/inverters
 
 // David Lamb
 // 2018-12
@@ -12,12 +14,17 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/influxdata/influxdb/client/v2"
-	"io/ioutil"
-	"net/http"
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -27,118 +34,518 @@ func check(e error) {
 	}
 }
 
-type EnvoyAPIMeasurement struct {
-	Production  json.RawMessage
-	Consumption json.RawMessage
-	Storage     json.RawMessage
+// EnvoyReadings is everything gathered from the Envoy in one poll
+type EnvoyReadings struct {
+	Site        string
+	Serial      string // With -gwtags, the gateway's serial, firmware and model
+	Firmware    string
+	Model       string
+	Production  envoy.Eim
+	Consumption []envoy.Eim
+	Storage     []envoy.Storage
+	Inverters   []envoy.Inverter
+	Meters      []envoy.MeterReading
+	Livedata    *envoy.Livedata
+	Ensemble    *Ensemble
+	Home        *envoy.Home
+	Inventory   []envoy.Inventory
+	Devstatus   []envoy.DeviceStatus
+	PowerMode   *envoy.PowerMode
+	Energy      *envoy.Energy
+	DayEnergy   map[string]DayEnergy // By eim type, with a site timezone
+	EstimatedWh map[string]float64   // Lifetime energy by eim type, with -estimate-wh
+	Rollup      *DailyRollup         // The day before, on the first poll of a day
+	Cost        *Cost                // Since the previous poll, with a tariff
+	Gap         *Gap                 // Without readings, just before this poll
+	PollTime    time.Time
 }
 
-type Inverters struct {
-	ActiveCount int
+// eims is the consumption eims then production, in a slice of their own,
+// as the readings are shared by the outputs writing them at once
+func (r EnvoyReadings) eims() []envoy.Eim {
+	return append(append([]envoy.Eim{}, r.Consumption...), r.Production)
 }
 
-type Eim struct {
-	MeasurementType  string
-	ReadingTime      int64
-	WNow             float64
-	WhLifetime       float64
-	VarhLeadLifetime float64
-	VarhLagLifetime  float64
-	VahLifetime      float64
-	RmsCurrent       float64
-	RmsVoltage       float64
-	ReactPwr         float64
-	ApprntPwr        float64
-	PwrFactor        float64
-	WhToday          float64
-	WhLastSevenDays  float64
-	VahToday         float64
-	VarhLeadToday    float64
-	VarhLagToday     float64
+func pollEnvoy(gw gateway) EnvoyReadings {
+	client, site := gw.client, gw.site
+	production, err := client.GetProduction()
+	if errors.Is(err, envoy.ErrTokenRequired) {
+		err = fmt.Errorf("%w (-et) or Enlighten credentials (-eu/-ep)", err)
+	}
+	check(err)
+
+	readings := EnvoyReadings{
+		Site:        site,
+		Serial:      gw.serial,
+		Firmware:    gw.firmware,
+		Model:       gw.model,
+		PollTime:    gw.now().Truncate(time.Second),
+		Production:  production.Production,
+		Consumption: meteredConsumption(client.Host, production.Consumption),
+		Storage:     production.Storage,
+	}
+	slog.Debug("Reading", "site", site, "time", readings.Production.ReadingTime, "type", "production", "watts", readings.Production.WNow)
+	for _, eim := range readings.Consumption {
+		slog.Debug("Reading", "site", site, "time", eim.ReadingTime, "type", eim.MeasurementType, "watts", eim.WNow)
+	}
+	for _, st := range readings.Storage {
+		if st.ActiveCount > 0 {
+			slog.Debug("Storage", "site", site, "time", st.ReadingTime, "type", st.Type, "watts", st.WNow, "whNow", st.WhNow, "state", st.State)
+		}
+	}
+
+	// The other endpoints at once, each filling in its own part of the
+	// readings.  Production goes first, as recordings' polls start with it.
+	polls := []func(){}
+	if gw.cfg.Inverters {
+		polls = append(polls, func() {
+			inverters, err := client.GetInverters()
+			check(err)
+			for _, inv := range inverters {
+				slog.Debug("Inverter", "site", site, "time", inv.LastReportDate, "serial", inv.SerialNumber, "watts", inv.LastReportWatts)
+			}
+			readings.Inverters = inverters
+		})
+	}
+	if gw.cfg.Meters {
+		polls = append(polls, func() {
+			meters, err := client.GetMeterReadings()
+			check(err)
+			for _, m := range meters {
+				slog.Debug("Meter", "site", site, "time", m.Timestamp, "type", m.MeasurementType, "watts", m.ActivePower, "phases", len(m.Channels))
+			}
+			readings.Meters = meters
+		})
+	}
+	if gw.cfg.Livedata {
+		polls = append(polls, func() { readings.Livedata = pollLivedata(gw) })
+	}
+	if gw.cfg.Ensemble {
+		polls = append(polls, func() { readings.Ensemble = pollEnsemble(gw) })
+	}
+	if gw.cfg.Home {
+		polls = append(polls, func() { readings.Home = pollHome(gw) })
+	}
+	if gw.cfg.Inventory {
+		polls = append(polls, func() { readings.Inventory = pollInventory(gw) })
+	}
+	if gw.cfg.Energy {
+		polls = append(polls, func() { readings.Energy = pollEnergy(gw) })
+	}
+	if gw.cfg.Devstatus {
+		polls = append(polls, func() { readings.Devstatus = pollDevstatus(gw) })
+	}
+	if gw.cfg.PowerMode {
+		polls = append(polls, func() { readings.PowerMode = pollPowerMode(gw) })
+	}
+	check(runParallel(gw.cfg.Parallel, polls))
+
+	checkClock(gw, &readings)
+	if gw.loc != nil {
+		readings.DayEnergy = dayEnergy(gw.client.Host, readings, gw.loc)
+	}
+	if gw.cfg.EstimateEnergy {
+		readings.EstimatedWh = estimateEnergy(gw, readings)
+	}
+	if gw.rollup {
+		readings.Rollup = addToRollup(gw.client.Host, readings, gw.loc)
+	}
+	if gw.tariff != nil {
+		readings.Cost = addCost(gw.client.Host, readings, gw.tariff, gw.loc)
+	}
+	return readings
 }
 
-func main() {
-	envoyHostPtr := flag.String("e", "envoy", "IP or hostname of Envoy")
-	influxAddrPtr := flag.String("dba", "http://localhost:8086", "InfluxDB connection address")
-	dbNamePtr := flag.String("dbn", "solar", "Influx database name to put readings in")
-	dbUserPtr := flag.String("dbu", "user", "DB username")
-	dbPwPtr := flag.String("dbp", "pw", "DB password")
-	measurementNamePtr := flag.String("m", "readings", "Influx measurement name customisation (table name equivalent)")
-	flag.Parse()
-
-	envoyUrl := "http://" + *envoyHostPtr + "/production.json?details=1"
-	envoyClient := http.Client{
-		Timeout: time.Second * 2, // Maximum of 2 secs
-	}
-	req, err := http.NewRequest(http.MethodGet, envoyUrl, nil)
-	check(err)
-	resp, err := envoyClient.Do(req)
-	check(err)
-	jsonData, err := ioutil.ReadAll(resp.Body)
+func getSerial(client *envoy.Client) string {
+	serial, err := client.GetSerial()
 	check(err)
+	return serial
+}
+
+// tryPoll runs poll with its panics returned as errors
+func tryPoll(poll func() EnvoyReadings) (readings EnvoyReadings, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError(r)
+		}
+	}()
+	return poll(), nil
+}
 
-	var apiJsonObj struct {
-		Production  json.RawMessage
-		Consumption json.RawMessage
-		Storage     json.RawMessage
+// runParallel runs fs, at most limit at a time, returning their panics as
+// errors once all have finished
+func runParallel(limit int, fs []func()) error {
+	if limit < 1 {
+		limit = 1
 	}
-	err = json.Unmarshal(jsonData, &apiJsonObj)
-	check(err)
+	slots := make(chan struct{}, limit)
+	errs := make([]error, len(fs))
+	var wg sync.WaitGroup
+	for i, f := range fs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, f func()) {
+			defer wg.Done()
+			errs[i] = catch(f)
+			<-slots
+		}(i, f)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
 
-	inverters := Inverters{}
-	prodReadings := Eim{}
-	productionObj := []interface{}{&inverters, &prodReadings}
-	err = json.Unmarshal(apiJsonObj.Production, &productionObj)
-	check(err)
+// pollEnvoyWithRetry retries failed polls up to retries times, waiting
+// backoff, then doubling it each time, plus up to 50% random jitter
+func pollEnvoyWithRetry(gw gateway) EnvoyReadings {
+	cfg := gw.cfg
+	for attempt := 0; ; attempt++ {
+		readings, err := tryPoll(func() EnvoyReadings {
+			return pollEnvoy(gw)
+		})
+		if err == nil {
+			return readings
+		}
+		stats.pollErrors.Add(1)
+		if attempt >= cfg.Retries {
+			panic(err)
+		}
+		delay := cfg.RetryBackoff << uint(attempt)
+		delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		slog.Warn("Poll failed, retrying", "host", gw.client.Host, "err", err, "delay", delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
 
-	fmt.Printf("%d production: %.3f\n", prodReadings.ReadingTime, prodReadings.WNow)
+// gateway is an Envoy to poll, with its settings
+type gateway struct {
+	client *envoy.Client
+	site   string // Tags readings when polling several Envoys
+	cfg    EnvoyConfig
+	loc    *time.Location   // For daily energy, if a timezone is set
+	rollup bool             // Sum up each day
+	tariff *tariff          // To cost grid import and export with
+	clock  func() time.Time // When replaying, the time recorded
 
-	consumptionReadings := []Eim{}
-	err = json.Unmarshal(apiJsonObj.Consumption, &consumptionReadings)
-	check(err)
-	for _, eim := range consumptionReadings {
-		fmt.Printf("%d %s: %.3f\n", eim.ReadingTime, eim.MeasurementType, eim.WNow)
+	// From info.xml at startup, with -gwtags
+	serial   string
+	firmware string
+	model    string
+}
+
+// now is the poll time: the time now, or when replaying, when recorded
+func (gw gateway) now() time.Time {
+	if gw.clock != nil {
+		return gw.clock()
 	}
+	return time.Now()
+}
 
-	// Connect to influxdb specified in commandline arguments
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:     *influxAddrPtr,
-		Username: *dbUserPtr,
-		Password: *dbPwPtr,
-	})
-	check(err)
-	defer c.Close()
+// tokenCacheFile is where an Envoy's token is cached: with several, a file
+// each, by serial
+func tokenCacheFile(ec EnvoyConfig, serial string, several bool) string {
+	if ec.TokenCache != "" && several {
+		return ec.TokenCache + "." + serial
+	}
+	return ec.TokenCache
+}
 
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  *dbNamePtr,
-		Precision: "s",
-	})
-	check(err)
+// rateLimiters is each Envoy host's rate limiter, shared by every client
+// of it: those of entries for the same host, and on reload, the old
+// clients still streaming and the new ones
+var rateLimiters = map[string]*envoy.RateLimiter{}
+
+// rateLimiter is host's rate limiter, allowing rate requests a second
+func rateLimiter(host string, rate float64) *envoy.RateLimiter {
+	l, ok := rateLimiters[host]
+	if !ok {
+		l = envoy.NewRateLimiter(host, rate)
+		rateLimiters[host] = l
+	}
+	l.SetRate(rate)
+	return l
+}
 
-	readings := append(consumptionReadings, prodReadings)
-	for _, reading := range readings {
-		tags := map[string]string{
-			"type": reading.MeasurementType,
+// newGateways sets up each configured Envoy, finding them via mDNS for
+// host auto and obtaining tokens from Enlighten where needed
+func newGateways(cfg *Config) []gateway {
+	gateways := []gateway{}
+	envoyConfigs := []EnvoyConfig{}
+	for _, ec := range cfg.envoyConfigs() {
+		if ec.Host != "auto" {
+			envoyConfigs = append(envoyConfigs, ec)
+			continue
 		}
-		fields := map[string]interface{}{
-			"watts": reading.WNow,
+		for _, host := range discoverEnvoyHosts() {
+			ec.Host = host
+			envoyConfigs = append(envoyConfigs, ec)
 		}
-		createdTime := time.Unix(reading.ReadingTime, 0)
+	}
+	for _, ec := range envoyConfigs {
+		client := envoy.NewClient(ec.Host, ec.Token)
+		client.Timeout = ec.Timeout
+		client.SetKeepAlive(ec.KeepAlive, ec.MaxIdleConns)
+		proxy, err := proxyFunc(ec.Proxy)
 		check(err)
-		pt, err := client.NewPoint(
-			*measurementNamePtr,
-			tags,
-			fields,
-			createdTime,
-		)
+		client.SetProxy(proxy)
+		if ec.Rate > 0 {
+			client.Limiter = rateLimiter(ec.Host, ec.Rate)
+		}
+		if cfg.Record != "" {
+			client.Record = recorder(cfg.Record, ec.Host)
+		}
+		serial := ec.Serial
+		if ec.Firmware == "auto" {
+			client.Firmware = detectFirmware(client, &ec)
+			if serial == "" && client.Firmware != nil {
+				serial = client.Firmware.Info.Device.Sn
+			}
+		}
+		if client.Token == "" && ec.Username != "" {
+			if serial == "" {
+				serial = getSerial(client)
+			}
+			client.Tokens = envoy.NewTokenSource(ec.Username, ec.Password, serial, tokenCacheFile(ec, serial, len(envoyConfigs) > 1))
+		}
+		if ec.DigestUser != "" {
+			client.DigestUser, client.DigestPassword = ec.DigestUser, ec.DigestPassword
+			if client.DigestPassword == "" {
+				if serial == "" {
+					serial = getSerial(client)
+				}
+				client.DigestPassword = envoy.DefaultPassword(ec.DigestUser, serial)
+			}
+		}
+		if client.Firmware != nil && client.Firmware.Tokens {
+			selectForRole(client, &ec, cfg.Interval > 0 && len(cfg.influxConfigs()) > 0 && cfg.Out == "")
+		}
+		site := ec.Site
+		if site == "" && len(envoyConfigs) > 1 {
+			if serial == "" {
+				serial = getSerial(client)
+			}
+			site = serial
+		}
+		gw := gateway{client: client, site: site, cfg: ec, loc: ec.location(), rollup: cfg.Influx.DailyMeasurement != ""}
+		gw.tariff = gatewayTariff(cfg.Tariff, client)
+		if cfg.Influx.GatewayTags {
+			info := &envoy.Info{}
+			if client.Firmware != nil {
+				*info = client.Firmware.Info
+			} else {
+				var err error
+				info, err = client.GetInfo()
+				check(err)
+			}
+			gw.serial, gw.firmware, gw.model = info.Device.Sn, info.Device.Software, info.Model()
+			if ec.Model != "" {
+				gw.model = ec.Model
+			}
+			slog.Info("Gateway", "host", ec.Host, "serial", gw.serial, "firmware", gw.firmware, "model", gw.model)
+		}
+		gateways = append(gateways, gw)
+	}
+	return gateways
+}
+
+func main() {
+	flag.Usage = usage
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "":
+		// No subcommand: poll once, or keep polling with -l, as always
+		run(loadConfig(args))
+	case "poll":
+		cfg := loadConfig(args)
+		cfg.Interval = 0
+		run(cfg)
+	case "serve":
+		cfg := loadConfig(args)
+		if cfg.Interval == 0 {
+			cfg.Interval = time.Minute
+		}
+		run(cfg)
+	case "discover":
+		discoverCommand(args)
+	case "token":
+		tokenCommand(args)
+	case "export":
+		exportCommand(args)
+	case "simulate":
+		simulateCommand(args)
+	case "backfill":
+		backfillCommand(args)
+	case "help":
+		usage()
+	case "validate-config":
+		validateConfigCommand(args)
+	case "service":
+		serviceCommand(args)
+	case "healthcheck":
+		healthcheckCommand(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", command)
+		usage()
+		os.Exit(2)
+	}
+}
+
+// stopSignals stops polling in a loop, from the OS or a Windows service
+// being stopped
+var stopSignals = make(chan os.Signal, 1)
+
+// run polls the Envoys and writes to the configured outputs, once or in
+// a loop when an interval is set
+func run(cfg *Config) {
+	if cfg.Interval == 0 {
+		// Polling once, as from cron: exit with a code for what failed
+		defer exitOnFailure()
+	}
+	if err := cfg.validate(); err != nil {
+		panic(fmt.Errorf("%w: %w", errConfig, err))
+	}
+	setupLogging(cfg.LogLevel, cfg.LogFormat)
+
+	if cfg.Replay != "" {
+		replay(cfg)
+		return
+	}
+
+	if cfg.Prometheus.Listen != "" {
+		servePrometheus(cfg.Prometheus.Listen)
+	}
+	if cfg.Health != "" {
+		serveHealth(cfg.Health, cfg, len(cfg.influxConfigs()) > 0 && cfg.Out == "")
+	}
+	if cfg.Http != "" {
+		serveWeb(cfg.Http, cfg.Interval)
+	}
+
+	gateways := newGateways(cfg)
+
+	sinks := newSinks(cfg, gateways)
+	checkInflux(cfg, sinks)
+	streaming := false
+	for _, gw := range gateways {
+		if gw.cfg.Stream {
+			go streamMeter(gw, cfg.Influx.StreamMeasurement, influxSinks(sinks))
+			streaming = true
+		}
+	}
+
+	lastPolls := map[string]time.Time{} // Each Envoy's last successful poll
+	pollAndWrite := func() error {
+		// Poll all Envoys at once, then write whatever was gathered
+		start := time.Now()
+		results := make([]*EnvoyReadings, len(gateways))
+		errs := make([]error, len(gateways))
+		var wg sync.WaitGroup
+		for i, gw := range gateways {
+			wg.Add(1)
+			go func(i int, gw gateway) {
+				defer wg.Done()
+				readings, err := tryPoll(func() EnvoyReadings {
+					return pollEnvoyWithRetry(gw)
+				})
+				if err != nil {
+					errs[i] = fmt.Errorf("%s: %w", gw.client.Host, err)
+					return
+				}
+				results[i] = &readings
+				stats.lastPoll.Store(time.Now().UnixNano())
+			}(i, gw)
+		}
+		wg.Wait()
+		stats.polls.Add(1)
+		stats.pollDuration.Store(int64(time.Since(start)))
+
+		polled := []EnvoyReadings{}
+		for i, readings := range results {
+			if readings != nil {
+				checkGap(cfg, lastPolls, gateways[i].client.Host, readings)
+				polled = append(polled, *readings)
+			}
+		}
+		if err := writeSinks(sinks, polled); err != nil {
+			errs = append(errs, writeError{err})
+		}
+		return errors.Join(errs...)
+	}
+
+	if cfg.Interval == 0 {
+		// Write anything held back now, to know whether it worked
+		err := catch(func() { check(pollAndWrite()) })
+		for _, sink := range sinks {
+			if flushErr := sink.Flush(); flushErr != nil {
+				err = errors.Join(err, writeError{flushErr})
+			}
+		}
+		closeSinks(sinks)
 		check(err)
-		bp.AddPoint(pt)
+		return
 	}
 
-	// Write the batch
-	err = c.Write(bp)
-	check(err)
+	// Loop mode: a failed poll is reported and retried on the next tick
+	pollLogged := func() {
+		if err := catch(func() { check(pollAndWrite()) }); err != nil {
+			slog.Error("Poll failed", "err", err)
+		}
+	}
+	quit := make(chan struct{})
 
-	err = c.Close()
-	check(err)
+	// Stop cleanly when the service is stopped or restarted
+	signal.Notify(stopSignals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-stopSignals
+		slog.Info("Shutting down", "signal", sig.String())
+		close(quit)
+	}()
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	// Under systemd, ping the watchdog only while polls are succeeding
+	var watchdog <-chan time.Time
+	if interval := sdWatchdogInterval(); interval > 0 {
+		watchdog = time.NewTicker(interval).C
+	}
+
+	// Poll straight away, then on schedule.  next is when each poll is
+	// due, before any jitter, so jitter doesn't accumulate.
+	next := time.Now()
+	pollLogged()
+	sdNotify("READY=1")
+	if cfg.Align {
+		next = cfg.alignPoll(next).Add(-cfg.Interval)
+	}
+	for {
+		next = next.Add(cfg.nextPollDelay(next))
+		if next.Before(time.Now()) {
+			// Fell behind, e.g. slow retries
+			next = time.Now()
+		}
+		next = cfg.alignPoll(next)
+		timer := time.NewTimer(time.Until(next) + cfg.pollJitter())
+	wait:
+		select {
+		case <-timer.C:
+			pollLogged()
+		case <-watchdog:
+			if fresh(cfg, unixNanoTime(stats.lastPoll.Load())) {
+				sdNotify("WATCHDOG=1")
+			}
+			goto wait
+		case <-hangups:
+			// Takes effect from the poll after the one due
+			cfg, gateways, sinks = reload(cfg, gateways, sinks, streaming)
+			goto wait
+		case <-quit:
+			sdNotify("STOPPING=1")
+			timer.Stop()
+			// Writes anything still pending
+			closeSinks(sinks)
+			return
+		}
+	}
 }
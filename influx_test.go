@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeInflux is an InfluxDB 1.x answering writes with status, and noting
+// the lines written
+type fakeInflux struct {
+	status  int
+	written []string
+}
+
+func (f *fakeInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/write" || r.URL.Query().Get("db") != "solar" {
+		http.NotFound(w, r)
+		return
+	}
+	if f.status != http.StatusNoContent {
+		http.Error(w, `{"error":"failed"}`, f.status)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	f.written = append(f.written, strings.Fields(string(body))...)
+	w.WriteHeader(f.status)
+}
+
+func fakeInfluxWriter(t *testing.T, retryBuffer int) (*InfluxWriter, *fakeInflux) {
+	influx := &fakeInflux{status: http.StatusNoContent}
+	server := httptest.NewServer(influx)
+	t.Cleanup(server.Close)
+	cfg := InfluxConfig{Addr: server.URL, Database: "solar", RetryBuffer: retryBuffer}
+	return &InfluxWriter{cfg: cfg, v1Write: &http.Client{}}, influx
+}
+
+func TestWritePendingRetries(t *testing.T) {
+	w, influx := fakeInfluxWriter(t, 3)
+
+	influx.status = http.StatusInternalServerError
+	w.pending = []string{"a", "b"}
+	if err := catch(w.writePending); err == nil || errors.Is(err, errRejected) {
+		t.Fatalf("write to a failing InfluxDB gave %v, want a retryable error", err)
+	}
+	if strings.Join(w.pending, ",") != "a,b" {
+		t.Fatalf("pending %v after a failure, want them kept", w.pending)
+	}
+
+	influx.status = http.StatusTooManyRequests
+	w.pending = append(w.pending, "c", "d")
+	if err := catch(w.writePending); err == nil {
+		t.Fatalf("write rate limited succeeded")
+	}
+	if strings.Join(w.pending, ",") != "b,c,d" {
+		t.Fatalf("pending %v, want the newest 3 kept", w.pending)
+	}
+
+	influx.status = http.StatusNoContent
+	if err := catch(w.writePending); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.pending) != 0 || strings.Join(influx.written, ",") != "b,c,d" {
+		t.Errorf("pending %v, written %v, want b,c,d written", w.pending, influx.written)
+	}
+}
+
+func TestWritePendingRejected(t *testing.T) {
+	w, influx := fakeInfluxWriter(t, 10)
+
+	influx.status = http.StatusBadRequest
+	w.pending = []string{"a", "b"}
+	if err := catch(w.writePending); !errors.Is(err, errRejected) {
+		t.Fatalf("write refused gave %v, want it rejected", err)
+	}
+	if len(w.pending) != 0 {
+		t.Errorf("pending %v after being refused, want them dropped", w.pending)
+	}
+}
+
+func TestWritePendingSpooled(t *testing.T) {
+	w, influx := fakeInfluxWriter(t, 10)
+	w.spool = NewSpool(t.TempDir())
+
+	influx.status = http.StatusServiceUnavailable
+	w.pending = []string{"a", "b"}
+	if err := catch(w.writePending); err != nil {
+		t.Fatalf("spooling gave %v", err)
+	}
+	if len(w.pending) != 0 || len(influx.written) != 0 {
+		t.Fatalf("pending %v, written %v, want them spooled", w.pending, influx.written)
+	}
+
+	influx.status = http.StatusNoContent
+	w.pending = []string{"c"}
+	if err := catch(w.writePending); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(influx.written, ",") != "a,b,c" {
+		t.Errorf("written %v, want the spooled points then the new", influx.written)
+	}
+}
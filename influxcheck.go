@@ -0,0 +1,134 @@
+package main
+
+// Checking InfluxDB at startup: each InfluxDB is pinged and sent an empty
+// write, which InfluxDB authenticates and looks up the org and bucket (or
+// database) for before finding there's nothing in it, so bad credentials,
+// a missing bucket or a read-only token stop the poller straight away,
+// saying which, instead of with the first write.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// errInfluxUnreachable is InfluxDB not answering, as opposed to refusing
+var errInfluxUnreachable = errors.New("unreachable")
+
+// checkInflux checks each InfluxDB can be written to, as -dbcheck says:
+// failing if not, or with -spool only if it answers but refuses, as
+// readings are spooled until it's back
+func checkInflux(cfg *Config, sinks []Sink) {
+	for _, w := range influxSinks(sinks) {
+		mode := w.cfg.Check
+		if mode == "" {
+			// Polling in a loop, InfluxDB may just be starting up too, and
+			// failed writes are retried
+			mode = "warn"
+			if cfg.Interval == 0 {
+				mode = "fail"
+			}
+		}
+		if mode == "off" {
+			continue
+		}
+		err := w.checkWrite()
+		if err == nil {
+			slog.Debug("InfluxDB can be written to", "addr", w.cfg.Addr, "bucket", w.cfg.Database)
+			continue
+		}
+		if mode == "warn" || errors.Is(err, errInfluxUnreachable) && w.spool != nil {
+			slog.Warn("Checking InfluxDB failed", "addr", w.cfg.Addr, "err", err)
+			continue
+		}
+		check(writeError{fmt.Errorf("InfluxDB at %s: %w (-dbcheck warn to carry on)", w.cfg.Addr, err)})
+	}
+}
+
+// checkWrite pings InfluxDB and sends it an empty write
+func (w *InfluxWriter) checkWrite() error {
+	if w.v2 != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		if _, err := w.v2.Ping(ctx); err != nil {
+			return fmt.Errorf("%w: %w", errInfluxUnreachable, err)
+		}
+	} else if _, _, err := w.v1.Ping(time.Second * 10); err != nil {
+		return fmt.Errorf("%w: %w", errInfluxUnreachable, err)
+	}
+
+	params := url.Values{}
+	path := "/write"
+	what := "database " + w.cfg.Database
+	if w.v2 != nil {
+		path = "/api/v2/write"
+		params.Set("org", w.cfg.Org)
+		params.Set("bucket", w.cfg.Database)
+		what = "bucket " + w.cfg.Database
+	} else {
+		params.Set("db", w.cfg.Database)
+		if w.cfg.RetentionPolicy != "" {
+			params.Set("rp", w.cfg.RetentionPolicy)
+		}
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(w.cfg.Addr, "/")+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if w.v2 != nil {
+		req.Header.Set("Authorization", "Token "+w.cfg.Token)
+	} else if w.cfg.Username != "" {
+		req.SetBasicAuth(w.cfg.Username, w.cfg.Password)
+	}
+	proxy, err := proxyFunc(w.cfg.Proxy)
+	if err != nil {
+		return err
+	}
+	c := &http.Client{Timeout: time.Second * 10, Transport: &http.Transport{Proxy: proxy}}
+	resp, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInfluxUnreachable, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode < 300, resp.StatusCode == http.StatusBadRequest:
+		// Let through, and only then found to have no points
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		if w.v2 != nil {
+			return errors.New("the token (-dbt) was refused")
+		}
+		return errors.New("the username and password (-dbu/-dbp) were refused")
+	case resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("not allowed to write to %s: %s", what, influxMessage(body))
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%s (-dbn/-dbo, or -dbcreate to create it)", influxMessage(body))
+	}
+	return fmt.Errorf("%s: %s", resp.Status, influxMessage(body))
+}
+
+// influxMessage is the message in an InfluxDB error response, whichever
+// version it's from
+func influxMessage(body []byte) string {
+	var e struct {
+		Message string `json:"message"` // 2.x
+		Error   string `json:"error"`   // 1.x
+	}
+	json.Unmarshal(body, &e)
+	switch {
+	case e.Message != "":
+		return e.Message
+	case e.Error != "":
+		return e.Error
+	}
+	return strings.TrimSpace(string(body))
+}
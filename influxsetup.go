@@ -0,0 +1,197 @@
+package main
+
+// Setting up InfluxDB at startup: with -dbcreate, the bucket (InfluxDB 2.x)
+// or database (1.x) is created if it isn't there yet, with -dbretention,
+// and with -dblong another to keep a downsampled copy of the readings in
+// for longer, filled by an InfluxDB task (2.x) or continuous query (1.x).
+// The task keeps the field names; the continuous query, averaging every
+// field with mean(*) as they aren't known until written, can't, and names
+// them mean_<field>.  What's there already is left as it is.
+
+import (
+	"context"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+	"github.com/influxdata/influxdb/client/v2"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// influxDuration is d in whole seconds as both Flux and InfluxQL take it,
+// e.g. 2592000s
+func influxDuration(d time.Duration) string {
+	return fmt.Sprintf("%ds", int64(d/time.Second))
+}
+
+// setup creates what's missing of the bucket or database and the
+// long-term copy, warning rather than failing, as InfluxDB may not be up
+// yet or the credentials not allowed to, and writing would say so anyway
+func (w *InfluxWriter) setup() {
+	var err error
+	if w.v2 != nil {
+		err = w.setupV2()
+	} else {
+		err = w.setupV1()
+	}
+	if err != nil {
+		slog.Warn("Setting up InfluxDB failed", "addr", w.cfg.Addr, "err", err)
+	}
+}
+
+func (w *InfluxWriter) setupV2() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	org, err := w.v2.OrganizationsAPI().FindOrganizationByName(ctx, w.cfg.Org)
+	if err != nil {
+		return fmt.Errorf("organisation %s: %w", w.cfg.Org, err)
+	}
+	buckets := w.v2.BucketsAPI()
+	ensure := func(name string, retention time.Duration) error {
+		if _, err := buckets.FindBucketByName(ctx, name); err == nil {
+			return nil
+		} else if !strings.Contains(err.Error(), "not found") {
+			return fmt.Errorf("bucket %s: %w", name, err)
+		}
+		rule := domain.RetentionRule{EverySeconds: int64(retention / time.Second)}
+		if _, err := buckets.CreateBucketWithName(ctx, org, name, rule); err != nil {
+			return fmt.Errorf("creating bucket %s: %w", name, err)
+		}
+		slog.Info("Created InfluxDB bucket", "bucket", name, "retention", retention)
+		return nil
+	}
+	if err := ensure(w.cfg.Database, w.cfg.Retention); err != nil {
+		return err
+	}
+	if w.cfg.LongTerm == "" {
+		return nil
+	}
+	if err := ensure(w.cfg.LongTerm, w.cfg.LongTermRetention); err != nil {
+		return err
+	}
+
+	tasks := w.v2.TasksAPI()
+	name := w.cfg.Database + " to " + w.cfg.LongTerm
+	existing, err := tasks.FindTasks(ctx, &api.TaskFilter{Name: name, OrgID: *org.Id})
+	if err != nil {
+		return fmt.Errorf("task %s: %w", name, err)
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+	// Each numeric field's mean over the period, under the same names
+	flux := fmt.Sprintf(`import "types"
+
+option task = {name: %q, every: %s}
+
+from(bucket: %q)
+  |> range(start: -task.every)
+  |> filter(fn: (r) => types.isNumeric(v: r._value))
+  |> aggregateWindow(every: task.every, fn: mean, createEmpty: false)
+  |> to(bucket: %q, org: %q)
+`, name, influxDuration(w.cfg.LongTermEvery), w.cfg.Database, w.cfg.LongTerm, w.cfg.Org)
+	if _, err := tasks.CreateTaskByFlux(ctx, flux, *org.Id); err != nil {
+		return fmt.Errorf("creating task %s: %w", name, err)
+	}
+	slog.Info("Created InfluxDB task", "task", name, "every", w.cfg.LongTermEvery)
+	return nil
+}
+
+// v1Query runs an InfluxQL statement, giving the values of its rows
+func (w *InfluxWriter) v1Query(command string) ([][]interface{}, error) {
+	response, err := w.v1.Query(client.NewQuery(command, w.cfg.Database, ""))
+	if err == nil {
+		err = response.Error()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", command, err)
+	}
+	values := [][]interface{}{}
+	for _, result := range response.Results {
+		for _, row := range result.Series {
+			values = append(values, row.Values...)
+		}
+	}
+	return values, nil
+}
+
+// v1Has is whether the first column of a SHOW statement's rows has name
+func (w *InfluxWriter) v1Has(show string, name string) (bool, error) {
+	rows, err := w.v1Query(show)
+	if err != nil {
+		return false, err
+	}
+	for _, row := range rows {
+		if len(row) > 0 && row[0] == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (w *InfluxWriter) setupV1() error {
+	db := w.cfg.Database
+	// INF, kept forever, for no retention
+	retention := func(d time.Duration) string {
+		if d == 0 {
+			return "INF"
+		}
+		return influxDuration(d)
+	}
+
+	exists, err := w.v1Has("SHOW DATABASES", db)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		rp := w.cfg.RetentionPolicy
+		if rp == "" {
+			rp = "autogen"
+		}
+		_, err := w.v1Query(fmt.Sprintf("CREATE DATABASE %q WITH DURATION %s NAME %q", db, retention(w.cfg.Retention), rp))
+		if err != nil {
+			return err
+		}
+		slog.Info("Created InfluxDB database", "database", db, "retentionPolicy", rp, "retention", w.cfg.Retention)
+	}
+	if w.cfg.LongTerm == "" {
+		return nil
+	}
+
+	exists, err = w.v1Has(fmt.Sprintf("SHOW RETENTION POLICIES ON %q", db), w.cfg.LongTerm)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err := w.v1Query(fmt.Sprintf("CREATE RETENTION POLICY %q ON %q DURATION %s REPLICATION 1", w.cfg.LongTerm, db, retention(w.cfg.LongTermRetention)))
+		if err != nil {
+			return err
+		}
+		slog.Info("Created InfluxDB retention policy", "database", db, "retentionPolicy", w.cfg.LongTerm, "retention", w.cfg.LongTermRetention)
+	}
+
+	name := db + "_" + w.cfg.LongTerm
+	exists, err = w.v1Has("SHOW CONTINUOUS QUERIES", name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	// From the default retention policy, or the one written to
+	from := fmt.Sprintf("%q", db)
+	if w.cfg.RetentionPolicy != "" {
+		from += fmt.Sprintf(".%q", w.cfg.RetentionPolicy)
+	} else {
+		from += "."
+	}
+	// mean(*) can't be aliased, so the fields come out as mean_<field>
+	_, err = w.v1Query(fmt.Sprintf("CREATE CONTINUOUS QUERY %q ON %q BEGIN SELECT mean(*) INTO %q.%q.:MEASUREMENT FROM %s./.*/ GROUP BY time(%s), * END",
+		name, db, db, w.cfg.LongTerm, from, influxDuration(w.cfg.LongTermEvery)))
+	if err != nil {
+		return err
+	}
+	slog.Info("Created InfluxDB continuous query", "query", name, "every", w.cfg.LongTermEvery)
+	return nil
+}
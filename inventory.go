@@ -0,0 +1,51 @@
+package main
+
+// Per-device status from /inventory.json, so microinverters and Q-relays
+// that stop producing or communicating show up
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+func pollInventory(gw gateway) []envoy.Inventory {
+	inventory, err := gw.client.GetInventory()
+	check(err)
+	for _, inv := range inventory {
+		for _, d := range inv.Devices {
+			if !d.Producing || !d.Communicating {
+				slog.Debug("Device not reporting", "site", gw.site, "type", inv.Type, "serial", d.SerialNum, "producing", d.Producing, "communicating", d.Communicating, "lastReport", d.LastRptDate)
+			}
+		}
+	}
+	return inventory
+}
+
+// inventoryPoints are at pollTime rather than each device's last report, so
+// a device that has gone quiet still gets its current status written
+func inventoryPoints(measurement string, inventory []envoy.Inventory, pollTime time.Time) []point {
+	points := []point{}
+	for _, inv := range inventory {
+		for _, d := range inv.Devices {
+			points = append(points, point{
+				measurement: measurement,
+				tags: map[string]string{
+					"type":   strings.ToLower(inv.Type),
+					"serial": d.SerialNum,
+				},
+				fields: map[string]interface{}{
+					"producing":     d.Producing,
+					"communicating": d.Communicating,
+					"provisioned":   d.Provisioned,
+					"operating":     d.Operating,
+					"status":        strings.Join(d.DeviceStatus, ","),
+					"lastReport":    d.LastRptDate,
+				},
+				time: pollTime,
+			})
+		}
+	}
+	return points
+}
@@ -0,0 +1,59 @@
+package main
+
+// -out jsonl: each point as a line of JSON on stdout, for piping to other
+// tools, e.g.
+//  {"measurement":"readings","time":"2024-01-31T12:00:00Z","type":"production","watts":1234}
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+type JsonlWriter struct {
+	out    io.Writer
+	influx InfluxConfig // Measurement names and fields to write
+	dedupe *dedupe
+}
+
+func NewJsonlWriter(influx InfluxConfig) *JsonlWriter {
+	return &JsonlWriter{out: os.Stdout, influx: influx, dedupe: newDedupe(influx.Duplicates)}
+}
+
+// pointObject is p for encoding as JSON, with its tags and fields
+// flattened alongside the measurement and time, as they don't overlap
+func pointObject(p point) map[string]interface{} {
+	obj := map[string]interface{}{
+		"measurement": p.measurement,
+		"time":        p.time.UTC().Format(time.RFC3339),
+	}
+	for k, v := range p.tags {
+		obj[k] = v
+	}
+	for k, v := range p.fields {
+		obj[k] = v
+	}
+	return obj
+}
+
+func (w *JsonlWriter) Write(readings []EnvoyReadings) error {
+	encoder := json.NewEncoder(w.out)
+	for _, r := range readings {
+		for _, p := range w.dedupe.filter(readingsToPoints(w.influx, r), r.PollTime) {
+			if err := encoder.Encode(pointObject(p)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush is a no-op as stdout isn't buffered
+func (w *JsonlWriter) Flush() error {
+	return nil
+}
+
+func (w *JsonlWriter) Close() error {
+	return nil
+}
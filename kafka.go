@@ -0,0 +1,78 @@
+package main
+
+// Kafka output: a JSON message per point, as for -out jsonl, optionally
+// keyed by the reading's type so each type stays in order on a partition
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/segmentio/kafka-go"
+	"strings"
+	"time"
+)
+
+type KafkaWriter struct {
+	writer *kafka.Writer
+	key    bool
+	influx InfluxConfig // Measurement names and fields to write
+	dedupe *dedupe
+}
+
+func NewKafkaWriter(cfg KafkaConfig, influx InfluxConfig) *KafkaWriter {
+	brokers := []string{}
+	for _, b := range strings.Split(cfg.Brokers, ",") {
+		brokers = append(brokers, strings.TrimSpace(b))
+	}
+	return &KafkaWriter{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireOne,
+			WriteTimeout: time.Second * 10,
+		},
+		key:    cfg.KeyByType,
+		influx: influx,
+		dedupe: newDedupe(influx.Duplicates),
+	}
+}
+
+// messageKey is p's type tag, or its measurement for those without one
+func messageKey(p point) string {
+	if t, ok := p.tags["type"]; ok {
+		return t
+	}
+	return p.measurement
+}
+
+func (w *KafkaWriter) Write(readings []EnvoyReadings) error {
+	messages := []kafka.Message{}
+	for _, r := range readings {
+		for _, p := range w.dedupe.filter(readingsToPoints(w.influx, r), r.PollTime) {
+			value, err := json.Marshal(pointObject(p))
+			if err != nil {
+				return err
+			}
+			message := kafka.Message{Value: value, Time: p.time}
+			if w.key {
+				message.Key = []byte(messageKey(p))
+			}
+			messages = append(messages, message)
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	return w.writer.WriteMessages(ctx, messages...)
+}
+
+// Flush is a no-op as WriteMessages waits for the batch to be acknowledged
+func (w *KafkaWriter) Flush() error {
+	return nil
+}
+
+func (w *KafkaWriter) Close() error {
+	return w.writer.Close()
+}
@@ -0,0 +1,59 @@
+package main
+
+// High resolution power flows from /ivp/livedata/status.  The Envoy only
+// updates it while the livedata stream is enabled, which lapses after a
+// while, so it's re-enabled whenever found off.
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"time"
+)
+
+// pollLivedata reads livedata, enabling the stream when found off
+func pollLivedata(gw gateway) *envoy.Livedata {
+	live, err := gw.client.GetLivedata()
+	check(err)
+	if !live.StreamEnabled() {
+		slog.Info("Enabling Envoy livedata stream", "host", gw.client.Host)
+		check(gw.client.EnableLivedataStream())
+	}
+	slog.Debug("Livedata", "site", gw.site, "time", live.Meters.LastUpdate, "pv", live.Meters.Sources["pv"].AggPMw/1000,
+		"grid", live.Meters.Sources["grid"].AggPMw/1000, "load", live.Meters.Sources["load"].AggPMw/1000)
+	return live
+}
+
+// livedataPoints are at t, normally the livedata's last update
+func livedataPoints(measurement string, live *envoy.Livedata, t time.Time) []point {
+	points := []point{}
+	for _, name := range envoy.LivedataSources {
+		source, ok := live.Meters.Sources[name]
+		if !ok {
+			continue
+		}
+		fields := map[string]interface{}{
+			"watts":         source.AggPMw / 1000,
+			"apparentPower": source.AggSMva / 1000,
+		}
+		if live.Meters.PhaseCount > 1 {
+			fields["wattsL1"] = source.PhAMw / 1000
+			fields["wattsL2"] = source.PhBMw / 1000
+			if live.Meters.PhaseCount > 2 {
+				fields["wattsL3"] = source.PhCMw / 1000
+			}
+		}
+		if name == "storage" {
+			fields["soc"] = live.Meters.EncAggSoc
+			fields["whNow"] = live.Meters.EncAggEnergy
+		}
+		points = append(points, point{
+			measurement: measurement,
+			tags: map[string]string{
+				"source": name,
+			},
+			fields: fields,
+			time:   t,
+		})
+	}
+	return points
+}
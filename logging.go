@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logOutput is where logs go: stderr, or the event log as a Windows service
+var logOutput io.Writer = os.Stderr
+
+// setupLogging makes the default slog logger write at the given level
+// (debug, info, warn, error) as text or json to logOutput
+func setupLogging(level string, format string) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(strings.ToUpper(level)))
+	check(err)
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(logOutput, opts)
+	case "json":
+		handler = slog.NewJSONHandler(logOutput, opts)
+	default:
+		panic("unknown log format " + format + ", expected text or json")
+	}
+	slog.SetDefault(slog.New(handler))
+}
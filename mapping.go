@@ -0,0 +1,71 @@
+package main
+
+// Schema mapping: renaming fields and tags, picking which fields are
+// written and routing points to other measurements, as set in the config
+// file, so points can match dashboards built for other collectors.
+
+// MappingConfig changes the points in a measurement, or of a type, or
+// every point if neither is given
+type MappingConfig struct {
+	Measurement string            `yaml:"measurement"` // Points in this measurement
+	Type        string            `yaml:"type"`        // Points tagged with this type
+	To          string            `yaml:"to"`          // Measurement to write them to instead
+	Fields      []string          `yaml:"fields"`      // Only write these fields (default all)
+	Rename      map[string]string `yaml:"rename"`      // New names for fields and tags
+}
+
+func (m MappingConfig) matches(p point) bool {
+	return (m.Measurement == "" || m.Measurement == p.measurement) && (m.Type == "" || m.Type == p.tags["type"])
+}
+
+// mapPoints applies every mapping that matches each point as it was made,
+// in order, leaving out points with no fields left
+func (cfg InfluxConfig) mapPoints(points []point) []point {
+	if len(cfg.Mapping) == 0 {
+		return points
+	}
+	mapped := []point{}
+	for _, p := range points {
+		original := point{measurement: p.measurement, tags: map[string]string{"type": p.tags["type"]}}
+		for _, m := range cfg.Mapping {
+			if !m.matches(original) {
+				continue
+			}
+			if m.To != "" {
+				p.measurement = m.To
+			}
+			if len(m.Fields) > 0 {
+				fields := map[string]interface{}{}
+				for _, name := range m.Fields {
+					if value, ok := p.fields[name]; ok {
+						fields[name] = value
+					}
+				}
+				p.fields = fields
+			}
+			if len(m.Rename) > 0 {
+				// Into new maps, so names can be swapped
+				fields, tags := map[string]interface{}{}, map[string]string{}
+				for k, v := range p.fields {
+					fields[m.renamed(k)] = v
+				}
+				for k, v := range p.tags {
+					tags[m.renamed(k)] = v
+				}
+				p.fields, p.tags = fields, tags
+			}
+		}
+		if len(p.fields) > 0 {
+			mapped = append(mapped, p)
+		}
+	}
+	return mapped
+}
+
+// renamed is a field or tag's new name
+func (m MappingConfig) renamed(name string) string {
+	if to, ok := m.Rename[name]; ok {
+		return to
+	}
+	return name
+}
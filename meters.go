@@ -0,0 +1,20 @@
+package main
+
+// Fields for per-phase CT meter readings
+
+import "github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+
+func meterChannelFields(c envoy.MeterChannel) map[string]interface{} {
+	return map[string]interface{}{
+		"watts":          c.ActivePower,
+		"apparentPower":  c.ApparentPower,
+		"reactivePower":  c.ReactivePower,
+		"pwrFactor":      c.PwrFactor,
+		"voltage":        c.Voltage,
+		"current":        c.Current,
+		"freq":           c.Freq,
+		"actEnergyDlvd":  c.ActEnergyDlvd,
+		"actEnergyRcvd":  c.ActEnergyRcvd,
+		"apparentEnergy": c.ApparentEnergy,
+	}
+}
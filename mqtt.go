@@ -0,0 +1,195 @@
+package main
+
+// MQTT output: publishes each reading as JSON, e.g. for home automation
+
+import (
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+type MqttPublisher struct {
+	client mqtt.Client
+	prefix string
+	qos    byte
+
+	// Home Assistant discovery, when haPrefix is set
+	haPrefix   string
+	deviceId   string
+	discovered map[string]bool
+}
+
+func NewMqttPublisher(broker string, clientId string, username string, password string, prefix string, qos int) *MqttPublisher {
+	if clientId == "" {
+		// One of its own, as the broker drops a client when another
+		// connects with its ID: another poller, or this one's new
+		// publisher on reload
+		clientId = fmt.Sprintf("influxEnvoyStats-%08x", rand.Uint32())
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientId).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true)
+	c := mqtt.NewClient(opts)
+	token := c.Connect()
+	if !token.WaitTimeout(time.Second * 10) {
+		slog.Warn("MQTT broker not yet connected, will keep retrying", "broker", broker)
+	}
+	check(token.Error())
+	return &MqttPublisher{client: c, prefix: prefix, qos: byte(qos)}
+}
+
+func (m *MqttPublisher) publish(topic string, v interface{}) {
+	payload, err := json.Marshal(v)
+	check(err)
+	token := m.client.Publish(m.prefix+"/"+topic, m.qos, false, payload)
+	if !token.WaitTimeout(time.Second * 10) {
+		panic("timed out publishing to MQTT topic " + m.prefix + "/" + topic)
+	}
+	check(token.Error())
+}
+
+// EnableHomeAssistantDiscovery publishes retained config topics under
+// haPrefix (normally "homeassistant") for each sensor as it first appears
+func (m *MqttPublisher) EnableHomeAssistantDiscovery(haPrefix string, deviceId string) {
+	m.haPrefix = haPrefix
+	m.deviceId = deviceId
+	m.discovered = map[string]bool{}
+}
+
+type haSensorConfig struct {
+	Name              string   `json:"name"`
+	UniqueId          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	UnitOfMeasurement string   `json:"unit_of_measurement"`
+	DeviceClass       string   `json:"device_class"`
+	StateClass        string   `json:"state_class"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+	ViaDevice    string   `json:"via_device,omitempty"`
+}
+
+func (m *MqttPublisher) discover(objectId string, cfg haSensorConfig) {
+	if m.discovered[objectId] {
+		return
+	}
+	cfg.UniqueId = objectId
+	payload, err := json.Marshal(cfg)
+	check(err)
+	token := m.client.Publish(m.haPrefix+"/sensor/"+objectId+"/config", m.qos, true, payload)
+	if !token.WaitTimeout(time.Second * 10) {
+		panic("timed out publishing Home Assistant discovery for " + objectId)
+	}
+	check(token.Error())
+	m.discovered[objectId] = true
+}
+
+// siteDeviceId identifies the Envoy in discovery config, by site name
+// when polling several
+func (m *MqttPublisher) siteDeviceId(site string) string {
+	if site != "" {
+		return site
+	}
+	return m.deviceId
+}
+
+func (m *MqttPublisher) discoverEim(site string, topic string, measurementType string) {
+	deviceId := m.siteDeviceId(site)
+	device := haDevice{
+		Identifiers:  []string{"envoy_" + deviceId},
+		Name:         "Envoy " + deviceId,
+		Manufacturer: "Enphase",
+	}
+	id := "envoy_" + deviceId + "_" + strings.Replace(measurementType, "-", "_", -1)
+	m.discover(id+"_power", haSensorConfig{
+		Name:              measurementType + " power",
+		StateTopic:        m.prefix + "/" + topic,
+		ValueTemplate:     "{{ value_json.wNow }}",
+		UnitOfMeasurement: "W",
+		DeviceClass:       "power",
+		StateClass:        "measurement",
+		Device:            device,
+	})
+	m.discover(id+"_energy", haSensorConfig{
+		Name:              measurementType + " lifetime energy",
+		StateTopic:        m.prefix + "/" + topic,
+		ValueTemplate:     "{{ value_json.whLifetime }}",
+		UnitOfMeasurement: "Wh",
+		DeviceClass:       "energy",
+		StateClass:        "total_increasing",
+		Device:            device,
+	})
+}
+
+func (m *MqttPublisher) discoverInverter(site string, topic string, serial string) {
+	m.discover("envoy_inverter_"+serial+"_power", haSensorConfig{
+		Name:              "power",
+		StateTopic:        m.prefix + "/" + topic,
+		ValueTemplate:     "{{ value_json.lastReportWatts }}",
+		UnitOfMeasurement: "W",
+		DeviceClass:       "power",
+		StateClass:        "measurement",
+		Device: haDevice{
+			Identifiers:  []string{"envoy_inverter_" + serial},
+			Name:         "Microinverter " + serial,
+			Manufacturer: "Enphase",
+			ViaDevice:    "envoy_" + m.siteDeviceId(site),
+		},
+	})
+}
+
+// Publish sends one message per eim to <prefix>/<measurementType> and
+// one per microinverter to <prefix>/inverters/<serial>.  Readings from a
+// named site go under <prefix>/<site>/ instead.
+func (m *MqttPublisher) Publish(r EnvoyReadings) {
+	base := ""
+	if r.Site != "" {
+		base = r.Site + "/"
+	}
+	for _, reading := range r.eims() {
+		topic := base + reading.MeasurementType
+		if m.haPrefix != "" {
+			m.discoverEim(r.Site, topic, reading.MeasurementType)
+		}
+		m.publish(topic, reading)
+	}
+	for _, inv := range r.Inverters {
+		topic := base + "inverters/" + inv.SerialNumber
+		if m.haPrefix != "" {
+			m.discoverInverter(r.Site, topic, inv.SerialNumber)
+		}
+		m.publish(topic, inv)
+	}
+}
+
+func (m *MqttPublisher) Write(readings []EnvoyReadings) error {
+	return catch(func() {
+		for _, r := range readings {
+			m.Publish(r)
+		}
+	})
+}
+
+// Flush is a no-op as Publish waits for each message to be sent
+func (m *MqttPublisher) Flush() error {
+	return nil
+}
+
+func (m *MqttPublisher) Close() error {
+	m.client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+// NATS output: a JSON message per point, as for -out jsonl, on a subject
+// from a template such as envoy.{site}.{measurement}.{type}.  Placeholders
+// are site, measurement or any tag name; a subject token left empty, e.g.
+// {site} with only one Envoy, is dropped.
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type NatsWriter struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext // When publishing to JetStream streams
+	subject string
+	influx  InfluxConfig // Measurement names and fields to write
+	dedupe  *dedupe
+}
+
+func NewNatsWriter(cfg NatsConfig, influx InfluxConfig) *NatsWriter {
+	conn, err := nats.Connect(cfg.Url,
+		nats.Name("influxEnvoyStats"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true))
+	check(err)
+	w := &NatsWriter{conn: conn, subject: cfg.Subject, influx: influx, dedupe: newDedupe(influx.Duplicates)}
+	if cfg.JetStream {
+		w.js, err = conn.JetStream()
+		check(err)
+	}
+	return w
+}
+
+var subjectPlaceholder = regexp.MustCompile(`\{([^}]*)\}`)
+
+// natsToken makes s safe within one subject token
+var natsToken = strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_").Replace
+
+// subjectFor fills in the subject template for p
+func (w *NatsWriter) subjectFor(p point) string {
+	tokens := []string{}
+	for _, token := range strings.Split(w.subject, ".") {
+		token = subjectPlaceholder.ReplaceAllStringFunc(token, func(placeholder string) string {
+			name := placeholder[1 : len(placeholder)-1]
+			if name == "measurement" {
+				return natsToken(p.measurement)
+			}
+			return natsToken(p.tags[name])
+		})
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+func (w *NatsWriter) Write(readings []EnvoyReadings) error {
+	for _, r := range readings {
+		for _, p := range w.dedupe.filter(readingsToPoints(w.influx, r), r.PollTime) {
+			data, err := json.Marshal(pointObject(p))
+			if err != nil {
+				return err
+			}
+			if w.js != nil {
+				_, err = w.js.Publish(w.subjectFor(p), data)
+			} else {
+				err = w.conn.Publish(w.subjectFor(p), data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush waits for the server to have received everything published
+func (w *NatsWriter) Flush() error {
+	return w.conn.FlushTimeout(time.Second * 10)
+}
+
+func (w *NatsWriter) Close() error {
+	return w.conn.Drain()
+}
@@ -0,0 +1,117 @@
+package main
+
+// Alert notifications by Pushover, Telegram or email
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type PushoverConfig struct {
+	Token string `yaml:"token"` // Application API token
+	User  string `yaml:"user"`  // User or group key
+}
+
+type TelegramConfig struct {
+	Token  string `yaml:"token"` // Bot token
+	ChatId string `yaml:"chatId"`
+}
+
+type SmtpConfig struct {
+	Addr     string `yaml:"addr"` // host:port
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+	To       string `yaml:"to"` // comma separated
+}
+
+// title is a one line summary of the alert
+func (a Alert) title() string {
+	title := "Solar alert: " + a.Name
+	if a.Resolved {
+		title = "Solar alert resolved: " + a.Name
+	}
+	if a.Site != "" {
+		title += " at " + a.Site
+	}
+	return title
+}
+
+// text is the alert's details
+func (a Alert) text() string {
+	text := a.Message
+	if a.Device != "" && !strings.Contains(text, a.Device) {
+		text += " (" + a.Device + ")"
+	}
+	return text + "\n" + a.Time.Format(time.RFC1123)
+}
+
+var notifyClient = &http.Client{Timeout: time.Second * 10}
+
+// postForm posts values to api, failing unless the response is a success.
+// Errors name just the host, as the URL can contain a token.
+func postForm(api string, values url.Values) error {
+	u, err := url.Parse(api)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.PostForm(api, values)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("%s: %w", u.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", u.Host, resp.Status)
+	}
+	return nil
+}
+
+func pushoverNotifier(cfg PushoverConfig) notifier {
+	return func(alert Alert) error {
+		return postForm("https://api.pushover.net/1/messages.json", url.Values{
+			"token":   {cfg.Token},
+			"user":    {cfg.User},
+			"title":   {alert.title()},
+			"message": {alert.text()},
+		})
+	}
+}
+
+func telegramNotifier(cfg TelegramConfig) notifier {
+	return func(alert Alert) error {
+		return postForm("https://api.telegram.org/bot"+cfg.Token+"/sendMessage", url.Values{
+			"chat_id": {cfg.ChatId},
+			"text":    {alert.title() + "\n" + alert.text()},
+		})
+	}
+}
+
+func smtpNotifier(cfg SmtpConfig) notifier {
+	to := []string{}
+	for _, addr := range strings.Split(cfg.To, ",") {
+		to = append(to, strings.TrimSpace(addr))
+	}
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host, _, _ := strings.Cut(cfg.Addr, ":")
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	return func(alert Alert) error {
+		msg := "From: " + cfg.From + "\r\n" +
+			"To: " + strings.Join(to, ", ") + "\r\n" +
+			"Subject: " + alert.title() + "\r\n" +
+			"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"\r\n" + strings.ReplaceAll(alert.text(), "\n", "\r\n") + "\r\n"
+		return smtp.SendMail(cfg.Addr, auth, cfg.From, to, []byte(msg))
+	}
+}
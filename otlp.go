@@ -0,0 +1,159 @@
+package main
+
+// OpenTelemetry output: readings and the poller's own metrics sent as OTLP
+// metrics over HTTP, to a collector or straight to a backend that takes
+// OTLP, such as Grafana Cloud, Datadog or New Relic.  Each numeric field of
+// a point is a gauge named from the prefix, measurement and field, e.g.
+// envoy.readings.watts, with the point's tags as attributes.
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type OtlpWriter struct {
+	prefix string
+	influx InfluxConfig // Measurement names and fields to write
+
+	exporter *otlpmetrichttp.Exporter
+	reader   *sdkmetric.ManualReader
+	meter    metric.Meter
+	gauges   map[string]metric.Float64Gauge // By name
+}
+
+func NewOtlpWriter(cfg OtlpConfig, influx InfluxConfig) *OtlpWriter {
+	headers := map[string]string{}
+	for _, h := range cfg.Headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			panic("OTLP header " + h + " should be Name: value")
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	// Settings not given here, such as certificates, can come from the
+	// standard OTEL_EXPORTER_OTLP_* variables
+	exporter, err := otlpmetrichttp.New(context.Background(),
+		otlpmetrichttp.WithEndpointURL(otlpMetricsURL(cfg.Endpoint)),
+		otlpmetrichttp.WithHeaders(headers),
+		otlpmetrichttp.WithTimeout(time.Second*30))
+	check(err)
+	// Collected and sent on each write rather than periodically
+	reader := sdkmetric.NewManualReader(
+		sdkmetric.WithTemporalitySelector(exporter.Temporality),
+		sdkmetric.WithAggregationSelector(exporter.Aggregation))
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(resource.NewSchemaless(attribute.String("service.name", "influxEnvoyStats"))))
+	w := &OtlpWriter{
+		prefix:   cfg.Prefix,
+		influx:   influx,
+		exporter: exporter,
+		reader:   reader,
+		meter:    provider.Meter("influxEnvoyStats"),
+		gauges:   map[string]metric.Float64Gauge{},
+	}
+	w.registerSelfStats()
+	return w
+}
+
+// otlpMetricsURL is endpoint, with the standard /v1/metrics path if it has
+// none, as the exporter would otherwise post to /
+func otlpMetricsURL(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	check(err)
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/metrics"
+	}
+	return u.String()
+}
+
+// The poller's own health, from selfStats, as for Prometheus
+func (w *OtlpWriter) registerSelfStats() {
+	counter := func(name string, description string, value func() int64) {
+		_, err := w.meter.Int64ObservableCounter(w.prefix+"."+name, metric.WithDescription(description),
+			metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+				o.Observe(value())
+				return nil
+			}))
+		check(err)
+	}
+	counter("polls", "Poll cycles run", stats.polls.Load)
+	counter("poll.errors", "Failed Envoy poll attempts, including those later retried", stats.pollErrors.Load)
+	counter("influx.write.errors", "Failed InfluxDB writes", stats.writeErrors.Load)
+	counter("influx.points.written", "Points written to InfluxDB", stats.pointsWritten.Load)
+	_, err := w.meter.Float64ObservableGauge(w.prefix+".poll.duration", metric.WithDescription("Time taken by the latest poll cycle"), metric.WithUnit("s"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			o.Observe(time.Duration(stats.pollDuration.Load()).Seconds())
+			return nil
+		}))
+	check(err)
+}
+
+// gauge is the gauge for a measurement's field, made the first time
+func (w *OtlpWriter) gauge(measurement string, field string) (metric.Float64Gauge, error) {
+	name := w.prefix + "." + measurement + "." + field
+	if g, ok := w.gauges[name]; ok {
+		return g, nil
+	}
+	g, err := w.meter.Float64Gauge(name)
+	if err != nil {
+		return nil, err
+	}
+	w.gauges[name] = g
+	return g, nil
+}
+
+func (w *OtlpWriter) Write(readings []EnvoyReadings) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	for _, r := range readings {
+		for _, p := range readingsToPoints(w.influx, r) {
+			attrs := []attribute.KeyValue{}
+			for k, v := range p.tags {
+				attrs = append(attrs, attribute.String(k, v))
+			}
+			set := metric.WithAttributeSet(attribute.NewSet(attrs...))
+			for field, value := range p.fields {
+				var f float64
+				switch v := value.(type) {
+				case float64:
+					f = v
+				case int:
+					f = float64(v)
+				case int64:
+					f = float64(v)
+				default:
+					continue
+				}
+				g, err := w.gauge(p.measurement, field)
+				if err != nil {
+					return err
+				}
+				g.Record(ctx, f, set)
+			}
+		}
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := w.reader.Collect(ctx, &rm); err != nil {
+		return err
+	}
+	return w.exporter.Export(ctx, &rm)
+}
+
+// Flush is a no-op as each Write sends its metrics
+func (w *OtlpWriter) Flush() error {
+	return nil
+}
+
+func (w *OtlpWriter) Close() error {
+	return w.exporter.Shutdown(context.Background())
+}
@@ -0,0 +1,86 @@
+package main
+
+// Panel mapping: what each microinverter's panel is called and where it
+// is, from the config file, added as tags to its points so dashboards can
+// group by roof face or string rather than by serial number, and the
+// arrays' production summed up (-marray).
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"sort"
+	"time"
+)
+
+// PanelConfig describes the panel on one microinverter
+type PanelConfig struct {
+	Name    string `yaml:"name"`    // e.g. "east-3"
+	Array   string `yaml:"array"`   // Roof face or string, e.g. "east"
+	Azimuth string `yaml:"azimuth"` // Degrees clockwise from north
+	Tilt    string `yaml:"tilt"`    // Degrees from horizontal
+}
+
+// tags is the panel's tags, leaving out those not given
+func (p PanelConfig) tags() map[string]string {
+	tags := map[string]string{}
+	for k, v := range map[string]string{"panel": p.Name, "array": p.Array, "azimuth": p.Azimuth, "tilt": p.Tilt} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// addPanelTags tags the points of each microinverter in panels, i.e.
+// those with its serial, with its panel's details
+func (cfg InfluxConfig) addPanelTags(points []point) {
+	if len(cfg.Panels) == 0 {
+		return
+	}
+	for _, p := range points {
+		panel, ok := cfg.Panels[p.tags["serial"]]
+		if !ok {
+			continue
+		}
+		for k, v := range panel.tags() {
+			p.tags[k] = v
+		}
+	}
+}
+
+// arrayPoints sums up the microinverters' last reports by the array their
+// panel is in, as a point per array at the poll time, to compare roof
+// faces.  wattsPerPanel evens out arrays of different sizes.
+func arrayPoints(measurement string, panels map[string]PanelConfig, inverters []envoy.Inverter, pollTime time.Time) []point {
+	watts, maxWatts, count := map[string]float64{}, map[string]float64{}, map[string]int{}
+	for _, inv := range inverters {
+		array := panels[inv.SerialNumber].Array
+		if array == "" {
+			continue
+		}
+		watts[array] += inv.LastReportWatts
+		maxWatts[array] += inv.MaxReportWatts
+		count[array]++
+	}
+	arrays := []string{}
+	for array := range count {
+		arrays = append(arrays, array)
+	}
+	sort.Strings(arrays)
+	points := []point{}
+	for _, array := range arrays {
+		points = append(points, point{
+			measurement: measurement,
+			tags: map[string]string{
+				"array": array,
+			},
+			fields: map[string]interface{}{
+				"watts":         watts[array],
+				"maxWatts":      maxWatts[array],
+				"wattsPerPanel": watts[array] / float64(count[array]),
+				"inverters":     count[array],
+			},
+			time: pollTime,
+		})
+	}
+	return points
+}
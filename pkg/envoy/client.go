@@ -0,0 +1,280 @@
+package envoy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrTokenRequired is returned for 401 responses to requests without a token
+var ErrTokenRequired = errors.New("firmware 7.x needs a token")
+
+// ErrUnauthorized is returned when the token or login given is rejected
+var ErrUnauthorized = errors.New("not authorised")
+
+// ErrNotFound is returned for 404 responses, e.g. from endpoints the
+// firmware doesn't have
+var ErrNotFound = errors.New("not found")
+
+// Client is the connection details for talking to the local gateway
+type Client struct {
+	Host   string
+	Token  string       // JWT required by firmware 7.x, empty for older firmware
+	Tokens *TokenSource // Alternatively obtain and refresh the JWT via Enlighten
+
+	// DigestUser and DigestPassword answer digest authentication, which
+	// older firmware asks for on protected pages
+	DigestUser     string
+	DigestPassword string
+
+	// Record, if set, is given the body of each successful GET, e.g. to
+	// save it for debugging
+	Record func(path string, body []byte)
+	// Respond, if set, answers GETs instead of the Envoy, e.g. replaying
+	// recorded responses.  Other requests are then not sent.
+	Respond func(path string) ([]byte, error)
+	// Timeout, if set, replaces the time each request is given, which
+	// depends on how slow the endpoint usually is
+	Timeout time.Duration
+	// Limiter, if set, spaces out requests, waiting before each for its
+	// turn without that counting against its timeout
+	Limiter *RateLimiter
+	// Firmware, if set, is what Detect found, for reading the endpoints the
+	// firmware has
+	Firmware *Firmware
+
+	transport http.RoundTripper
+}
+
+func NewClient(host string, token string) *Client {
+	return &Client{
+		Host:  host,
+		Token: token,
+		// Firmware 7.x only serves HTTPS, with a self-signed certificate
+		transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+// SetKeepAlive sets how long connections are kept open between requests
+// (0 to close them after each) and how many at most
+func (c *Client) SetKeepAlive(idle time.Duration, maxIdle int) {
+	t, ok := c.transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	t.DisableKeepAlives = idle == 0
+	t.IdleConnTimeout = idle
+	t.MaxIdleConns = maxIdle
+	t.MaxIdleConnsPerHost = maxIdle
+}
+
+// SetProxy sends requests through proxy, as http.Transport's Proxy, nil
+// for none
+func (c *Client) SetProxy(proxy func(*http.Request) (*url.URL, error)) {
+	if t, ok := c.transport.(*http.Transport); ok {
+		t.Proxy = proxy
+	}
+}
+
+// UsesToken is whether requests are authenticated, over HTTPS
+func (c *Client) UsesToken() bool {
+	return c.Token != "" || c.Tokens != nil
+}
+
+func (c *Client) token() (string, error) {
+	if c.Tokens != nil {
+		return c.Tokens.Token()
+	}
+	return c.Token, nil
+}
+
+func (c *Client) url(path string) string {
+	if c.UsesToken() {
+		return "https://" + c.Host + path
+	}
+	return "http://" + c.Host + path
+}
+
+// Get fetches the given Envoy API path and returns the raw body
+func (c *Client) Get(path string, timeout time.Duration) ([]byte, error) {
+	return c.request(http.MethodGet, path, nil, timeout)
+}
+
+// Put sends body as JSON to the given Envoy API path and returns the response
+func (c *Client) Put(path string, body []byte, timeout time.Duration) ([]byte, error) {
+	return c.request(http.MethodPut, path, body, timeout)
+}
+
+// getJSON fetches path and decodes it into v
+func (c *Client) getJSON(path string, timeout time.Duration, v interface{}) error {
+	data, err := c.Get(path, timeout)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Client) request(method string, path string, body []byte, timeout time.Duration) ([]byte, error) {
+	if c.Respond != nil {
+		if method != http.MethodGet {
+			return nil, nil
+		}
+		return c.Respond(path)
+	}
+	if c.Timeout > 0 {
+		timeout = c.Timeout
+	}
+	c.wait()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		if !c.UsesToken() && c.DigestUser == "" {
+			return nil, fmt.Errorf("%s returned %s - %w", path, resp.Status, ErrTokenRequired)
+		}
+		if c.Tokens != nil {
+			// Revoked or otherwise rejected - get a new one next time
+			c.Tokens.Invalidate()
+		}
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%s returned %s - %w", path, resp.Status, ErrUnauthorized)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s returned %s - %w", path, resp.Status, ErrNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err == nil && method == http.MethodGet && c.Record != nil {
+		c.Record(path, data)
+	}
+	return data, err
+}
+
+// do sends a request with the token if there is one, answering a digest
+// authentication challenge if there are credentials for it
+func (c *Client) do(ctx context.Context, method string, path string, body []byte) (*http.Response, error) {
+	newRequest := func() (*http.Request, error) {
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, c.url(path), bodyReader)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.UsesToken() {
+			token, err := c.token()
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req, nil
+	}
+	httpClient := &http.Client{Transport: c.transport}
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	c.done(resp, err)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.DigestUser == "" {
+		return resp, err
+	}
+	auth, ok := c.digestAuthorization(req, resp)
+	if !ok {
+		return resp, nil
+	}
+	resp.Body.Close()
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", auth)
+	c.wait()
+	resp, err = httpClient.Do(req)
+	c.done(resp, err)
+	return resp, err
+}
+
+// wait waits for the Limiter, if any, to allow a request
+func (c *Client) wait() {
+	if c.Limiter != nil {
+		c.Limiter.Wait()
+	}
+}
+
+// done tells the Limiter, if any, whether a response showed the gateway
+// struggling: no answer in time, or a server error
+func (c *Client) done(resp *http.Response, err error) {
+	if c.Limiter != nil {
+		c.Limiter.done(err != nil || resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests)
+	}
+}
+
+// Info is the gateway's identity from /info.xml
+type Info struct {
+	Device struct {
+		Sn       string `xml:"sn"`
+		Pn       string `xml:"pn"`       // Part number
+		Software string `xml:"software"` // Firmware version, e.g. D7.6.175
+		Imeter   *bool  `xml:"imeter"`   // Whether it's a metered model, missing on some firmware
+	} `xml:"device"`
+}
+
+// GetInfo reads the unauthenticated /info.xml
+func (c *Client) GetInfo() (*Info, error) {
+	httpClient := &http.Client{Transport: c.transport, Timeout: time.Second * 5}
+	if c.Timeout > 0 {
+		httpClient.Timeout = c.Timeout
+	}
+	// info.xml is served over plain HTTP on all firmware versions
+	c.wait()
+	resp, err := httpClient.Get("http://" + c.Host + "/info.xml")
+	c.done(resp, err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("/info.xml returned %s", resp.Status)
+	}
+	info := &Info{}
+	if err := xml.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// GetSerial reads the gateway serial number from /info.xml
+func (c *Client) GetSerial() (string, error) {
+	info, err := c.GetInfo()
+	if err != nil {
+		return "", err
+	}
+	return info.Device.Sn, nil
+}
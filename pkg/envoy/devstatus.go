@@ -0,0 +1,87 @@
+package envoy
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// DeviceStatus is a microinverter's latest electrical readings from
+// /ivp/peb/devstatus, in volts, amps and watts.  Fields the firmware
+// doesn't report are zero.
+type DeviceStatus struct {
+	SerialNumber  string
+	ReportDate    int64
+	Communicating bool
+	Recent        bool // Reported in the last few intervals
+	Producing     bool
+	Temperature   float64 // °C
+	DCVoltage     float64
+	DCCurrent     float64
+	ACVoltage     float64
+	ACPower       float64
+}
+
+// devstatusTable is a device type's table in /ivp/peb/devstatus: the
+// field names, then a row of values per device
+type devstatusTable struct {
+	Fields []string            `json:"fields"`
+	Values [][]json.RawMessage `json:"values"`
+}
+
+// GetDeviceStatus reads the microinverters' status from
+// /ivp/peb/devstatus, which needs an installer login
+func (c *Client) GetDeviceStatus() ([]DeviceStatus, error) {
+	tables := map[string]devstatusTable{}
+	if err := c.getJSON("/ivp/peb/devstatus", time.Second*10, &tables); err != nil {
+		return nil, err
+	}
+	pcu := tables["pcu"]
+	devices := []DeviceStatus{}
+	for _, row := range pcu.Values {
+		d := DeviceStatus{}
+		for i, name := range pcu.Fields {
+			if i >= len(row) {
+				break
+			}
+			value := row[i]
+			number := func(scale float64) float64 {
+				var f float64
+				json.Unmarshal(value, &f)
+				return f * scale
+			}
+			flag := func() bool {
+				var b bool
+				json.Unmarshal(value, &b)
+				return b
+			}
+			switch name {
+			case "serialNumber":
+				// A number on some firmware
+				d.SerialNumber = strings.Trim(string(value), `"`)
+			case "reportDate":
+				d.ReportDate = int64(number(1))
+			case "communicating":
+				d.Communicating = flag()
+			case "recent":
+				d.Recent = flag()
+			case "producing":
+				d.Producing = flag()
+			case "temperature":
+				d.Temperature = number(1)
+			case "dcVoltageINmV":
+				d.DCVoltage = number(0.001)
+			case "dcCurrentINmA":
+				d.DCCurrent = number(0.001)
+			case "acVoltageINmV":
+				d.ACVoltage = number(0.001)
+			case "acPowerINmW":
+				d.ACPower = number(0.001)
+			}
+		}
+		if d.SerialNumber != "" {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
@@ -0,0 +1,115 @@
+package envoy
+
+// HTTP digest authentication, which firmware before 7.x uses for its
+// installer and other protected pages, e.g. /stream/meter
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// digestRealm is the realm of the installer password
+const digestRealm = "enphaseenergy.com"
+
+// DefaultPassword is the password firmware before 7.x gives its built in
+// users: the last 6 digits of the serial for envoy, and for installer one
+// derived from the serial, as Enphase's Installer Toolkit app does
+func DefaultPassword(username string, serial string) string {
+	switch username {
+	case "envoy":
+		if len(serial) < 6 {
+			return serial
+		}
+		return serial[len(serial)-6:]
+	case "installer":
+		return installerPassword(serial)
+	}
+	return ""
+}
+
+func installerPassword(serial string) string {
+	sum := md5.Sum([]byte("[e]installer@" + digestRealm + "#" + serial + " EnPhAsE eNeRgY "))
+	hash := hex.EncodeToString(sum[:])
+	zeros := strings.Count(hash, "0")
+	ones := strings.Count(hash, "1")
+	password := []byte{}
+	for i := len(hash) - 1; i >= len(hash)-8; i-- {
+		if zeros == 3 || zeros == 6 || zeros == 9 {
+			zeros--
+		}
+		if zeros > 20 {
+			zeros = 20
+		} else if zeros < 0 {
+			zeros = 0
+		}
+		if ones == 9 || ones == 15 {
+			ones--
+		}
+		if ones > 26 {
+			ones = 26
+		} else if ones < 0 {
+			ones = 0
+		}
+		switch c := hash[i]; c {
+		case '0':
+			password = append(password, byte('f'+zeros))
+			zeros--
+		case '1':
+			password = append(password, byte('@'+ones))
+			ones--
+		default:
+			password = append(password, c)
+		}
+	}
+	return string(password)
+}
+
+// digestChallenge parses a WWW-Authenticate: Digest header
+func digestChallenge(header string) (map[string]string, bool) {
+	rest, ok := strings.CutPrefix(header, "Digest ")
+	if !ok {
+		return nil, false
+	}
+	params := map[string]string{}
+	for _, part := range strings.Split(rest, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[strings.ToLower(key)] = strings.Trim(value, `"`)
+		}
+	}
+	return params, params["nonce"] != ""
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// digestAuthorization answers the challenge in resp for req
+func (c *Client) digestAuthorization(req *http.Request, resp *http.Response) (string, bool) {
+	challenge, ok := digestChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok {
+		return "", false
+	}
+	uri := req.URL.RequestURI()
+	ha1 := md5Hex(c.DigestUser + ":" + challenge["realm"] + ":" + c.DigestPassword)
+	ha2 := md5Hex(req.Method + ":" + uri)
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, c.DigestUser, challenge["realm"], challenge["nonce"], uri)
+	if strings.Contains(challenge["qop"], "auth") {
+		cnonceBytes := make([]byte, 8)
+		rand.Read(cnonceBytes)
+		cnonce := hex.EncodeToString(cnonceBytes)
+		response := md5Hex(ha1 + ":" + challenge["nonce"] + ":00000001:" + cnonce + ":auth:" + ha2)
+		auth += fmt.Sprintf(`, qop=auth, nc=00000001, cnonce="%s", response="%s"`, cnonce, response)
+	} else {
+		auth += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+challenge["nonce"]+":"+ha2))
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		auth += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return auth, true
+}
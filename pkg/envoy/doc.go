@@ -0,0 +1,9 @@
+// Package envoy reads production, consumption, battery, microinverter and
+// meter data from an Enphase Envoy (IQ Gateway) via its local API.
+//
+//	client := envoy.NewClient("envoy.local", token)
+//	production, err := client.GetProduction()
+//
+// Firmware 7.x needs a token: give one to NewClient, or set Client.Tokens
+// to obtain and refresh one via Enlighten credentials.
+package envoy
@@ -0,0 +1,25 @@
+package envoy
+
+import "time"
+
+// EnergyCounter is one meter's energy totals and power in /ivp/pdm/energy
+type EnergyCounter struct {
+	WattHoursToday     float64 `json:"wattHoursToday"`
+	WattHoursSevenDays float64 `json:"wattHoursSevenDays"`
+	WattHoursLifetime  float64 `json:"wattHoursLifetime"`
+	WattsNow           float64 `json:"wattsNow"`
+}
+
+// Energy is the Envoy's own energy counters from /ivp/pdm/energy
+// (firmware 7.x), keyed by what measures it: pcu (the microinverters), rgm
+// (revenue grade meter) and eim (CTs).  Meters not fitted are nil.
+type Energy struct {
+	Production  map[string]*EnergyCounter `json:"production"`
+	Consumption map[string]*EnergyCounter `json:"consumption"`
+}
+
+func (c *Client) GetEnergy() (*Energy, error) {
+	energy := &Energy{}
+	err := c.getJSON("/ivp/pdm/energy", time.Second*5, energy)
+	return energy, err
+}
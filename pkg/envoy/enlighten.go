@@ -0,0 +1,208 @@
+package envoy
+
+// Obtain an Envoy access token via Enlighten credentials, as required
+// by firmware 7.x (IQ Gateway).  Same flow as the "Get token" web page:
+//  1. log in to Enlighten to get a session id
+//  2. exchange the session id for a JWT for the given gateway serial
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	enlightenLoginUrl = "https://enlighten.enphaseenergy.com/login/login.json?"
+	entrezTokenUrl    = "https://entrez.enphaseenergy.com/tokens"
+)
+
+// GetEnlightenToken requests a new token for the gateway with the given serial
+func GetEnlightenToken(username string, password string, serial string) (string, error) {
+	httpClient := &http.Client{Timeout: time.Second * 30}
+
+	resp, err := httpClient.PostForm(enlightenLoginUrl, url.Values{
+		"user[email]":    {username},
+		"user[password]": {password},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Enlighten login returned %s", resp.Status)
+	}
+	var login struct {
+		Message   string
+		SessionId string `json:"session_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		return "", err
+	}
+	if login.SessionId == "" {
+		return "", fmt.Errorf("Enlighten login failed: %s - %w", login.Message, ErrUnauthorized)
+	}
+
+	reqBody, err := json.Marshal(map[string]string{
+		"session_id": login.SessionId,
+		"serial_num": serial,
+		"username":   username,
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err = httpClient.Post(entrezTokenUrl, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	token, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Token request returned %s", resp.Status)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// Refresh tokens this long before they expire
+const tokenRefreshMargin = 7 * 24 * time.Hour
+
+// TokenSource hands out a valid Envoy token, requesting a new one from
+// Enlighten when the current one nears expiry.  Tokens are cached on disk
+// so restarts don't need a fresh login.
+type TokenSource struct {
+	username  string
+	password  string
+	serial    string
+	cacheFile string
+
+	// Held while checking or getting a token, so polls at once share one
+	// login rather than each logging in
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewTokenSource gets tokens for the given gateway serial, cached in
+// cacheFile unless that's empty
+func NewTokenSource(username string, password string, serial string, cacheFile string) *TokenSource {
+	t := &TokenSource{
+		username:  username,
+		password:  password,
+		serial:    serial,
+		cacheFile: cacheFile,
+	}
+	if cacheFile != "" {
+		if cached, err := ioutil.ReadFile(cacheFile); err == nil {
+			t.set(strings.TrimSpace(string(cached)))
+		}
+	}
+	return t
+}
+
+func (t *TokenSource) set(token string) {
+	t.token = token
+	t.expiry = tokenExpiry(token)
+}
+
+// Token returns a token valid for at least tokenRefreshMargin
+func (t *TokenSource) Token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.valid()
+}
+
+// valid is Token with mu held
+func (t *TokenSource) valid() (string, error) {
+	if t.token == "" || time.Now().Add(tokenRefreshMargin).After(t.expiry) {
+		token, err := GetEnlightenToken(t.username, t.password, t.serial)
+		if err != nil {
+			return "", err
+		}
+		t.set(token)
+		if t.cacheFile != "" {
+			if err := os.MkdirAll(filepath.Dir(t.cacheFile), 0700); err != nil {
+				return "", err
+			}
+			if err := ioutil.WriteFile(t.cacheFile, []byte(t.token), 0600); err != nil {
+				return "", err
+			}
+		}
+		slog.Info("Obtained Envoy token", "serial", t.serial, "expires", t.expiry)
+	}
+	return t.token, nil
+}
+
+// Invalidate forces a new token on the next call, e.g. after a 401
+func (t *TokenSource) Invalidate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.token = ""
+}
+
+// Refresh forces a new token from Enlighten, even if the one held is still
+// valid, e.g. to replace a revoked one
+func (t *TokenSource) Refresh() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.token = ""
+	return t.valid()
+}
+
+// TokenInfo is what an Envoy token says about itself
+type TokenInfo struct {
+	Serial   string // Of the gateway it's for
+	Role     string // The Enlighten account's: owner or installer
+	Username string
+	Issued   time.Time
+	Expiry   time.Time
+}
+
+// ParseToken reads the claims in an Envoy token, without verifying it
+func ParseToken(token string) (TokenInfo, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return TokenInfo{}, fmt.Errorf("not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return TokenInfo{}, err
+	}
+	var claims struct {
+		Aud         string
+		EnphaseUser string
+		Username    string
+		Iat         int64
+		Exp         int64
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return TokenInfo{}, err
+	}
+	return TokenInfo{
+		Serial:   claims.Aud,
+		Role:     claims.EnphaseUser,
+		Username: claims.Username,
+		Issued:   time.Unix(claims.Iat, 0),
+		Expiry:   time.Unix(claims.Exp, 0),
+	}, nil
+}
+
+// tokenExpiry reads the exp claim from the JWT, without verifying it
+func tokenExpiry(token string) time.Time {
+	info, err := ParseToken(token)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.Expiry
+}
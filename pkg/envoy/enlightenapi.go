@@ -0,0 +1,105 @@
+package envoy
+
+// The Enlighten v4 cloud API (https://developer-v4.enphase.com), for the
+// history Enlighten holds from before local monitoring started.  It needs
+// an API key from an Enphase developer account and an OAuth access token
+// authorised by the system's owner.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const enlightenApiUrl = "https://api.enphaseenergy.com/api/v4"
+
+// EnlightenAPI requests one system's data from the Enlighten v4 API
+type EnlightenAPI struct {
+	Url         string // Default the Enphase API
+	Key         string
+	AccessToken string
+	SystemId    string
+
+	http *http.Client
+}
+
+func NewEnlightenAPI(key string, accessToken string, systemId string) *EnlightenAPI {
+	return &EnlightenAPI{
+		Url:         enlightenApiUrl,
+		Key:         key,
+		AccessToken: accessToken,
+		SystemId:    systemId,
+		http:        &http.Client{Timeout: time.Second * 30},
+	}
+}
+
+// Interval is the microinverters' production over an interval (5 minutes)
+type Interval struct {
+	EndAt            int64   `json:"end_at"`
+	DevicesReporting int     `json:"devices_reporting"`
+	Powr             float64 // Average watts
+	Enwh             float64 // Wh produced
+}
+
+// RateLimitError is a 429 response: the API plans allow a few requests a
+// minute and a limited number a month
+type RateLimitError struct {
+	Period string    // minute or month
+	Until  time.Time // End of the period
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("Enlighten API limit per %s reached until %s", e.Period, e.Until.Format(time.RFC3339))
+}
+
+// GetProductionMicro reads the production intervals of the day starting
+// at start (/telemetry/production_micro)
+func (c *EnlightenAPI) GetProductionMicro(start time.Time) ([]Interval, error) {
+	query := url.Values{
+		"key":         {c.Key},
+		"start_at":    {fmt.Sprint(start.Unix())},
+		"granularity": {"day"},
+	}
+	req, err := http.NewRequest("GET", c.Url+"/systems/"+url.PathEscape(c.SystemId)+"/telemetry/production_micro?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.AccessToken)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err // Without the URL, which has the API key in it
+		}
+		return nil, fmt.Errorf("Enlighten API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		var limit struct {
+			Period    string
+			PeriodEnd int64 `json:"period_end"`
+		}
+		json.NewDecoder(resp.Body).Decode(&limit)
+		e := &RateLimitError{Period: limit.Period, Until: time.Unix(limit.PeriodEnd, 0)}
+		if limit.PeriodEnd == 0 {
+			e.Period, e.Until = "minute", time.Now().Add(time.Minute)
+		}
+		return nil, e
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Message string
+			Details string
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return nil, fmt.Errorf("Enlighten API returned %s: %s %s", resp.Status, apiErr.Message, apiErr.Details)
+	}
+	var telemetry struct {
+		Intervals []Interval
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&telemetry); err != nil {
+		return nil, err
+	}
+	return telemetry.Intervals, nil
+}
@@ -0,0 +1,91 @@
+package envoy
+
+// Ensemble (battery and backup) devices: Encharge batteries and the
+// Enpower smart switch, from /ivp/ensemble/inventory and /ivp/ensemble/power
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EnsembleDevice is an Encharge or Enpower from /ivp/ensemble/inventory,
+// with the fields of both
+type EnsembleDevice struct {
+	SerialNum     string  `json:"serial_num"`
+	LastRptDate   int64   `json:"last_rpt_date"`
+	Communicating bool    `json:"communicating"`
+	Operating     bool    `json:"operating"`
+	Temperature   float64 `json:"temperature"`
+
+	// Encharge
+	PercentFull      float64 `json:"percentFull"`
+	EnchargeCapacity float64 `json:"encharge_capacity"` // Wh
+	LedStatus        int     `json:"led_status"`
+
+	// Enpower
+	MainsAdminState string `json:"mains_admin_state"` // closed when connected to the grid
+	MainsOperState  string `json:"mains_oper_state"`
+	EnpwrGridMode   string `json:"Enpwr_grid_mode"` // e.g. multimode-ongrid
+	EnchgGridMode   string `json:"Enchg_grid_mode"`
+}
+
+// EnsembleInventory is one type of device, ENCHARGE or ENPOWER
+type EnsembleInventory struct {
+	Type    string           `json:"type"`
+	Devices []EnsembleDevice `json:"devices"`
+}
+
+// GetEnsembleInventory lists the Encharge and Enpower devices, empty for
+// a system without any
+func (c *Client) GetEnsembleInventory() ([]EnsembleInventory, error) {
+	inventory := []EnsembleInventory{}
+	err := c.getJSON("/ivp/ensemble/inventory", time.Second*5, &inventory)
+	return inventory, err
+}
+
+// EnsemblePower is an Encharge's power from /ivp/ensemble/power
+type EnsemblePower struct {
+	SerialNum        string  `json:"serial_num"`
+	RealPowerMw      float64 `json:"real_power_mw"` // positive discharging
+	ApparentPowerMva float64 `json:"apparent_power_mva"`
+	Soc              float64 `json:"soc"`
+}
+
+// GetEnsemblePower reads each Encharge's charge/discharge power
+func (c *Client) GetEnsemblePower() ([]EnsemblePower, error) {
+	data, err := c.Get("/ivp/ensemble/power", time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	// Firmware spells the key "devices:", but allow for that being fixed
+	var power map[string][]EnsemblePower
+	if err := json.Unmarshal(data, &power); err != nil {
+		return nil, fmt.Errorf("ensemble power: %w", err)
+	}
+	if devices, ok := power["devices:"]; ok {
+		return devices, nil
+	}
+	return power["devices"], nil
+}
+
+// Relay is the Enpower's grid relay from /ivp/ensemble/relay
+type Relay struct {
+	MainsAdminState string `json:"mains_admin_state"` // closed when commanded on-grid
+	MainsOperState  string `json:"mains_oper_state"`  // closed when actually connected
+	Der1State       int    `json:"der1_state"`
+	Der2State       int    `json:"der2_state"`
+	Der3State       int    `json:"der3_state"`
+}
+
+// OnGrid is whether the system is connected to the grid
+func (r *Relay) OnGrid() bool {
+	return r.MainsOperState == "closed"
+}
+
+// GetRelay reads the grid relay state, for systems with an Enpower
+func (c *Client) GetRelay() (*Relay, error) {
+	relay := &Relay{}
+	err := c.getJSON("/ivp/ensemble/relay", time.Second*5, relay)
+	return relay, err
+}
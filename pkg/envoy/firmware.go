@@ -0,0 +1,90 @@
+package envoy
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Firmware is which API a gateway's firmware has, found by Detect
+type Firmware struct {
+	Info  Info
+	Major int // Of the version, e.g. 7 for D7.6.175, or 0 if not understood
+
+	// Tokens is whether it needs a token, over HTTPS, as from firmware 7.x
+	Tokens bool
+	// ProductionJSON is whether it has /production.json; the earliest
+	// firmware has only the totals in /api/v1/production
+	ProductionJSON bool
+}
+
+// Detect probes the gateway for its firmware: info.xml for the version,
+// then production.json without a token to see whether one is needed, and
+// if that isn't there, /api/v1/production
+func (c *Client) Detect() (*Firmware, error) {
+	info, err := c.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	fw := &Firmware{Info: *info, Major: majorVersion(info.Device.Software)}
+
+	// Without any credentials, as firmware 7.x refuses requests without a
+	// token whatever else is given
+	probe := &Client{Host: c.Host, Timeout: c.Timeout, Limiter: c.Limiter, transport: c.transport}
+	_, err = probe.Get("/production.json", time.Second*5)
+	switch {
+	case err == nil:
+		fw.ProductionJSON = true
+	case errors.Is(err, ErrTokenRequired):
+		fw.ProductionJSON = true
+		fw.Tokens = true
+	case errors.Is(err, ErrNotFound):
+		if _, err := probe.Get("/api/v1/production", time.Second*5); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	fw.Tokens = fw.Tokens || fw.Major >= 7
+	return fw, nil
+}
+
+// majorVersion is the first number in a firmware version such as D7.6.175
+// or R4.10.35, 0 if there isn't one
+func majorVersion(software string) int {
+	v := strings.TrimLeft(software, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
+	if i := strings.Index(v, "."); i >= 0 {
+		v = v[:i]
+	}
+	major, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return major
+}
+
+// getLegacyProduction reads /api/v1/production, all the earliest firmware
+// has: production totals, without meter readings, consumption or storage
+func (c *Client) getLegacyProduction() (*Production, error) {
+	var totals struct {
+		WattHoursToday     float64 `json:"wattHoursToday"`
+		WattHoursSevenDays float64 `json:"wattHoursSevenDays"`
+		WattHoursLifetime  float64 `json:"wattHoursLifetime"`
+		WattsNow           float64 `json:"wattsNow"`
+	}
+	if err := c.getJSON("/api/v1/production", time.Second*2, &totals); err != nil {
+		return nil, err
+	}
+	return &Production{
+		Production: Eim{
+			MeasurementType: "production",
+			ReadingTime:     time.Now().Unix(), // It has no time of its own
+			WNow:            totals.WattsNow,
+			WhLifetime:      totals.WattHoursLifetime,
+			WhToday:         totals.WattHoursToday,
+			WhLastSevenDays: totals.WattHoursSevenDays,
+		},
+		Consumption: []Eim{},
+	}, nil
+}
@@ -0,0 +1,78 @@
+package envoy
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FlexFloat is a number that some firmware quotes, sometimes with a unit
+// after it, e.g. "191 MB"
+type FlexFloat float64
+
+func (f *FlexFloat) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) != nil {
+		s = string(data)
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		*f = 0
+		return nil
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return err
+	}
+	*f = FlexFloat(v)
+	return nil
+}
+
+// NetworkInterface is one of the gateway's network connections
+type NetworkInterface struct {
+	Type              string `json:"type"` // ethernet, wifi, cellular
+	Interface         string `json:"interface"`
+	Dhcp              bool   `json:"dhcp"`
+	Ip                string `json:"ip"`
+	SignalStrength    int    `json:"signal_strength"`
+	SignalStrengthMax int    `json:"signal_strength_max"`
+	Carrier           bool   `json:"carrier"`
+}
+
+// Home is the gateway status from /home.json
+type Home struct {
+	SoftwareBuildEpoch int64     `json:"software_build_epoch"`
+	DbSize             FlexFloat `json:"db_size"` // MB
+	DbPercentFull      FlexFloat `json:"db_percent_full"`
+	Timezone           string    `json:"timezone"`
+	Network            struct {
+		WebComm                 bool               `json:"web_comm"` // Connected to Enlighten
+		EverReportedToEnlighten bool               `json:"ever_reported_to_enlighten"`
+		LastEnlightenReportTime int64              `json:"last_enlighten_report_time"`
+		PrimaryInterface        string             `json:"primary_interface"`
+		Interfaces              []NetworkInterface `json:"interfaces"`
+	} `json:"network"`
+	Comm struct {
+		Num   int `json:"num"`   // Devices communicating
+		Level int `json:"level"` // Signal level, 0-5
+	} `json:"comm"`
+	Alerts       []json.RawMessage `json:"alerts"`
+	UpdateStatus string            `json:"update_status"`
+}
+
+// PrimaryNetwork is the interface the gateway reports through, if known
+func (h *Home) PrimaryNetwork() *NetworkInterface {
+	for i, iface := range h.Network.Interfaces {
+		if iface.Interface == h.Network.PrimaryInterface {
+			return &h.Network.Interfaces[i]
+		}
+	}
+	return nil
+}
+
+func (c *Client) GetHome() (*Home, error) {
+	home := &Home{}
+	err := c.getJSON("/home.json", time.Second*5, home)
+	return home, err
+}
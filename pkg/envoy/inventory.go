@@ -0,0 +1,33 @@
+package envoy
+
+import (
+	"time"
+)
+
+// Device is a microinverter (PCU), AC battery (ACB) or Q-relay (NSRB)
+// from /inventory.json
+type Device struct {
+	PartNum        string   `json:"part_num"`
+	SerialNum      string   `json:"serial_num"`
+	DeviceStatus   []string `json:"device_status"` // e.g. envoy.global.ok
+	LastRptDate    int64    `json:"last_rpt_date,string"`
+	Producing      bool     `json:"producing"`
+	Communicating  bool     `json:"communicating"`
+	Provisioned    bool     `json:"provisioned"`
+	Operating      bool     `json:"operating"`
+	ImgPnumRunning string   `json:"img_pnum_running"` // Firmware
+}
+
+// Inventory is one type of device, PCU, ACB or NSRB
+type Inventory struct {
+	Type    string   `json:"type"`
+	Devices []Device `json:"devices"`
+}
+
+// GetInventory lists the devices the Envoy knows of, including ones that
+// are no longer reporting
+func (c *Client) GetInventory() ([]Inventory, error) {
+	inventory := []Inventory{}
+	err := c.getJSON("/inventory.json", time.Second*10, &inventory)
+	return inventory, err
+}
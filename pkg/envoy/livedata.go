@@ -0,0 +1,78 @@
+package envoy
+
+// High resolution power flows from /ivp/livedata/status (firmware 7.x).
+// The Envoy only updates it while the livedata stream is enabled, which
+// lapses after a while.
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// LivedataSource is the power for one of pv, grid, load, storage, generator
+type LivedataSource struct {
+	AggPMw  float64 `json:"agg_p_mw"`
+	AggSMva float64 `json:"agg_s_mva"`
+	PhAMw   float64 `json:"agg_p_ph_a_mw"`
+	PhBMw   float64 `json:"agg_p_ph_b_mw"`
+	PhCMw   float64 `json:"agg_p_ph_c_mw"`
+}
+
+type Livedata struct {
+	Connection struct {
+		ScStream string `json:"sc_stream"`
+	} `json:"connection"`
+	Meters struct {
+		LastUpdate   int64                     `json:"last_update"`
+		Soc          float64                   `json:"soc"`
+		EncAggSoc    float64                   `json:"enc_agg_soc"`
+		EncAggEnergy float64                   `json:"enc_agg_energy"`
+		PhaseCount   int                       `json:"phase_count"`
+		Sources      map[string]LivedataSource `json:"-"`
+	} `json:"meters"`
+}
+
+// LivedataSources are the power flows livedata can report
+var LivedataSources = []string{"pv", "grid", "load", "storage", "generator"}
+
+// StreamEnabled is whether the values are being kept up to date
+func (l *Livedata) StreamEnabled() bool {
+	return l.Connection.ScStream == "enabled"
+}
+
+func (c *Client) GetLivedata() (*Livedata, error) {
+	jsonData, err := c.Get("/ivp/livedata/status", time.Second*2)
+	if err != nil {
+		return nil, err
+	}
+	live := &Livedata{}
+	if err := json.Unmarshal(jsonData, live); err != nil {
+		return nil, fmt.Errorf("livedata: %w", err)
+	}
+
+	// The sources sit alongside the other meters values
+	var raw struct {
+		Meters map[string]json.RawMessage `json:"meters"`
+	}
+	if err := json.Unmarshal(jsonData, &raw); err != nil {
+		return nil, fmt.Errorf("livedata: %w", err)
+	}
+	live.Meters.Sources = map[string]LivedataSource{}
+	for _, name := range LivedataSources {
+		if data, ok := raw.Meters[name]; ok {
+			source := LivedataSource{}
+			if err := json.Unmarshal(data, &source); err != nil {
+				return nil, fmt.Errorf("livedata %s: %w", name, err)
+			}
+			live.Meters.Sources[name] = source
+		}
+	}
+	return live, nil
+}
+
+// EnableLivedataStream has the Envoy keep livedata up to date for a while
+func (c *Client) EnableLivedataStream() error {
+	_, err := c.Put("/ivp/livedata/stream", []byte(`{"enable":1}`), time.Second*5)
+	return err
+}
@@ -0,0 +1,67 @@
+package envoy
+
+// Per-phase CT meter readings from /ivp/meters and /ivp/meters/readings,
+// which production.json only gives as totals
+
+import "time"
+
+// Meter is a CT meter's configuration from /ivp/meters
+type Meter struct {
+	Eid             int64  `json:"eid"`
+	State           string `json:"state"`
+	MeasurementType string `json:"measurementType"`
+	PhaseMode       string `json:"phaseMode"`
+	PhaseCount      int    `json:"phaseCount"`
+	MeteringStatus  string `json:"meteringStatus"`
+}
+
+// MeterChannel is one phase's reading, or the total across phases
+type MeterChannel struct {
+	Eid            int64   `json:"eid"`
+	Timestamp      int64   `json:"timestamp"`
+	ActEnergyDlvd  float64 `json:"actEnergyDlvd"`
+	ActEnergyRcvd  float64 `json:"actEnergyRcvd"`
+	ApparentEnergy float64 `json:"apparentEnergy"`
+	ActivePower    float64 `json:"activePower"`
+	ApparentPower  float64 `json:"apparentPower"`
+	ReactivePower  float64 `json:"reactivePower"`
+	PwrFactor      float64 `json:"pwrFactor"`
+	Voltage        float64 `json:"voltage"`
+	Current        float64 `json:"current"`
+	Freq           float64 `json:"freq"`
+}
+
+// MeterReading is a meter's reading from /ivp/meters/readings
+type MeterReading struct {
+	MeterChannel
+	MeasurementType string         `json:"measurementType"` // From /ivp/meters
+	Channels        []MeterChannel `json:"channels"`
+}
+
+// GetMeters reads the CT meters' configuration
+func (c *Client) GetMeters() ([]Meter, error) {
+	meters := []Meter{}
+	err := c.getJSON("/ivp/meters", time.Second*5, &meters)
+	return meters, err
+}
+
+// GetMeterReadings reads each CT meter, with its measurement type
+func (c *Client) GetMeterReadings() ([]MeterReading, error) {
+	meters, err := c.GetMeters()
+	if err != nil {
+		return nil, err
+	}
+	meterTypes := map[int64]string{}
+	for _, m := range meters {
+		meterTypes[m.Eid] = m.MeasurementType
+	}
+
+	readings := []MeterReading{}
+	if err := c.getJSON("/ivp/meters/readings", time.Second*5, &readings); err != nil {
+		return nil, err
+	}
+	for i := range readings {
+		readings[i].MeasurementType = meterTypes[readings[i].Eid]
+	}
+	return readings, nil
+}
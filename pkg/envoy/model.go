@@ -0,0 +1,35 @@
+package envoy
+
+import "strings"
+
+// models is the model family by the start of the part number in info.xml.
+// An IQ Combiner can't be told apart: it reports the IQ Gateway built into
+// it, and nothing else it reports, such as Q-relays in its inventory, is
+// particular to a Combiner.
+var models = []struct {
+	partNumber string
+	model      string
+}{
+	{"800-00553", "IQ Gateway"},
+	{"800-00554", "Envoy-S"},
+	{"800-00555", "Envoy-S Metered"},
+	{"800-00654", "IQ Gateway"},
+	{"800-00656", "IQ Gateway"},
+}
+
+// Model is the gateway's model family, from its part number, or the part
+// number itself if it isn't one known
+func (i *Info) Model() string {
+	for _, m := range models {
+		if strings.HasPrefix(i.Device.Pn, m.partNumber) {
+			return m.model
+		}
+	}
+	return i.Device.Pn
+}
+
+// Metered is whether the gateway has CT inputs, as a metered model, true
+// if info.xml doesn't say
+func (i *Info) Metered() bool {
+	return i.Device.Imeter == nil || *i.Device.Imeter
+}
@@ -0,0 +1,16 @@
+package envoy
+
+import "time"
+
+// PowerMode is whether production has been switched off at the gateway,
+// e.g. by the installer app or an emergency power-off, from
+// /ivp/mod/603980032/mode/power (firmware 7.x)
+type PowerMode struct {
+	PowerForcedOff bool `json:"powerForcedOff"`
+}
+
+func (c *Client) GetPowerMode() (*PowerMode, error) {
+	mode := &PowerMode{}
+	err := c.getJSON("/ivp/mod/603980032/mode/power", time.Second*5, mode)
+	return mode, err
+}
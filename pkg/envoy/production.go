@@ -0,0 +1,110 @@
+package envoy
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Eim is a production or consumption reading from an integrated meter
+type Eim struct {
+	ActiveCount      *int    `json:"activeCount,omitempty"` // CTs in use, missing on some firmware
+	MeasurementType  string  `json:"measurementType"`
+	ReadingTime      int64   `json:"readingTime"`
+	WNow             float64 `json:"wNow"`
+	WhLifetime       float64 `json:"whLifetime"`
+	VarhLeadLifetime float64 `json:"varhLeadLifetime"`
+	VarhLagLifetime  float64 `json:"varhLagLifetime"`
+	VahLifetime      float64 `json:"vahLifetime"`
+	RmsCurrent       float64 `json:"rmsCurrent"`
+	RmsVoltage       float64 `json:"rmsVoltage"`
+	ReactPwr         float64 `json:"reactPwr"`
+	ApprntPwr        float64 `json:"apprntPwr"`
+	PwrFactor        float64 `json:"pwrFactor"`
+	WhToday          float64 `json:"whToday"`
+	WhLastSevenDays  float64 `json:"whLastSevenDays"`
+	VahToday         float64 `json:"vahToday"`
+	VarhLeadToday    float64 `json:"varhLeadToday"`
+	VarhLagToday     float64 `json:"varhLagToday"`
+	// Lines is each phase's (or for split-phase, each leg's) share, with
+	// the same fields less the type and time
+	Lines []Eim `json:"lines,omitempty"`
+}
+
+// Metering is whether the eim's CTs are in use.  Envoys without
+// consumption CTs still report consumption eims, with an activeCount of 0
+// and readings that stay at zero.
+func (e Eim) Metering() bool {
+	return e.ActiveCount == nil || *e.ActiveCount > 0
+}
+
+// Storage is a battery reading from production.json, e.g. Encharge (type "acb")
+type Storage struct {
+	Type        string  `json:"type"`
+	ActiveCount int     `json:"activeCount"`
+	ReadingTime int64   `json:"readingTime"`
+	WNow        float64 `json:"wNow"`
+	WhNow       float64 `json:"whNow"`
+	State       string  `json:"state"`
+	PercentFull float64 `json:"percentFull"`
+}
+
+// Production is the content of /production.json?details=1
+type Production struct {
+	ActiveInverters int // Microinverters reporting
+	Production      Eim
+	Consumption     []Eim
+	Storage         []Storage
+}
+
+// GetProduction reads /production.json, which has the production eim
+// after a microinverter summary, then consumption and storage, or on the
+// earliest firmware, as found by Detect, the totals it has instead
+func (c *Client) GetProduction() (*Production, error) {
+	if c.Firmware != nil && !c.Firmware.ProductionJSON {
+		return c.getLegacyProduction()
+	}
+	var raw struct {
+		Production  json.RawMessage
+		Consumption json.RawMessage
+		Storage     json.RawMessage
+	}
+	if err := c.getJSON("/production.json?details=1", time.Second*2, &raw); err != nil {
+		return nil, err
+	}
+
+	p := &Production{}
+	var inverters struct {
+		ActiveCount int
+	}
+	productionObj := []interface{}{&inverters, &p.Production}
+	if err := json.Unmarshal(raw.Production, &productionObj); err != nil {
+		return nil, fmt.Errorf("production: %w", err)
+	}
+	p.ActiveInverters = inverters.ActiveCount
+	if err := json.Unmarshal(raw.Consumption, &p.Consumption); err != nil {
+		return nil, fmt.Errorf("consumption: %w", err)
+	}
+	if len(raw.Storage) > 0 {
+		if err := json.Unmarshal(raw.Storage, &p.Storage); err != nil {
+			return nil, fmt.Errorf("storage: %w", err)
+		}
+	}
+	return p, nil
+}
+
+type Inverter struct {
+	SerialNumber    string  `json:"serialNumber"`
+	LastReportDate  int64   `json:"lastReportDate"`
+	DevType         int     `json:"devType"`
+	LastReportWatts float64 `json:"lastReportWatts"`
+	MaxReportWatts  float64 `json:"maxReportWatts"`
+}
+
+// GetInverters reads each microinverter's last report
+func (c *Client) GetInverters() ([]Inverter, error) {
+	inverters := []Inverter{}
+	// Can take a few seconds on larger arrays
+	err := c.getJSON("/api/v1/production/inverters", time.Second*10, &inverters)
+	return inverters, err
+}
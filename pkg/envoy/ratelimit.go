@@ -0,0 +1,83 @@
+package envoy
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// The gateway's embedded web server copes badly with many requests at
+// once, returning errors or even rebooting, so requests to it can be
+// spaced out, and more so while it is failing.
+const (
+	minBackoff = 250 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// RateLimiter spaces out every request to a gateway, whichever endpoint
+// and whoever sends it.  While requests fail or time out, or the gateway
+// answers with a server error, it waits longer between them, doubling up
+// to maxBackoff, and as they succeed again goes back to the usual rate.
+type RateLimiter struct {
+	host     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	next    time.Time     // When the next request may be sent
+	backoff time.Duration // Added to interval while the gateway struggles
+}
+
+// NewRateLimiter allows perSecond requests to host a second at most
+func NewRateLimiter(host string, perSecond float64) *RateLimiter {
+	return &RateLimiter{host: host, interval: rateInterval(perSecond)}
+}
+
+func rateInterval(perSecond float64) time.Duration {
+	return time.Duration(float64(time.Second) / perSecond)
+}
+
+// SetRate changes the requests a second allowed, for every client sharing
+// the limiter
+func (l *RateLimiter) SetRate(perSecond float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interval = rateInterval(perSecond)
+}
+
+// Wait blocks until the next request may be sent
+func (l *RateLimiter) Wait() {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval + l.backoff)
+	l.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// done notes whether a request found the gateway struggling
+func (l *RateLimiter) done(struggling bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if struggling {
+		if l.backoff == 0 {
+			l.backoff = minBackoff
+			slog.Warn("Envoy struggling, spacing out requests", "host", l.host)
+			return
+		}
+		l.backoff *= 2
+		if l.backoff > maxBackoff {
+			l.backoff = maxBackoff
+		}
+		return
+	}
+	if l.backoff > 0 {
+		l.backoff /= 2
+		if l.backoff < minBackoff {
+			l.backoff = 0
+			slog.Info("Envoy recovered, back to the usual request rate", "host", l.host)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package envoy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// PhaseSample is one phase's reading in /stream/meter
+type PhaseSample struct {
+	P  float64 `json:"p"` // Active power, W
+	Q  float64 `json:"q"` // Reactive power, VAr
+	S  float64 `json:"s"` // Apparent power, VA
+	V  float64 `json:"v"`
+	I  float64 `json:"i"`
+	Pf float64 `json:"pf"`
+	F  float64 `json:"f"` // Frequency, Hz
+}
+
+// MeterSample is a sample of the CT meters from /stream/meter, by
+// measurement type (production, net-consumption, total-consumption) then
+// phase (ph-a, ph-b, ph-c)
+type MeterSample map[string]map[string]PhaseSample
+
+// streamStall is how long the stream can go quiet before it's given up on
+const streamStall = 30 * time.Second
+
+// StreamMeter reads /stream/meter, which sends a sample about every
+// second, passing each to f until the connection fails.  It needs an
+// installer login.
+func (c *Client) StreamMeter(f func(MeterSample)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.wait()
+	resp, err := c.do(ctx, http.MethodGet, "/stream/meter", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("/stream/meter returned %s", resp.Status)
+	}
+
+	stalled := time.AfterFunc(streamStall, cancel)
+	defer stalled.Stop()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		stalled.Reset(streamStall)
+		// Server-sent events: "data: {...}"
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok {
+			continue
+		}
+		var sample MeterSample
+		if err := json.Unmarshal(data, &sample); err != nil {
+			return fmt.Errorf("/stream/meter: %w", err)
+		}
+		f(sample)
+	}
+	if ctx.Err() != nil {
+		return errors.New("/stream/meter stopped sending")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("/stream/meter closed")
+}
@@ -0,0 +1,48 @@
+package envoy
+
+import "time"
+
+// Tariff is the electricity tariff set up for the site in Enlighten, as
+// the Envoy has it in /admin/lib/tariff: a single rate, or time-of-use
+// rates by season, day of the week and time of day.  Seasons and the like
+// are for buying, SeasonsSell for selling back.
+type Tariff struct {
+	Currency struct {
+		Code string `json:"code"`
+	} `json:"currency"`
+	SingleRate struct {
+		Rate FlexFloat `json:"rate"`
+		Sell FlexFloat `json:"sell"`
+	} `json:"single_rate"`
+	Seasons     []TariffSeason `json:"seasons"`
+	SeasonsSell []TariffSeason `json:"seasons_sell"`
+}
+
+// TariffSeason applies from its start until the next season's
+type TariffSeason struct {
+	Id    string       `json:"id"`
+	Start string       `json:"start"` // Month/day, e.g. 6/1
+	Days  []TariffDays `json:"days"`
+}
+
+// TariffDays is the rates on some days of the week
+type TariffDays struct {
+	Id      string         `json:"id"`
+	Days    string         `json:"days"` // e.g. Mon,Tue,Wed,Thu,Fri
+	Periods []TariffPeriod `json:"periods"`
+}
+
+// TariffPeriod is a rate from its start until the next period's
+type TariffPeriod struct {
+	Id    string    `json:"id"`
+	Start FlexFloat `json:"start"` // Minutes after midnight, or -1 for midnight
+	Rate  FlexFloat `json:"rate"`
+}
+
+func (c *Client) GetTariff() (*Tariff, error) {
+	var body struct {
+		Tariff Tariff `json:"tariff"`
+	}
+	err := c.getJSON("/admin/lib/tariff", time.Second*5, &body)
+	return &body.Tariff, err
+}
@@ -0,0 +1,45 @@
+package main
+
+// Production switched off at the gateway (-power-mode), which can happen
+// by accident from the installer app and otherwise goes unnoticed until
+// the bill comes, bar a dip in production that looks like cloud.
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// powerForcedOff is whether each Envoy's production was last found
+// switched off, by host
+var powerForcedOff sync.Map
+
+// pollPowerMode reads whether production is switched off, logging when
+// that changes
+func pollPowerMode(gw gateway) *envoy.PowerMode {
+	mode, err := gw.client.GetPowerMode()
+	check(err)
+	previous, seen := powerForcedOff.Swap(gw.client.Host, mode.PowerForcedOff)
+	switch {
+	case mode.PowerForcedOff && (!seen || !previous.(bool)):
+		slog.Warn("Production is switched off at the Envoy", "site", gw.site, "host", gw.client.Host)
+	case !mode.PowerForcedOff && seen && previous.(bool):
+		slog.Info("Production switched back on at the Envoy", "site", gw.site, "host", gw.client.Host)
+	}
+	return mode
+}
+
+// powerModePoint has whether production is enabled, at the poll time
+func powerModePoint(measurement string, mode *envoy.PowerMode, t time.Time) point {
+	return point{
+		measurement: measurement,
+		tags: map[string]string{
+			"type": "production-state",
+		},
+		fields: map[string]interface{}{
+			"enabled": !mode.PowerForcedOff,
+		},
+		time: t,
+	}
+}
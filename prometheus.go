@@ -0,0 +1,113 @@
+package main
+
+// Prometheus exporter: serves the latest readings as gauges on /metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	promWatts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "envoy_watts",
+		Help: "Current power by measurement type (production, total-consumption, net-consumption)",
+	}, []string{"site", "type"})
+	promInverterWatts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "envoy_inverter_watts",
+		Help: "Last reported power per microinverter",
+	}, []string{"site", "serial"})
+	promInverterLastReport = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "envoy_inverter_last_report_timestamp_seconds",
+		Help: "Time of the last report per microinverter",
+	}, []string{"site", "serial"})
+	promInverterReportAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "envoy_inverter_report_age_seconds",
+		Help: "Time since the last report per microinverter, at the latest poll",
+	}, []string{"site", "serial"})
+	promReadingTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "envoy_reading_timestamp_seconds",
+		Help: "Envoy reading time of the latest production reading",
+	}, []string{"site"})
+	promGridConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "envoy_grid_connected",
+		Help: "1 when the Enpower relay is connected to the grid, 0 when running off-grid",
+	}, []string{"site"})
+
+	// Each output's queue, when polling in a loop
+	promOutputErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "envoy_output_write_errors_total",
+		Help: "Failed writes to an output, including those later retried",
+	}, []string{"output"})
+	promOutputDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "envoy_output_dropped_total",
+		Help: "Poll cycles' readings dropped from an output's full queue",
+	}, []string{"output"})
+	promOutputQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "envoy_output_queued",
+		Help: "Poll cycles' readings waiting to be written to an output",
+	}, []string{"output"})
+)
+
+// The poller's own health, from selfStats
+func registerSelfStats() {
+	counter := func(name string, help string, value *atomic.Int64) {
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help},
+			func() float64 { return float64(value.Load()) }))
+	}
+	counter("envoy_polls_total", "Poll cycles run", &stats.polls)
+	counter("envoy_poll_errors_total", "Failed Envoy poll attempts, including those later retried", &stats.pollErrors)
+	counter("influx_write_errors_total", "Failed InfluxDB writes", &stats.writeErrors)
+	counter("influx_points_written_total", "Points written to InfluxDB", &stats.pointsWritten)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "envoy_poll_duration_seconds",
+		Help: "Time taken by the latest poll cycle",
+	}, func() float64 { return time.Duration(stats.pollDuration.Load()).Seconds() }))
+}
+
+func servePrometheus(addr string) {
+	prometheus.MustRegister(promWatts, promInverterWatts, promInverterLastReport, promInverterReportAge, promReadingTime, promGridConnected)
+	prometheus.MustRegister(promOutputErrors, promOutputDropped, promOutputQueued)
+	registerSelfStats()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		slog.Error("Prometheus listener stopped", "err", err)
+	}()
+}
+
+// prometheusSink sets the gauges served by servePrometheus
+type prometheusSink struct{}
+
+func (prometheusSink) Write(readings []EnvoyReadings) error {
+	for _, r := range readings {
+		updatePrometheus(r)
+	}
+	return nil
+}
+
+func (prometheusSink) Flush() error { return nil }
+func (prometheusSink) Close() error { return nil }
+
+func updatePrometheus(r EnvoyReadings) {
+	for _, reading := range r.eims() {
+		promWatts.WithLabelValues(r.Site, reading.MeasurementType).Set(reading.WNow)
+	}
+	promReadingTime.WithLabelValues(r.Site).Set(float64(r.Production.ReadingTime))
+	if r.Ensemble != nil && r.Ensemble.Relay != nil {
+		connected := 0.0
+		if r.Ensemble.Relay.OnGrid() {
+			connected = 1
+		}
+		promGridConnected.WithLabelValues(r.Site).Set(connected)
+	}
+	for _, inv := range r.Inverters {
+		promInverterWatts.WithLabelValues(r.Site, inv.SerialNumber).Set(inv.LastReportWatts)
+		promInverterLastReport.WithLabelValues(r.Site, inv.SerialNumber).Set(float64(inv.LastReportDate))
+		promInverterReportAge.WithLabelValues(r.Site, inv.SerialNumber).Set(r.PollTime.Sub(time.Unix(inv.LastReportDate, 0)).Seconds())
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+// Proxies: the Envoy and InfluxDB can each be reached through an HTTP or
+// SOCKS proxy, e.g. where the poller runs in another network segment from
+// the Envoy and reaches it through a jump host.
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// proxyFunc is the proxy for a -envoy-proxy or -dbproxy setting: by default
+// as the standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables say,
+// direct for none, or the URL of one
+func proxyFunc(setting string) (func(*http.Request) (*url.URL, error), error) {
+	switch setting {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct":
+		return nil, nil
+	}
+	u, err := url.Parse(setting)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return http.ProxyURL(u), nil
+	}
+	return nil, fmt.Errorf("unsupported proxy %s, expected direct or an http, https or socks5 URL", setting)
+}
@@ -0,0 +1,184 @@
+package main
+
+// PVOutput.org uploader: posts production and consumption to the
+// addstatus API once per status interval, with power averaged over it.
+// Several Envoys are added together as one system.
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const pvoutputAddStatusUrl = "https://pvoutput.org/service/r2/addstatus.jsp"
+
+type PvoutputWriter struct {
+	apiKey   string
+	systemId string
+	interval time.Duration
+	client   *http.Client
+
+	slot        time.Time // Start of the status interval being averaged
+	samples     int
+	production  float64 // Sums of the watts samples
+	consumption float64
+	last        pvoutputStatus
+	unposted    []url.Values // Statuses of intervals over, to post, oldest first
+	pausedUntil time.Time    // Rate limited
+}
+
+// pvoutputStatus is the latest reading to post
+type pvoutputStatus struct {
+	time               time.Time
+	whToday            float64
+	consumptionWhToday float64
+	consumption        bool // whether there's a consumption CT
+	voltage            float64
+}
+
+func NewPvoutputWriter(cfg PvoutputConfig) *PvoutputWriter {
+	return &PvoutputWriter{
+		apiKey:   cfg.ApiKey,
+		systemId: cfg.SystemId,
+		interval: cfg.Interval,
+		client:   &http.Client{Timeout: time.Second * 30},
+	}
+}
+
+func (w *PvoutputWriter) Write(readings []EnvoyReadings) error {
+	if len(readings) == 0 {
+		return nil
+	}
+	status := pvoutputStatus{}
+	var production, consumption float64
+	for _, r := range readings {
+		t := time.Unix(r.Production.ReadingTime, 0)
+		if t.After(status.time) {
+			status.time = t
+		}
+		production += r.Production.WNow
+		status.whToday += r.Production.WhToday
+		status.voltage = r.Production.RmsVoltage
+		for _, eim := range r.Consumption {
+			if eim.MeasurementType == "total-consumption" {
+				status.consumption = true
+				consumption += eim.WNow
+				status.consumptionWhToday += eim.WhToday
+			}
+		}
+	}
+
+	if w.samples > 0 && !status.time.After(w.last.time) {
+		// Already added, e.g. written again on a retry
+		return nil
+	}
+
+	// Post the previous interval's averages once a reading is in the next
+	slot := status.time.Truncate(w.interval)
+	if w.samples > 0 && slot.After(w.slot) {
+		w.unposted = append(w.unposted, w.statusParams())
+		if over := len(w.unposted) - int(24*time.Hour/w.interval); over > 0 {
+			w.unposted = w.unposted[over:]
+			slog.Warn("PVOutput unreachable for a day, dropped the oldest statuses", "statuses", over)
+		}
+		w.samples, w.production, w.consumption = 0, 0, 0
+	}
+	w.slot = slot
+	w.samples++
+	w.production += production
+	w.consumption += consumption
+	w.last = status
+	return w.postUnposted()
+}
+
+// retry posts the statuses that failed to post, as the readings have
+// already been added to the averages
+func (w *PvoutputWriter) retry() error {
+	return w.postUnposted()
+}
+
+// postUnposted posts the intervals over, oldest first, keeping those not
+// posted for next time
+func (w *PvoutputWriter) postUnposted() error {
+	for len(w.unposted) > 0 {
+		err := w.post(w.unposted[0])
+		if err != nil && !errors.Is(err, errRejected) {
+			return err
+		}
+		// Posted, or refused, e.g. as too old, so never to be taken
+		w.unposted = w.unposted[1:]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statusParams is the addstatus parameters for the interval being averaged
+func (w *PvoutputWriter) statusParams() url.Values {
+	t := w.last.time.Local()
+	params := url.Values{
+		"d":  {t.Format("20060102")},
+		"t":  {t.Format("15:04")},
+		"v1": {strconv.FormatFloat(w.last.whToday, 'f', 0, 64)},
+		"v2": {strconv.FormatFloat(w.production/float64(w.samples), 'f', 0, 64)},
+		"v6": {strconv.FormatFloat(w.last.voltage, 'f', 1, 64)},
+	}
+	if w.last.consumption {
+		params.Set("v3", strconv.FormatFloat(w.last.consumptionWhToday, 'f', 0, 64))
+		params.Set("v4", strconv.FormatFloat(w.consumption/float64(w.samples), 'f', 0, 64))
+	}
+	return params
+}
+
+func (w *PvoutputWriter) post(params url.Values) error {
+	if time.Now().Before(w.pausedUntil) {
+		slog.Debug("PVOutput rate limit reached, skipping", "until", w.pausedUntil)
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, pvoutputAddStatusUrl, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Pvoutput-Apikey", w.apiKey)
+	req.Header.Set("X-Pvoutput-SystemId", w.systemId)
+	req.Header.Set("X-Rate-Limit", "1")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	// Hold off until the hourly limit resets, rather than keep failing
+	if resp.Header.Get("X-Rate-Limit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-Rate-Limit-Reset"), 10, 64); err == nil {
+			w.pausedUntil = time.Unix(reset, 0)
+			slog.Warn("PVOutput rate limit reached", "until", w.pausedUntil)
+		}
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("status %w by PVOutput, %s: %s", errRejected, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PVOutput returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	slog.Debug("Posted to PVOutput", "date", params.Get("d"), "time", params.Get("t"), "watts", params.Get("v2"))
+	return nil
+}
+
+// Flush is a no-op, as a partial interval isn't worth posting
+func (w *PvoutputWriter) Flush() error {
+	return nil
+}
+
+func (w *PvoutputWriter) Close() error {
+	return nil
+}
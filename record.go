@@ -0,0 +1,49 @@
+package main
+
+// Recording the Envoy's raw responses, e.g. as fixtures for parsing
+// problems with a new firmware version.  Each is saved under
+// <dir>/<host>/ named by when it was received and its path, e.g.
+// 2024-01-31T12-00-00.123Z_production.json_details=1.json
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// recordTimeFormat is sortable and has no colons, for Windows
+const recordTimeFormat = "2006-01-02T15-04-05.000Z"
+
+// recordName makes s safe as part of a file name
+var recordName = strings.NewReplacer("/", "_", "?", "_", ":", "_", "&", "_").Replace
+
+// recordPath is the file name for a response to path, less the time
+func recordPath(path string) string {
+	name := recordName(strings.TrimPrefix(path, "/"))
+	if !strings.HasSuffix(name, ".json") {
+		name += ".json"
+	}
+	return name
+}
+
+// recordFile is the file name for a response to path received at t
+func recordFile(t time.Time, path string) string {
+	return t.UTC().Format(recordTimeFormat) + "_" + recordPath(path)
+}
+
+// recorder saves each response from host under dir.  Failures are logged
+// rather than failing the poll.
+func recorder(dir string, host string) func(path string, body []byte) {
+	hostDir := filepath.Join(dir, recordName(host))
+	return func(path string, body []byte) {
+		err := os.MkdirAll(hostDir, 0755)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(hostDir, recordFile(time.Now(), path)), body, 0644)
+		}
+		if err != nil {
+			slog.Error("Recording response failed", "path", path, "err", err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+// Reloading on SIGHUP: the config file, environment and command line are
+// read again, and the Envoys and outputs set up afresh with them, between
+// polls.  Readings held back for InfluxDB carry over to the new writer.
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+)
+
+// reloadConfig reads the settings again, as they were first read
+func reloadConfig(cfg *Config) (reloaded *Config, err error) {
+	err = catch(func() {
+		// Flags can only be defined once per set
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		reloaded = loadConfig(cfg.args)
+		if reloaded.Interval == 0 {
+			// -l was dropped or defaulted, as by serve: keep looping
+			reloaded.Interval = cfg.Interval
+		}
+		check(reloaded.validate())
+	})
+	if err == nil && reloaded.Replay != "" {
+		err = errors.New("can't switch to replaying (-replay) on reload")
+	}
+	return reloaded, err
+}
+
+// reload sets up the gateways and outputs for the settings as they are
+// now, closing the old outputs, or keeps the old ones if that fails.
+// streaming is whether meter streams are writing to the old InfluxDB
+// writers, which they go on doing.
+func reload(cfg *Config, gateways []gateway, sinks []Sink, streaming bool) (*Config, []gateway, []Sink) {
+	reloaded, err := reloadConfig(cfg)
+	var newGws []gateway
+	var newOuts []Sink
+	if err == nil {
+		err = catch(func() {
+			newGws = newGateways(reloaded)
+			newOuts = newSinks(reloaded, newGws)
+		})
+	}
+	if err != nil {
+		slog.Error("Reloading settings failed, carrying on with the old ones", "err", err)
+		return cfg, gateways, sinks
+	}
+
+	// Write what's queued for the old outputs first, so what the new
+	// InfluxDB writers take over includes anything of it that failed, and
+	// comes before their own points
+	for _, sink := range sinks {
+		if q, ok := sink.(*queuedSink); ok {
+			q.stop()
+		}
+	}
+
+	// Each InfluxDB in turn, as listed
+	old, ws := influxSinks(sinks), influxSinks(newOuts)
+	for i, w := range ws {
+		if i < len(old) {
+			w.takeOver(old[i])
+		}
+	}
+	for _, sink := range sinks {
+		sink = unqueued(sink)
+		if _, influx := sink.(*InfluxWriter); influx && streaming {
+			// Still written to by the streams
+			continue
+		}
+		if err := sink.Flush(); err != nil {
+			slog.Error("Flushing output failed", "err", err)
+		}
+		if err := sink.Close(); err != nil {
+			slog.Error("Closing output failed", "err", err)
+		}
+	}
+	setupLogging(reloaded.LogLevel, reloaded.LogFormat)
+	slog.Info("Reloaded settings", "envoys", len(newGws), "outputs", len(newOuts))
+	return reloaded, newGws, newOuts
+}
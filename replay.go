@@ -0,0 +1,124 @@
+package main
+
+// Replaying responses saved with -record through the usual parsing and
+// outputs, e.g. to backfill after an outage or re-write with new settings.
+// Each host's responses are split into polls at each production.json.
+
+import (
+	"fmt"
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// recordedPoll is the files saved in one poll, by their recordPath
+type recordedPoll struct {
+	time  time.Time
+	files map[string]string
+}
+
+// recordedPolls reads the names of the responses saved in dir into polls
+func recordedPolls(dir string) []recordedPoll {
+	entries, err := os.ReadDir(dir)
+	check(err)
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	pollStart := recordPath("/production.json?details=1")
+	polls := []recordedPoll{}
+	for _, name := range names {
+		stamp, path, ok := strings.Cut(name, "_")
+		t, err := time.Parse(recordTimeFormat, stamp)
+		if !ok || err != nil {
+			slog.Warn("Skipping file not from -record", "file", filepath.Join(dir, name))
+			continue
+		}
+		if path == pollStart || len(polls) == 0 {
+			polls = append(polls, recordedPoll{time: t, files: map[string]string{}})
+		}
+		polls[len(polls)-1].files[path] = filepath.Join(dir, name)
+	}
+	return polls
+}
+
+// respond answers the client's requests from the poll's responses
+func (p recordedPoll) respond(path string) ([]byte, error) {
+	file, ok := p.files[recordPath(path)]
+	if !ok {
+		return nil, fmt.Errorf("%s wasn't recorded", path)
+	}
+	return os.ReadFile(file)
+}
+
+// replayGateways is a gateway for each host recorded in dir, or dir itself
+// if it has the responses, with the host's settings if it's configured
+func replayGateways(cfg *Config, dir string) (gateways []gateway, dirs []string) {
+	entries, err := os.ReadDir(dir)
+	check(err)
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs = append(dirs, filepath.Join(dir, e.Name()))
+		}
+	}
+	if len(dirs) == 0 {
+		dirs = []string{dir}
+	}
+	for _, d := range dirs {
+		host := filepath.Base(d)
+		ec := cfg.envoyConfigs()[0]
+		for _, c := range cfg.envoyConfigs() {
+			if recordName(c.Host) == host {
+				ec = c
+			}
+		}
+		if ec.Site == "" && len(dirs) > 1 {
+			ec.Site = host
+		}
+		// The Envoy's tariff isn't recorded, only the rates given
+		tariff := cfg.Tariff
+		tariff.Envoy = false
+		gw := gateway{client: envoy.NewClient(host, ""), site: ec.Site, cfg: ec, loc: ec.location(), rollup: cfg.Influx.DailyMeasurement != ""}
+		gw.tariff = gatewayTariff(tariff, gw.client)
+		gateways = append(gateways, gw)
+	}
+	return gateways, dirs
+}
+
+// replay writes the recorded polls to the outputs, as at the time they
+// were recorded
+func replay(cfg *Config) {
+	gateways, dirs := replayGateways(cfg, cfg.Replay)
+	sinks := newSinks(cfg, gateways)
+	defer closeSinks(sinks)
+	checkInflux(cfg, sinks)
+	for i, gw := range gateways {
+		polls := recordedPolls(dirs[i])
+		slog.Info("Replaying", "dir", dirs[i], "site", gw.site, "polls", len(polls))
+		for _, p := range polls {
+			gw.client.Respond = p.respond
+			recorded := p.time
+			gw.clock = func() time.Time {
+				return recorded
+			}
+			readings, err := tryPoll(func() EnvoyReadings {
+				return pollEnvoy(gw)
+			})
+			if err != nil {
+				slog.Warn("Skipping recorded poll", "dir", dirs[i], "time", p.time, "err", err)
+				continue
+			}
+			if err := writeSinks(sinks, []EnvoyReadings{readings}); err != nil {
+				slog.Error("Writing replayed poll failed", "time", p.time, "err", err)
+			}
+		}
+	}
+}
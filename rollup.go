@@ -0,0 +1,124 @@
+package main
+
+// A summary point per day: energy produced and consumed, imported and
+// exported, and peak power, written when the day is over.  Days end at
+// midnight in the site's timezone (-tz), or the host's.
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"math"
+	"sync"
+	"time"
+)
+
+// DailyRollup sums up one day at a site
+type DailyRollup struct {
+	Day              time.Time // Its midnight
+	ProductionWh     float64
+	ConsumptionWh    float64 // Only with a total-consumption CT
+	ImportWh         float64
+	ExportWh         float64
+	PeakWatts        float64 // Production
+	PeakConsumptionW float64
+
+	// Lifetime totals at the start of the day, and import/export power as
+	// at the last poll, to add up the day as it goes
+	productionStart  float64
+	consumptionStart float64
+	lastPoll         time.Time
+	lastDerived      Derived
+	hasConsumption   bool
+}
+
+var (
+	rollupsMu sync.Mutex
+	rollups   = map[string]*DailyRollup{} // By host
+)
+
+// maxRollupGap is the longest between polls to count import/export over,
+// beyond which the poller was probably down
+const maxRollupGap = time.Hour
+
+// addToRollup adds r to its day's rollup, returning the previous day's
+// once r is the first of a new day
+func addToRollup(host string, r EnvoyReadings, loc *time.Location) *DailyRollup {
+	if loc == nil {
+		loc = time.Local
+	}
+	t := r.PollTime.In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	total, hasConsumption := totalConsumption(r)
+
+	rollupsMu.Lock()
+	defer rollupsMu.Unlock()
+	d, ok := rollups[host]
+	var finished *DailyRollup
+	if ok && !d.Day.Equal(day) {
+		finished = d
+		// Carry on from where yesterday finished
+		d = &DailyRollup{
+			Day:              day,
+			productionStart:  finished.productionStart + finished.ProductionWh,
+			consumptionStart: finished.consumptionStart + finished.ConsumptionWh,
+			lastPoll:         finished.lastPoll,
+			lastDerived:      finished.lastDerived,
+		}
+		rollups[host] = d
+	}
+	if !ok {
+		// Started mid-day: take the Envoy's word for the day so far
+		d = &DailyRollup{
+			Day:              day,
+			productionStart:  r.Production.WhLifetime - r.Production.WhToday,
+			consumptionStart: total.WhLifetime - total.WhToday,
+		}
+		rollups[host] = d
+	}
+
+	d.ProductionWh = r.Production.WhLifetime - d.productionStart
+	d.PeakWatts = math.Max(d.PeakWatts, r.Production.WNow)
+	if hasConsumption {
+		d.hasConsumption = true
+		d.ConsumptionWh = total.WhLifetime - d.consumptionStart
+		d.PeakConsumptionW = math.Max(d.PeakConsumptionW, total.WNow)
+		derived, _ := derive(r)
+		if gap := r.PollTime.Sub(d.lastPoll); !d.lastPoll.IsZero() && gap <= maxRollupGap {
+			// Average of the power at each end of the gap
+			hours := gap.Hours()
+			d.ImportWh += (d.lastDerived.GridImportWatts + derived.GridImportWatts) / 2 * hours
+			d.ExportWh += (d.lastDerived.GridExportWatts + derived.GridExportWatts) / 2 * hours
+		}
+		d.lastDerived = derived
+	}
+	d.lastPoll = r.PollTime
+	return finished
+}
+
+// totalConsumption is r's total-consumption eim, if it has one
+func totalConsumption(r EnvoyReadings) (total envoy.Eim, ok bool) {
+	for _, eim := range r.Consumption {
+		if eim.MeasurementType == "total-consumption" {
+			return eim, true
+		}
+	}
+	return envoy.Eim{}, false
+}
+
+func rollupPoint(measurement string, d *DailyRollup) point {
+	fields := map[string]interface{}{
+		"productionWh": d.ProductionWh,
+		"peakWatts":    d.PeakWatts,
+	}
+	if d.hasConsumption {
+		fields["consumptionWh"] = d.ConsumptionWh
+		fields["peakConsumptionWatts"] = d.PeakConsumptionW
+		fields["importWh"] = d.ImportWh
+		fields["exportWh"] = d.ExportWh
+	}
+	return point{
+		measurement: measurement,
+		tags:        map[string]string{},
+		fields:      fields,
+		time:        d.Day,
+	}
+}
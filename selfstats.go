@@ -0,0 +1,42 @@
+package main
+
+// Metrics about the poller itself, so gaps can be alerted on rather than
+// discovered later.  Exposed via Prometheus and optionally written to
+// InfluxDB each cycle.
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type selfStats struct {
+	polls         atomic.Int64
+	pollErrors    atomic.Int64 // failed attempts, including those retried
+	pollDuration  atomic.Int64 // nanoseconds, of the latest cycle
+	writeErrors   atomic.Int64
+	pointsWritten atomic.Int64
+
+	// Unix nanoseconds of the last success
+	lastPoll  atomic.Int64
+	lastWrite atomic.Int64
+}
+
+var (
+	stats     selfStats
+	startTime = time.Now()
+)
+
+func (s *selfStats) point(measurement string) point {
+	return point{
+		measurement: measurement,
+		tags:        map[string]string{},
+		fields: map[string]interface{}{
+			"polls":               s.polls.Load(),
+			"pollErrors":          s.pollErrors.Load(),
+			"pollDurationSeconds": time.Duration(s.pollDuration.Load()).Seconds(),
+			"writeErrors":         s.writeErrors.Load(),
+			"pointsWritten":       s.pointsWritten.Load(),
+		},
+		time: time.Now().Truncate(time.Second),
+	}
+}
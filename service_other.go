@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// serviceCommand is for Windows; elsewhere, run under systemd or the like
+func serviceCommand(args []string) {
+	fmt.Fprintln(os.Stderr, "The service command is for running as a Windows service; on Linux, see the README's systemd section")
+	os.Exit(2)
+}
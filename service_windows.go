@@ -0,0 +1,182 @@
+//go:build windows
+
+package main
+
+// Running as a Windows service: "service install [flags]" registers the
+// poller to start with Windows, running "service run [flags]", and logging
+// to the Application event log.
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	serviceName        = "influxEnvoyStats"
+	serviceDisplayName = "Enphase Envoy monitoring"
+	serviceDescription = "Polls Enphase Envoy solar gateways and writes their readings to InfluxDB and other outputs."
+)
+
+func serviceCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: influxEnvoyStats service install [flags] | uninstall | run [flags]")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "install":
+		installService(args[1:])
+	case "uninstall":
+		uninstallService()
+	case "run":
+		runService(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown service command %q, expected install, uninstall or run\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// installService registers the service to start automatically with the
+// flags given, which are checked first
+func installService(args []string) {
+	cfg := loadConfig(args)
+	check(cfg.validate())
+	exe, err := os.Executable()
+	check(err)
+	exe, err = filepath.Abs(exe)
+	check(err)
+
+	m, err := mgr.Connect()
+	check(err)
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		fmt.Fprintf(os.Stderr, "Service %s is already installed, uninstall it first to change its flags\n", serviceName)
+		os.Exit(1)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run"}, args...)...)
+	check(err)
+	defer s.Close()
+	// Restart it a minute after it fails, as systemd's Restart=on-failure
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: time.Minute}}, uint32((24 * time.Hour).Seconds()))
+	check(err)
+	err = s.SetRecoveryActionsOnNonCrashFailures(true)
+	check(err)
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil && !strings.Contains(err.Error(), "exists") {
+		check(err)
+	}
+	fmt.Printf("Installed service %s, start it with: sc start %s\n", serviceName, serviceName)
+}
+
+// uninstallService removes the service, once stopped, and its event source
+func uninstallService() {
+	m, err := mgr.Connect()
+	check(err)
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Service %s isn't installed\n", serviceName)
+		os.Exit(1)
+	}
+	defer s.Close()
+	check(s.Delete())
+	if err := eventlog.Remove(serviceName); err != nil {
+		slog.Warn("Removing the event log source failed", "err", err)
+	}
+	fmt.Printf("Uninstalled service %s\n", serviceName)
+}
+
+// runService polls as the service manager's service, or in the foreground
+// if started from a console, e.g. to try out the service's flags
+func runService(args []string) {
+	isService, err := svc.IsWindowsService()
+	check(err)
+	if !isService {
+		run(serviceConfig(args))
+		return
+	}
+	elog, err := eventlog.Open(serviceName)
+	check(err)
+	defer elog.Close()
+	logOutput = eventlogWriter{elog}
+	setupLogging("info", "text") // Until the settings are read
+	if err := svc.Run(serviceName, &service{args: args}); err != nil {
+		elog.Error(1, fmt.Sprintf("%s service failed: %v", serviceName, err))
+	}
+}
+
+// serviceConfig is the settings as for serve: always polling in a loop
+func serviceConfig(args []string) *Config {
+	cfg := loadConfig(args)
+	if cfg.Interval == 0 {
+		cfg.Interval = time.Minute
+	}
+	return cfg
+}
+
+type service struct {
+	args []string
+}
+
+// Execute polls until the service is stopped, or polling fails to start
+func (s *service) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() {
+		done <- catch(func() { run(serviceConfig(s.args)) })
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				select {
+				case stopSignals <- syscall.SIGTERM:
+				default: // Already stopping
+				}
+			}
+		case err := <-done:
+			if err != nil {
+				slog.Error("Polling failed", "err", err)
+				return false, 1
+			}
+			return false, 0
+		}
+	}
+}
+
+// eventlogWriter writes each log line to the event log, at the level it's
+// logged at
+type eventlogWriter struct {
+	log *eventlog.Log
+}
+
+func (w eventlogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	var err error
+	switch {
+	case strings.Contains(line, "level=ERROR"), strings.Contains(line, `"level":"ERROR"`):
+		err = w.log.Error(1, line)
+	case strings.Contains(line, "level=WARN"), strings.Contains(line, `"level":"WARN"`):
+		err = w.log.Warning(1, line)
+	default:
+		err = w.log.Info(1, line)
+	}
+	return len(p), err
+}
@@ -0,0 +1,355 @@
+package main
+
+// simulate: a fake Envoy serving a plausible day of solar production and
+// household consumption, for trying out dashboards and outputs without
+// the hardware, or as a target for testing the poller
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"math"
+	"math/big"
+	mathrand "math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const simulatedSerial = "122100000001"
+
+// simulator is the state of the fake Envoy: its energy meters, which run
+// on from when it started
+type simulator struct {
+	inverters int
+	peak      float64 // Watts per inverter at midday
+	lat, lon  float64
+	noCTs     bool // Consumption eims not metering, as without CTs
+
+	mu          sync.Mutex
+	updated     time.Time
+	produced    float64 // Wh lifetime
+	consumed    float64
+	producedDay float64 // Wh today
+	consumedDay float64
+	load        float64 // Current household load, wandering about
+}
+
+// sun is the sunrise and sunset on t's day, from the location if given,
+// otherwise 6am to 6pm local time
+func (s *simulator) sun(t time.Time) (time.Time, time.Time) {
+	if s.lat != 0 || s.lon != 0 {
+		if rise, set, polar, _ := sunTimes(t, s.lat, s.lon); !polar {
+			return rise, set
+		}
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return midnight.Add(6 * time.Hour), midnight.Add(18 * time.Hour)
+}
+
+// production is the watts each inverter makes at t: a curve peaking at
+// solar noon, with passing clouds
+func (s *simulator) production(t time.Time) float64 {
+	rise, set := s.sun(t)
+	if t.Before(rise) || !t.Before(set) {
+		return 0
+	}
+	dayFraction := float64(t.Sub(rise)) / float64(set.Sub(rise))
+	clouds := 0.85 + 0.15*math.Sin(float64(t.Unix())/700)*math.Sin(float64(t.Unix())/170)
+	return s.peak * math.Pow(math.Sin(math.Pi*dayFraction), 1.5) * clouds
+}
+
+// update runs the meters on to now, returning the current power
+func (s *simulator) update(now time.Time) (production float64, consumption float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.updated.IsZero() {
+		// As though it's been running a few years, and all of today
+		s.updated, s.load = now, 400
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		for t := midnight; t.Before(now); t = t.Add(5 * time.Minute) {
+			s.producedDay += s.production(t) * float64(s.inverters) / 12
+		}
+		s.consumedDay = s.load * now.Sub(midnight).Hours()
+		s.produced, s.consumed = 12e6+s.producedDay, 15e6+s.consumedDay
+	}
+	if now.YearDay() != s.updated.YearDay() {
+		s.producedDay, s.consumedDay = 0, 0
+	}
+	s.load = math.Max(150, math.Min(6000, s.load+mathrand.NormFloat64()*80))
+	if mathrand.Intn(40) == 0 {
+		s.load += 2000 // Kettle on
+	}
+	production = s.production(now) * float64(s.inverters)
+	hours := now.Sub(s.updated).Hours()
+	s.produced += production * hours
+	s.producedDay += production * hours
+	s.consumed += s.load * hours
+	s.consumedDay += s.load * hours
+	s.updated = now
+	return production, s.load
+}
+
+func simulatedEim(measurementType string, now time.Time, watts float64, whLifetime float64, whToday float64) envoy.Eim {
+	volts := 240 + mathrand.Float64()*2
+	return envoy.Eim{
+		MeasurementType: measurementType,
+		ReadingTime:     now.Unix(),
+		WNow:            watts,
+		WhLifetime:      whLifetime,
+		WhToday:         whToday,
+		RmsVoltage:      volts,
+		RmsCurrent:      watts / volts,
+		ApprntPwr:       math.Abs(watts),
+		PwrFactor:       1,
+	}
+}
+
+func (s *simulator) productionJSON(now time.Time) interface{} {
+	production, consumption := s.update(now)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"production": []interface{}{
+			map[string]interface{}{"type": "inverters", "activeCount": s.inverters, "readingTime": now.Unix(), "wNow": production, "whLifetime": s.produced},
+			simulatedEim("production", now, production, s.produced, s.producedDay),
+		},
+		"consumption": s.consumptionEims(now, production, consumption),
+		"storage":     []envoy.Storage{{Type: "acb", State: "idle"}},
+	}
+}
+
+// consumptionEims are as from consumption CTs, or without them, all zero
+func (s *simulator) consumptionEims(now time.Time, production float64, consumption float64) []envoy.Eim {
+	if s.noCTs {
+		none := 0
+		eims := []envoy.Eim{{MeasurementType: "total-consumption"}, {MeasurementType: "net-consumption"}}
+		for i := range eims {
+			eims[i].ActiveCount = &none
+			eims[i].ReadingTime = now.Unix()
+		}
+		return eims
+	}
+	return []envoy.Eim{
+		simulatedEim("total-consumption", now, consumption, s.consumed, s.consumedDay),
+		simulatedEim("net-consumption", now, consumption-production, s.consumed-s.produced, s.consumedDay-s.producedDay),
+	}
+}
+
+// lastReport is when the inverters last reported: every 5 minutes, and
+// not since sunset
+func (s *simulator) lastReport(now time.Time) time.Time {
+	rise, set := s.sun(now)
+	if now.Before(rise) {
+		_, set = s.sun(now.AddDate(0, 0, -1))
+	}
+	if now.Before(set) {
+		set = now
+	}
+	return set.Truncate(5 * time.Minute)
+}
+
+func (s *simulator) invertersJSON(now time.Time) interface{} {
+	reported := s.lastReport(now)
+	inverters := []envoy.Inverter{}
+	for i := 0; i < s.inverters; i++ {
+		// Some panels a little shaded
+		watts := s.production(reported) * (1 - 0.02*float64(i%5))
+		inverters = append(inverters, envoy.Inverter{
+			SerialNumber:    fmt.Sprintf("1219000%05d", i+1),
+			LastReportDate:  reported.Unix(),
+			DevType:         1,
+			LastReportWatts: math.Round(watts),
+			MaxReportWatts:  math.Round(s.peak),
+		})
+	}
+	return inverters
+}
+
+func (s *simulator) inventoryJSON(now time.Time) interface{} {
+	pcu := envoy.Inventory{Type: "PCU"}
+	for i := 0; i < s.inverters; i++ {
+		pcu.Devices = append(pcu.Devices, envoy.Device{
+			PartNum:       "800-01391-r02",
+			SerialNum:     fmt.Sprintf("1219000%05d", i+1),
+			DeviceStatus:  []string{"envoy.global.ok"},
+			LastRptDate:   s.lastReport(now).Unix(),
+			Producing:     s.production(now) > 0,
+			Communicating: true,
+			Provisioned:   true,
+			Operating:     true,
+		})
+	}
+	return []envoy.Inventory{pcu, {Type: "ACB"}, {Type: "NSRB"}}
+}
+
+// devstatusJSON is /ivp/peb/devstatus's table of microinverters, DC
+// voltage falling off a little as it warms up
+func (s *simulator) devstatusJSON(now time.Time) interface{} {
+	reported := s.lastReport(now)
+	values := [][]interface{}{}
+	for i := 0; i < s.inverters; i++ {
+		watts := s.production(reported) * (1 - 0.02*float64(i%5))
+		temperature := 15 + watts/10
+		dcVoltage := 38 - 0.1*temperature
+		values = append(values, []interface{}{
+			fmt.Sprintf("1219000%05d", i+1), 1, true, true, watts > 0, reported.Unix(), math.Round(temperature),
+			math.Round(dcVoltage * 1000), math.Round(watts / 0.96 / dcVoltage * 1000), 240000, math.Round(watts * 1000),
+		})
+	}
+	return map[string]interface{}{
+		"pcu": map[string]interface{}{
+			"fields": []string{"serialNumber", "devType", "communicating", "recent", "producing", "reportDate", "temperature", "dcVoltageINmV", "dcCurrentINmA", "acVoltageINmV", "acPowerINmW"},
+			"values": values,
+		},
+	}
+}
+
+func (s *simulator) homeJSON(now time.Time) interface{} {
+	home := envoy.Home{SoftwareBuildEpoch: 1700000000, DbSize: 120, DbPercentFull: 5, Timezone: "UTC"}
+	home.Network.WebComm = true
+	home.Network.EverReportedToEnlighten = true
+	home.Network.LastEnlightenReportTime = now.Truncate(5 * time.Minute).Unix()
+	home.Network.PrimaryInterface = "eth0"
+	home.Network.Interfaces = []envoy.NetworkInterface{{Type: "ethernet", Interface: "eth0", Dhcp: true, Ip: "192.168.1.50", Carrier: true}}
+	home.Comm.Num, home.Comm.Level = s.inverters, 5
+	home.UpdateStatus = "satisfied"
+	return home
+}
+
+func (s *simulator) energyJSON(now time.Time) interface{} {
+	production, consumption := s.update(now)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counter := func(watts float64, lifetime float64, today float64) *envoy.EnergyCounter {
+		return &envoy.EnergyCounter{WattHoursToday: math.Round(today), WattHoursSevenDays: math.Round(today * 7), WattHoursLifetime: math.Round(lifetime), WattsNow: math.Round(watts)}
+	}
+	return envoy.Energy{
+		Production: map[string]*envoy.EnergyCounter{
+			"pcu": counter(production, s.produced, s.producedDay),
+			"rgm": nil,
+			"eim": counter(production, s.produced, s.producedDay),
+		},
+		Consumption: map[string]*envoy.EnergyCounter{
+			"eim": counter(consumption, s.consumed, s.consumedDay),
+		},
+	}
+}
+
+// tariffJSON is a time-of-use tariff with a weekday evening peak
+func (s *simulator) tariffJSON(now time.Time) interface{} {
+	t := envoy.Tariff{}
+	t.Currency.Code = "USD"
+	t.SingleRate.Rate = 0.15
+	t.Seasons = []envoy.TariffSeason{{
+		Id:    "all_year",
+		Start: "1/1",
+		Days: []envoy.TariffDays{{
+			Id:      "weekdays",
+			Days:    "Mon,Tue,Wed,Thu,Fri",
+			Periods: []envoy.TariffPeriod{{Id: "off-peak", Start: -1, Rate: 0.12}, {Id: "peak", Start: 16 * 60, Rate: 0.35}, {Id: "off-peak", Start: 21 * 60, Rate: 0.12}},
+		}, {
+			Id:      "weekend",
+			Days:    "Sat,Sun",
+			Periods: []envoy.TariffPeriod{{Id: "off-peak", Start: -1, Rate: 0.12}},
+		}},
+	}}
+	t.SeasonsSell = []envoy.TariffSeason{{
+		Id:    "all_year",
+		Start: "1/1",
+		Days: []envoy.TariffDays{{
+			Id:      "all",
+			Days:    "Mon,Tue,Wed,Thu,Fri,Sat,Sun",
+			Periods: []envoy.TariffPeriod{{Id: "export", Start: -1, Rate: 0.05}},
+		}},
+	}}
+	return map[string]interface{}{"tariff": t}
+}
+
+// selfSignedCert is a certificate for serving HTTPS as firmware 7.x does
+func selfSignedCert() tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	check(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "envoy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		DNSNames:     []string{"envoy", "envoy.local", "localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	check(err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func simulateCommand(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:8080", "Address to serve the fake Envoy on")
+	inverters := flags.Int("inverters", 12, "Number of microinverters")
+	peak := flags.Float64("peak", 300, "Watts per microinverter at midday")
+	token := flags.String("token", "", "Require this token, serving HTTPS like firmware 7.x (default plain HTTP without authentication)")
+	lat := flags.Float64("lat", 0, "Latitude, for sunrise and sunset (default 6am to 6pm)")
+	lon := flags.Float64("lon", 0, "Longitude")
+	noCTs := flags.Bool("no-cts", false, "Act as without consumption CTs, reporting consumption that isn't metered")
+	flags.Parse(args)
+	setupLogging("info", "text")
+
+	s := &simulator{inverters: *inverters, peak: *peak, lat: *lat, lon: *lon, noCTs: *noCTs}
+	server := &http.Server{Addr: *listen, Handler: s.handler(*token)}
+	slog.Info("Simulating an Envoy", "addr", *listen, "inverters", *inverters, "https", *token != "")
+	if *token != "" {
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{selfSignedCert()}}
+		check(server.ListenAndServeTLS("", ""))
+	}
+	check(server.ListenAndServe())
+}
+
+// handler serves the Envoy's endpoints, requiring token if it isn't empty
+func (s *simulator) handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	serveJSON := func(path string, body func(now time.Time) interface{}) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(body(time.Now()))
+		})
+	}
+	serveJSON("/production.json", s.productionJSON)
+	serveJSON("/api/v1/production/inverters", s.invertersJSON)
+	serveJSON("/inventory.json", s.inventoryJSON)
+	serveJSON("/ivp/peb/devstatus", s.devstatusJSON)
+	serveJSON("/ivp/mod/603980032/mode/power", func(time.Time) interface{} { return envoy.PowerMode{} })
+	serveJSON("/home.json", s.homeJSON)
+	serveJSON("/ivp/pdm/energy", s.energyJSON)
+	serveJSON("/admin/lib/tariff", s.tariffJSON)
+	mux.HandleFunc("/info.xml", func(w http.ResponseWriter, r *http.Request) {
+		software := "R4.10.35"
+		if token != "" {
+			software = "D7.6.175"
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<?xml version='1.0' encoding='UTF-8'?>
+<envoy_info>
+  <time>%d</time>
+  <device>
+    <sn>%s</sn>
+    <pn>800-00555-r03</pn>
+    <software>%s</software>
+    <imeter>true</imeter>
+  </device>
+</envoy_info>
+`, time.Now().Unix(), simulatedSerial, software)
+	})
+	return mux
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+)
+
+// simulatedGateway is a gateway polling a simulated Envoy
+func simulatedGateway(t *testing.T, s *simulator, token string, cfg EnvoyConfig) gateway {
+	server := httptest.NewServer(s.handler(token))
+	t.Cleanup(server.Close)
+	client := envoy.NewClient(strings.TrimPrefix(server.URL, "http://"), "")
+	return gateway{client: client, site: "home", cfg: cfg}
+}
+
+func TestPollEnvoy(t *testing.T) {
+	s := &simulator{inverters: 12, peak: 300}
+	gw := simulatedGateway(t, s, "", EnvoyConfig{Inverters: true, Inventory: true, Parallel: 2})
+
+	r := pollEnvoy(gw)
+	if r.Site != "home" {
+		t.Errorf("site %q, want home", r.Site)
+	}
+	if r.Production.ReadingTime == 0 || r.Production.WNow < 0 {
+		t.Errorf("production %+v, want a reading", r.Production)
+	}
+	types := []string{}
+	for _, eim := range r.Consumption {
+		types = append(types, eim.MeasurementType)
+	}
+	if strings.Join(types, ",") != "total-consumption,net-consumption" {
+		t.Errorf("consumption %v, want total and net", types)
+	}
+	if len(r.Inverters) != 12 {
+		t.Errorf("%d inverters, want 12", len(r.Inverters))
+	}
+	if r.Meters != nil || r.Home != nil {
+		t.Errorf("polled endpoints not asked for")
+	}
+}
+
+func TestPollEnvoyWithoutCTs(t *testing.T) {
+	s := &simulator{inverters: 4, peak: 300, noCTs: true}
+	gw := simulatedGateway(t, s, "", EnvoyConfig{})
+
+	r := pollEnvoy(gw)
+	if len(r.Consumption) != 0 {
+		t.Errorf("%d consumption readings, want none without CTs", len(r.Consumption))
+	}
+	if len(r.Inverters) != 0 {
+		t.Errorf("%d inverters, want none when not asked for", len(r.Inverters))
+	}
+}
+
+func TestPollEnvoyUnauthorized(t *testing.T) {
+	s := &simulator{inverters: 4, peak: 300}
+	gw := simulatedGateway(t, s, "secret", EnvoyConfig{})
+
+	if _, err := tryPoll(func() EnvoyReadings { return pollEnvoy(gw) }); err == nil {
+		t.Errorf("poll without the token succeeded")
+	}
+}
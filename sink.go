@@ -0,0 +1,263 @@
+package main
+
+// Outputs for readings.  Each poll cycle's readings go to every configured
+// sink in turn, and one failing doesn't stop the others being written.
+// When polling in a loop, each sink has a queue of its own, written from
+// in the background, so one that's slow or down doesn't hold up the others.
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink is somewhere readings are written to
+type Sink interface {
+	// Write takes a poll cycle's readings, one per Envoy polled successfully
+	Write(readings []EnvoyReadings) error
+	// Flush sends anything still buffered
+	Flush() error
+	Close() error
+}
+
+// errRejected marks a write an output refused outright, e.g. as malformed,
+// which retrying wouldn't change
+var errRejected = errors.New("rejected")
+
+// retrier is a sink that keeps what it failed to write, so that a retry
+// writes that again rather than being given the readings a second time
+type retrier interface {
+	retry() error
+}
+
+// catch runs f with its panics returned as errors, for sinks built on check
+func catch(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError(r)
+		}
+	}()
+	f()
+	return nil
+}
+
+// panicError is a recovered panic as an error, keeping it if it was one
+// so it can still be told apart with errors.Is
+func panicError(r interface{}) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", r)
+}
+
+// newSinks connects to each output configured
+func newSinks(cfg *Config, gateways []gateway) []Sink {
+	if cfg.Out == "jsonl" {
+		return []Sink{NewJsonlWriter(cfg.Influx)}
+	}
+	sinks := []Sink{}
+	var mqttPub *MqttPublisher
+	if cfg.Prometheus.Listen != "" {
+		sinks = append(sinks, prometheusSink{})
+	}
+	if cfg.Http != "" {
+		sinks = append(sinks, latest)
+	}
+	if cfg.Mqtt.Broker != "" {
+		mqttPub = NewMqttPublisher(cfg.Mqtt.Broker, cfg.Mqtt.ClientId, cfg.Mqtt.Username, cfg.Mqtt.Password, cfg.Mqtt.Topic, cfg.Mqtt.Qos)
+		if cfg.Mqtt.HomeAssistant != "" {
+			// Only used for a single Envoy, several are identified by site
+			deviceId := gateways[0].cfg.Serial
+			if deviceId == "" {
+				deviceId = getSerial(gateways[0].client)
+			}
+			mqttPub.EnableHomeAssistantDiscovery(cfg.Mqtt.HomeAssistant, deviceId)
+		}
+		sinks = append(sinks, mqttPub)
+	}
+	for _, ic := range cfg.influxConfigs() {
+		sinks = append(sinks, NewInfluxWriter(ic))
+	}
+	if cfg.Postgres.DSN != "" {
+		sinks = append(sinks, NewPostgresWriter(cfg.Postgres, cfg.Influx))
+	}
+	if cfg.Sqlite.File != "" {
+		sinks = append(sinks, NewSqliteWriter(cfg.Sqlite, cfg.Influx))
+	}
+	if cfg.Graphite.Addr != "" {
+		sinks = append(sinks, NewGraphiteWriter(cfg.Graphite, cfg.Influx))
+	}
+	if cfg.Otlp.Endpoint != "" {
+		sinks = append(sinks, NewOtlpWriter(cfg.Otlp, cfg.Influx))
+	}
+	if cfg.Kafka.Brokers != "" {
+		sinks = append(sinks, NewKafkaWriter(cfg.Kafka, cfg.Influx))
+	}
+	if cfg.Nats.Url != "" {
+		sinks = append(sinks, NewNatsWriter(cfg.Nats, cfg.Influx))
+	}
+	if cfg.Webhook.Url != "" {
+		sinks = append(sinks, NewWebhookWriter(cfg.Webhook))
+	}
+	if cfg.Pvoutput.ApiKey != "" {
+		sinks = append(sinks, NewPvoutputWriter(cfg.Pvoutput))
+	}
+	if cfg.Csv.Dir != "" {
+		sinks = append(sinks, NewCsvWriter(cfg.Csv, cfg.Influx))
+	}
+	if cfg.Alerts.enabled() {
+		sinks = append(sinks, NewAlerter(cfg, mqttPub))
+	}
+	if cfg.Interval > 0 && cfg.Replay == "" {
+		for i, sink := range sinks {
+			sinks[i] = newQueuedSink(sink, cfg.OutputQueue, cfg.OutputRetries, cfg.OutputBackoff)
+		}
+	}
+	return sinks
+}
+
+// influxSinks is the InfluxDB outputs among sinks
+func influxSinks(sinks []Sink) []*InfluxWriter {
+	writers := []*InfluxWriter{}
+	for _, sink := range sinks {
+		if w, ok := unqueued(sink).(*InfluxWriter); ok {
+			writers = append(writers, w)
+		}
+	}
+	return writers
+}
+
+// sinkName is what a sink is called in logs and metrics
+func sinkName(sink Sink) string {
+	if w, ok := sink.(*InfluxWriter); ok {
+		return "influx " + w.cfg.Addr
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", sink), "*main.")
+}
+
+// queuedSink writes to a sink from a queue of its own, in the background.
+// A write that fails is retried after a backoff, doubling each time, and
+// given up on after retries; while it's failing, the queue holds up to
+// size poll cycles' readings, dropping the oldest beyond that.
+type queuedSink struct {
+	sink    Sink
+	name    string
+	retries int
+	backoff time.Duration
+	queue   chan []EnvoyReadings
+	pending sync.WaitGroup // Readings queued or being written
+	done    chan struct{}
+}
+
+func newQueuedSink(sink Sink, size int, retries int, backoff time.Duration) *queuedSink {
+	q := &queuedSink{
+		sink:    sink,
+		name:    sinkName(sink),
+		retries: retries,
+		backoff: backoff,
+		queue:   make(chan []EnvoyReadings, size),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// unqueued is the sink a queue writes to, or sink itself if not queued
+func unqueued(sink Sink) Sink {
+	if q, ok := sink.(*queuedSink); ok {
+		return q.sink
+	}
+	return sink
+}
+
+// Write queues readings, dropping the oldest queued if it's full.  Write
+// errors are logged and counted as they happen rather than returned.
+func (q *queuedSink) Write(readings []EnvoyReadings) error {
+	q.pending.Add(1)
+	for {
+		select {
+		case q.queue <- readings:
+			promOutputQueued.WithLabelValues(q.name).Set(float64(len(q.queue)))
+			return nil
+		default:
+		}
+		select {
+		case <-q.queue:
+			q.pending.Done()
+			promOutputDropped.WithLabelValues(q.name).Inc()
+			slog.Warn("Output queue full, dropped the oldest readings", "output", q.name)
+		default:
+		}
+	}
+}
+
+// run writes the queued readings, until the queue is closed
+func (q *queuedSink) run() {
+	defer close(q.done)
+	for readings := range q.queue {
+		promOutputQueued.WithLabelValues(q.name).Set(float64(len(q.queue)))
+		backoff := q.backoff
+		for attempt := 0; ; attempt++ {
+			write := func() { check(q.sink.Write(readings)) }
+			if r, ok := q.sink.(retrier); ok && attempt > 0 {
+				write = func() { check(r.retry()) }
+			}
+			err := catch(write)
+			if err == nil {
+				break
+			}
+			promOutputErrors.WithLabelValues(q.name).Inc()
+			if attempt >= q.retries || errors.Is(err, errRejected) {
+				slog.Error("Writing to output failed, giving up on these readings", "output", q.name, "err", err)
+				break
+			}
+			slog.Warn("Writing to output failed, retrying", "output", q.name, "err", err, "delay", backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		q.pending.Done()
+	}
+}
+
+// Flush waits for the readings queued to be written, then flushes the sink
+func (q *queuedSink) Flush() error {
+	q.pending.Wait()
+	return q.sink.Flush()
+}
+
+// stop writes what's queued and stops writing, leaving the sink open
+func (q *queuedSink) stop() {
+	close(q.queue)
+	<-q.done
+}
+
+func (q *queuedSink) Close() error {
+	q.stop()
+	return q.sink.Close()
+}
+
+// writeSinks writes readings to every sink, returning all their errors
+func writeSinks(sinks []Sink, readings []EnvoyReadings) error {
+	errs := []error{}
+	for _, sink := range sinks {
+		if err := sink.Write(readings); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closeSinks flushes and closes every sink, e.g. on shutdown
+func closeSinks(sinks []Sink) {
+	for _, sink := range sinks {
+		if err := sink.Flush(); err != nil {
+			slog.Error("Flushing output failed", "err", err)
+		}
+		if err := sink.Close(); err != nil {
+			slog.Error("Closing output failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+// Smoothing (-smooth): each power value written as its moving average
+// over the last while, as livedata and meter readings jump about from
+// second to second and make dashboards hard to read.
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// sample is a value of a series' field, at its point's time
+type sample struct {
+	time  time.Time
+	value float64
+}
+
+// smoother averages each series' power fields over a moving window
+type smoother struct {
+	window  time.Duration
+	keepRaw bool // Also write the value as read, as <field>Raw
+
+	mu      sync.Mutex          // Streams smooth samples alongside polls
+	history map[string][]sample // By series and field
+}
+
+func newSmoother(window time.Duration, keepRaw bool) *smoother {
+	return &smoother{window: window, keepRaw: keepRaw, history: map[string][]sample{}}
+}
+
+// smoothedField is whether a field is power, e.g. watts, wattsL1 or
+// reactivePower
+func smoothedField(name string) bool {
+	return strings.HasPrefix(name, "watts") || strings.HasSuffix(name, "Power")
+}
+
+// smooth replaces each point's power fields with their mean over the
+// window up to the point's time
+func (s *smoother) smooth(points []point) []point {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range points {
+		key := seriesKey(p)
+		fields := map[string]interface{}{}
+		for name, value := range p.fields {
+			fields[name] = value
+			f, ok := value.(float64)
+			if !ok || !smoothedField(name) {
+				continue
+			}
+			history := append(s.history[key+" "+name], sample{p.time, f})
+			start := p.time.Add(-s.window)
+			for len(history) > 1 && !history[0].time.After(start) {
+				history = history[1:]
+			}
+			s.history[key+" "+name] = history
+			sum := 0.0
+			for _, h := range history {
+				sum += h.value
+			}
+			fields[name] = sum / float64(len(history))
+			if s.keepRaw {
+				fields[name+"Raw"] = f
+			}
+		}
+		points[i].fields = fields
+	}
+	return points
+}
@@ -0,0 +1,67 @@
+package main
+
+// Spool keeps points that couldn't be written to InfluxDB on disk, as
+// line protocol files, until they can be written with their original
+// timestamps.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Spool struct {
+	dir string
+	mu  sync.Mutex // Add can be called from the background InfluxDB writer
+}
+
+func NewSpool(dir string) *Spool {
+	err := os.MkdirAll(dir, 0700)
+	check(err)
+	return &Spool{dir: dir}
+}
+
+func (s *Spool) files() []string {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.lp"))
+	check(err)
+	// Names are timestamps, so this is oldest first
+	sort.Strings(files)
+	return files
+}
+
+// Add stores a batch of line protocol lines
+func (s *Spool) Add(lines []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d.lp", time.Now().UnixNano()))
+	err := ioutil.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	check(err)
+}
+
+// Flush writes the stored batches oldest first, removing each once
+// written, and stops at the first failure
+func (s *Spool) Flush(write func(lines []string) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := s.files()
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		check(err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if err := write(lines); err != nil {
+			return err
+		}
+		err = os.Remove(name)
+		check(err)
+	}
+	if len(files) > 0 {
+		slog.Info("Flushed spooled batches to InfluxDB", "batches", len(files))
+	}
+	return nil
+}
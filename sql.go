@@ -0,0 +1,127 @@
+package main
+
+// SQL outputs: the same points as InfluxDB gets, one row each with the
+// tags and fields as JSON, e.g. for PostgreSQL
+//  SELECT time, fields->>'watts' FROM readings
+//   WHERE measurement = 'readings' AND tags->>'type' = 'production'
+// or SQLite
+//  SELECT time, json_extract(fields, '$.watts') FROM readings
+//   WHERE measurement = 'readings' AND json_extract(tags, '$.type') = 'production'
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"log/slog"
+)
+
+type SqlWriter struct {
+	db     *sql.DB
+	insert string
+	influx InfluxConfig // Measurement names and fields to write
+	dedupe *dedupe
+}
+
+func NewPostgresWriter(cfg PostgresConfig, influx InfluxConfig) *SqlWriter {
+	db, err := sql.Open("postgres", cfg.DSN)
+	check(err)
+	table := pq.QuoteIdentifier(cfg.Table)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (
+		time        timestamptz NOT NULL,
+		measurement text        NOT NULL,
+		tags        jsonb       NOT NULL,
+		fields      jsonb       NOT NULL
+	)`)
+	check(err)
+
+	// A hypertable where TimescaleDB is installed, otherwise a plain index
+	var timescale bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&timescale)
+	check(err)
+	if timescale {
+		_, err = db.Exec(`SELECT create_hypertable($1, 'time', if_not_exists => TRUE)`, cfg.Table)
+	} else {
+		_, err = db.Exec(`CREATE INDEX IF NOT EXISTS ` + pq.QuoteIdentifier(cfg.Table+"_time") + ` ON ` + table + ` (measurement, time)`)
+	}
+	check(err)
+	slog.Info("Writing to PostgreSQL", "table", cfg.Table, "timescaledb", timescale)
+
+	return &SqlWriter{
+		db:     db,
+		insert: `INSERT INTO ` + table + ` (time, measurement, tags, fields) VALUES ($1, $2, $3, $4)`,
+		influx: influx,
+		dedupe: newDedupe(influx.Duplicates),
+	}
+}
+
+// NewSqliteWriter writes to a database file, created if needed
+func NewSqliteWriter(cfg SqliteConfig, influx InfluxConfig) *SqlWriter {
+	db, err := sql.Open("sqlite3", cfg.File)
+	check(err)
+	// One writer at a time, and let readers in while writing
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`PRAGMA journal_mode = WAL`)
+	check(err)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS readings (
+		time        TIMESTAMP NOT NULL,
+		measurement TEXT      NOT NULL,
+		tags        TEXT      NOT NULL,
+		fields      TEXT      NOT NULL
+	)`)
+	check(err)
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS readings_time ON readings (measurement, time)`)
+	check(err)
+	slog.Info("Writing to SQLite", "file", cfg.File)
+
+	return &SqlWriter{
+		db:     db,
+		insert: `INSERT INTO readings (time, measurement, tags, fields) VALUES (?, ?, ?, ?)`,
+		influx: influx,
+		dedupe: newDedupe(influx.Duplicates),
+	}
+}
+
+func (w *SqlWriter) Write(readings []EnvoyReadings) error {
+	points := []point{}
+	for _, r := range readings {
+		points = append(points, w.dedupe.filter(readingsToPoints(w.influx, r), r.PollTime)...)
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(w.insert)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, p := range points {
+		tags, err := json.Marshal(p.tags)
+		if err != nil {
+			return err
+		}
+		fields, err := json.Marshal(p.fields)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(p.time.UTC(), p.measurement, string(tags), string(fields)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Flush is a no-op as each Write is committed
+func (w *SqlWriter) Flush() error {
+	return nil
+}
+
+func (w *SqlWriter) Close() error {
+	return w.db.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+// Streaming: the Envoy's /stream/meter sends the CT meters' readings about
+// once a second.  Each stream is kept connected alongside polling, and its
+// samples written to InfluxDB in batches.
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+const (
+	streamWriteInterval = 10 * time.Second
+	streamMaxBackoff    = time.Minute
+)
+
+// streamPhases names /stream/meter's phases as the meter points do
+var streamPhases = map[string]string{"ph-a": "L1", "ph-b": "L2", "ph-c": "L3"}
+
+// streamSamplePoints has a point per measurement type and phase, at t
+func streamSamplePoints(measurement string, sample envoy.MeterSample, t time.Time) []point {
+	types := []string{}
+	for typ := range sample {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	points := []point{}
+	for _, typ := range types {
+		phases := []string{}
+		for phase := range sample[typ] {
+			phases = append(phases, phase)
+		}
+		sort.Strings(phases)
+		for _, phase := range phases {
+			s := sample[typ][phase]
+			if name, ok := streamPhases[phase]; ok {
+				phase = name
+			}
+			points = append(points, point{
+				measurement: measurement,
+				tags: map[string]string{
+					"type":  typ,
+					"phase": phase,
+				},
+				fields: map[string]interface{}{
+					"watts":         s.P,
+					"reactivePower": s.Q,
+					"apparentPower": s.S,
+					"voltage":       s.V,
+					"current":       s.I,
+					"pwrFactor":     s.Pf,
+					"freq":          s.F,
+				},
+				time: t,
+			})
+		}
+	}
+	return points
+}
+
+// streamMeter keeps gw's meter stream connected, reconnecting with
+// backoff when it drops, and writes its samples to each of ws
+func streamMeter(gw gateway, measurement string, ws []*InfluxWriter) {
+	pending := []point{}
+	lastWrite := time.Now()
+	write := func() {
+		for _, w := range ws {
+			// A copy each, as smoothing replaces their fields
+			points := append([]point{}, pending...)
+			if err := catch(func() { w.WritePoints(w.downsampled(w.smoothed(points))) }); err != nil {
+				slog.Error("Writing streamed samples failed", "site", gw.site, "samples", len(pending), "err", err)
+			}
+		}
+		pending, lastWrite = nil, time.Now()
+	}
+
+	backoff := time.Second
+	for {
+		connected := time.Now()
+		err := gw.client.StreamMeter(func(sample envoy.MeterSample) {
+			points := streamSamplePoints(measurement, sample, time.Now().Truncate(time.Second))
+			if gw.site != "" {
+				for _, p := range points {
+					p.tags["site"] = gw.site
+				}
+			}
+			// The same for every InfluxDB
+			pending = append(pending, ws[0].cfg.addTags(ws[0].cfg.mapPoints(points))...)
+			if time.Since(lastWrite) >= streamWriteInterval {
+				write()
+			}
+		})
+		if len(pending) > 0 {
+			write()
+		}
+		if time.Since(connected) > streamMaxBackoff {
+			backoff = time.Second
+		}
+		slog.Warn("Meter stream disconnected", "site", gw.site, "err", err, "retryIn", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
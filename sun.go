@@ -0,0 +1,68 @@
+package main
+
+// Sunrise and sunset, per the sunrise equation
+// (https://en.wikipedia.org/wiki/Sunrise_equation), good to a minute or
+// two which is plenty for choosing how often to poll.
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	j2000       = 2451545.0
+	unixEpochJD = 2440587.5
+	degrees     = math.Pi / 180
+)
+
+func julianDate(t time.Time) float64 {
+	return float64(t.Unix())/86400 + unixEpochJD
+}
+
+func fromJulianDate(jd float64) time.Time {
+	return time.Unix(int64(math.Round((jd-unixEpochJD)*86400)), 0)
+}
+
+// sunTimes is the sunrise and sunset on the day of t at the given
+// location (degrees, north and east positive).  At polar latitudes with no
+// sunrise or sunset, alwaysUp says which it is.
+func sunTimes(t time.Time, lat float64, lon float64) (rise time.Time, set time.Time, polar bool, alwaysUp bool) {
+	n := math.Ceil(julianDate(t) - j2000 - 0.0009 + lon/360 - 0.5)
+	jStar := n - lon/360
+	m := math.Mod(357.5291+0.98560028*jStar, 360)
+	c := 1.9148*math.Sin(m*degrees) + 0.02*math.Sin(2*m*degrees) + 0.0003*math.Sin(3*m*degrees)
+	lambda := math.Mod(m+c+180+102.9372, 360)
+	jTransit := j2000 + jStar + 0.0053*math.Sin(m*degrees) - 0.0069*math.Sin(2*lambda*degrees)
+	sinDecl := math.Sin(lambda*degrees) * math.Sin(23.4397*degrees)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+	cosHourAngle := (math.Sin(-0.833*degrees) - math.Sin(lat*degrees)*sinDecl) / (math.Cos(lat*degrees) * cosDecl)
+	if cosHourAngle < -1 {
+		return time.Time{}, time.Time{}, true, true
+	}
+	if cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, true, false
+	}
+	hourAngle := math.Acos(cosHourAngle) / degrees
+	return fromJulianDate(jTransit - hourAngle/360), fromJulianDate(jTransit + hourAngle/360), false, false
+}
+
+// isDaylight is whether the sun is up at t
+func isDaylight(t time.Time, lat float64, lon float64) bool {
+	rise, set, polar, alwaysUp := sunTimes(t, lat, lon)
+	if polar {
+		return alwaysUp
+	}
+	return !t.Before(rise) && t.Before(set)
+}
+
+// nextSunrise is the first sunrise after t, looking up to a year ahead
+// for polar night
+func nextSunrise(t time.Time, lat float64, lon float64) time.Time {
+	for day := 0; day < 366; day++ {
+		rise, _, polar, _ := sunTimes(t.AddDate(0, 0, day), lat, lon)
+		if !polar && rise.After(t) {
+			return rise
+		}
+	}
+	return t.AddDate(1, 0, 0)
+}
@@ -0,0 +1,38 @@
+package main
+
+// systemd Type=notify support: READY once started, and WATCHDOG pings
+// while polls keep succeeding, so a wedged loop gets restarted.
+// See sd_notify(3); no-ops when not run by systemd.
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// sdWatchdogInterval is how often to ping the watchdog, half its timeout,
+// or 0 if it's not enabled
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,315 @@
+package main
+
+// What energy bought from the grid costs and what selling it back earns:
+// the grid import and export between polls, at the rates then, from the
+// tariff set up on the Envoy, or flat rates or rate schedules given
+
+import (
+	"fmt"
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ratePeriod is a rate from start, in minutes after midnight
+type ratePeriod struct {
+	start int
+	rate  float64
+}
+
+// rateDays is the periods on some days of the week, in order of start
+type rateDays struct {
+	days    [7]bool // By time.Weekday
+	periods []ratePeriod
+}
+
+// rateSeason is the rates from a day of the year
+type rateSeason struct {
+	month time.Month
+	day   int
+	days  []rateDays
+}
+
+// rateSchedule is the seasons in order of start.  Each season, day and
+// period runs on until the next starts, wrapping round from the last.
+type rateSchedule []rateSeason
+
+// at is the rate at t, in t's location
+func (s rateSchedule) at(t time.Time) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	season := s[len(s)-1]
+	for _, se := range s {
+		if t.Month() > se.month || t.Month() == se.month && t.Day() >= se.day {
+			season = se
+		}
+	}
+	for _, d := range season.days {
+		if !d.days[t.Weekday()] || len(d.periods) == 0 {
+			continue
+		}
+		minute := t.Hour()*60 + t.Minute()
+		period := d.periods[len(d.periods)-1]
+		for _, p := range d.periods {
+			if minute >= p.start {
+				period = p
+			}
+		}
+		return period.rate
+	}
+	return 0
+}
+
+// flatRate is the same rate all year round
+func flatRate(rate float64) rateSchedule {
+	all := rateDays{periods: []ratePeriod{{rate: rate}}}
+	for i := range all.days {
+		all.days[i] = true
+	}
+	return rateSchedule{{month: time.January, day: 1, days: []rateDays{all}}}
+}
+
+// tariff is the rates for buying (importing) and selling (exporting)
+type tariff struct {
+	currency  string
+	buy, sell rateSchedule
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseWeekdays reads a list of days such as "Mon,Tue,Wed" or "Sat, Sun"
+func parseWeekdays(list string) (days [7]bool, err error) {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if len(name) > 3 {
+			name = name[:3]
+		}
+		day, ok := weekdays[name]
+		if !ok {
+			return days, fmt.Errorf("unknown day %q", name)
+		}
+		days[day] = true
+	}
+	return days, nil
+}
+
+// parseMonthDay reads a season's start as month/day, e.g. 6/1
+func parseMonthDay(s string) (time.Month, int, error) {
+	month, day, ok := strings.Cut(s, "/")
+	m, err1 := strconv.Atoi(strings.TrimSpace(month))
+	d, err2 := strconv.Atoi(strings.TrimSpace(day))
+	if !ok || err1 != nil || err2 != nil || m < 1 || m > 12 || d < 1 || d > 31 {
+		return 0, 0, fmt.Errorf("season start %q isn't month/day", s)
+	}
+	return time.Month(m), d, nil
+}
+
+// sortSchedule puts seasons and periods in order of start
+func sortSchedule(s rateSchedule) rateSchedule {
+	sort.Slice(s, func(i, j int) bool {
+		return s[i].month < s[j].month || s[i].month == s[j].month && s[i].day < s[j].day
+	})
+	for _, season := range s {
+		for _, d := range season.days {
+			sort.Slice(d.periods, func(i, j int) bool { return d.periods[i].start < d.periods[j].start })
+		}
+	}
+	return s
+}
+
+// envoySchedule converts the Envoy's seasons, or its single rate if it has
+// none with rates set
+func envoySchedule(seasons []envoy.TariffSeason, single float64) (rateSchedule, error) {
+	schedule := rateSchedule{}
+	rated := false
+	for _, se := range seasons {
+		month, day, err := parseMonthDay(se.Start)
+		if err != nil {
+			return nil, err
+		}
+		season := rateSeason{month: month, day: day}
+		for _, d := range se.Days {
+			days, err := parseWeekdays(d.Days)
+			if err != nil {
+				return nil, err
+			}
+			rd := rateDays{days: days}
+			for _, p := range d.Periods {
+				start := int(p.Start)
+				if start < 0 {
+					start = 0
+				}
+				rd.periods = append(rd.periods, ratePeriod{start: start, rate: float64(p.Rate)})
+				rated = rated || p.Rate != 0
+			}
+			season.days = append(season.days, rd)
+		}
+		schedule = append(schedule, season)
+	}
+	if !rated {
+		return flatRate(single), nil
+	}
+	return sortSchedule(schedule), nil
+}
+
+// configSchedule converts rate schedules from the config file, or nil if
+// there are none
+func configSchedule(seasons []RateSeasonConfig) (rateSchedule, error) {
+	if len(seasons) == 0 {
+		return nil, nil
+	}
+	schedule := rateSchedule{}
+	for _, se := range seasons {
+		season := rateSeason{month: time.January, day: 1}
+		if se.Start != "" {
+			var err error
+			season.month, season.day, err = parseMonthDay(se.Start)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(se.Days) == 0 {
+			return nil, fmt.Errorf("season from %s has no days", se.Start)
+		}
+		for _, d := range se.Days {
+			rd := rateDays{days: [7]bool{true, true, true, true, true, true, true}}
+			if d.Days != "" {
+				var err error
+				rd.days, err = parseWeekdays(d.Days)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if len(d.Periods) == 0 {
+				return nil, fmt.Errorf("days %s have no rates", d.Days)
+			}
+			for _, p := range d.Periods {
+				start := 0
+				if p.Start != "" {
+					t, err := time.Parse("15:04", p.Start)
+					if err != nil {
+						return nil, fmt.Errorf("period start %q isn't hh:mm", p.Start)
+					}
+					start = t.Hour()*60 + t.Minute()
+				}
+				rd.periods = append(rd.periods, ratePeriod{start: start, rate: p.Rate})
+			}
+			season.days = append(season.days, rd)
+		}
+		schedule = append(schedule, season)
+	}
+	return sortSchedule(schedule), nil
+}
+
+// envoyTariff reads the tariff set up on the Envoy
+func envoyTariff(client *envoy.Client) *tariff {
+	et, err := client.GetTariff()
+	check(err)
+	t := &tariff{currency: et.Currency.Code}
+	t.buy, err = envoySchedule(et.Seasons, float64(et.SingleRate.Rate))
+	check(err)
+	t.sell, err = envoySchedule(et.SeasonsSell, float64(et.SingleRate.Sell))
+	check(err)
+	slog.Info("Tariff", "host", client.Host, "currency", t.currency, "buySeasons", len(t.buy), "sellSeasons", len(t.sell))
+	return t
+}
+
+// gatewayTariff is the tariff to cost client's readings with, or nil if
+// none is set up
+func gatewayTariff(cfg TariffConfig, client *envoy.Client) *tariff {
+	if cfg.Envoy {
+		return envoyTariff(client)
+	}
+	if cfg.ImportRate == 0 && cfg.ExportRate == 0 && len(cfg.Import) == 0 && len(cfg.Export) == 0 {
+		return nil
+	}
+	t := &tariff{currency: cfg.Currency, buy: flatRate(cfg.ImportRate), sell: flatRate(cfg.ExportRate)}
+	// Validated with the config
+	if buy, _ := configSchedule(cfg.Import); buy != nil {
+		t.buy = buy
+	}
+	if sell, _ := configSchedule(cfg.Export); sell != nil {
+		t.sell = sell
+	}
+	return t
+}
+
+// Cost is the grid energy since the previous poll, and what it cost or
+// earned at the rates in force then
+type Cost struct {
+	Currency     string
+	ImportWh     float64
+	ExportWh     float64
+	ImportRate   float64 // per kWh
+	ExportRate   float64
+	ImportCost   float64
+	ExportCredit float64
+}
+
+// maxCostGap is the longest between polls to cost the energy over, beyond
+// which the poller was probably down
+const maxCostGap = time.Hour
+
+// costPoll is a poll's grid power, to integrate up to the next
+type costPoll struct {
+	time    time.Time
+	derived Derived
+}
+
+var (
+	costPollsMu sync.Mutex
+	costPolls   = map[string]costPoll{} // Each host's previous
+)
+
+// addCost costs the grid energy since host's previous poll, which needs
+// a total-consumption CT
+func addCost(host string, r EnvoyReadings, t *tariff, loc *time.Location) *Cost {
+	derived, ok := derive(r)
+	if !ok {
+		return nil
+	}
+	costPollsMu.Lock()
+	last, seen := costPolls[host]
+	costPolls[host] = costPoll{r.PollTime, derived}
+	costPollsMu.Unlock()
+	gap := r.PollTime.Sub(last.time)
+	if !seen || gap <= 0 || gap > maxCostGap {
+		return nil
+	}
+
+	if loc == nil {
+		loc = time.Local
+	}
+	// At the rates as the interval began, averaging the power at each end
+	start := last.time.In(loc)
+	c := &Cost{
+		Currency:   t.currency,
+		ImportWh:   (last.derived.GridImportWatts + derived.GridImportWatts) / 2 * gap.Hours(),
+		ExportWh:   (last.derived.GridExportWatts + derived.GridExportWatts) / 2 * gap.Hours(),
+		ImportRate: t.buy.at(start),
+		ExportRate: t.sell.at(start),
+	}
+	c.ImportCost = c.ImportWh / 1000 * c.ImportRate
+	c.ExportCredit = c.ExportWh / 1000 * c.ExportRate
+	return c
+}
+
+func (c *Cost) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"importWh":     c.ImportWh,
+		"exportWh":     c.ExportWh,
+		"importRate":   c.ImportRate,
+		"exportRate":   c.ExportRate,
+		"importCost":   c.ImportCost,
+		"exportCredit": c.ExportCredit,
+		"netCost":      c.ImportCost - c.ExportCredit,
+	}
+}
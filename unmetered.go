@@ -0,0 +1,29 @@
+package main
+
+// Envoys without consumption CTs still report consumption eims, which stay
+// at zero.  They're left out of the readings, with a note in the log,
+// rather than written as zero consumption forever.
+
+import (
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"log/slog"
+	"sync"
+)
+
+// unmeteredNoted is each host and eim type logged as not metering
+var unmeteredNoted sync.Map
+
+// meteredConsumption is the consumption eims with CTs in use
+func meteredConsumption(host string, eims []envoy.Eim) []envoy.Eim {
+	metered := []envoy.Eim{}
+	for _, eim := range eims {
+		if eim.Metering() {
+			metered = append(metered, eim)
+			continue
+		}
+		if _, noted := unmeteredNoted.LoadOrStore(host+" "+eim.MeasurementType, true); !noted {
+			slog.Info("No consumption CTs, not writing consumption", "host", host, "type", eim.MeasurementType)
+		}
+	}
+	return metered
+}
@@ -0,0 +1,290 @@
+package main
+
+// Web dashboard of the latest readings from each Envoy, for a quick look
+// without setting up Grafana, and a JSON API of them under /api/,
+// including a stream of each poll's readings as server-sent events
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"github.com/prupe/enphase-envoy-local-monitoring/pkg/envoy"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// latestReadings keeps each site's most recent readings for the web
+// server, and passes each poll's on to stream subscribers
+type latestReadings struct {
+	mu          sync.Mutex
+	readings    map[string]EnvoyReadings // By site
+	subscribers map[chan []EnvoyReadings]bool
+}
+
+var latest = &latestReadings{
+	readings:    map[string]EnvoyReadings{},
+	subscribers: map[chan []EnvoyReadings]bool{},
+}
+
+func (l *latestReadings) Write(readings []EnvoyReadings) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range readings {
+		l.readings[r.Site] = r
+	}
+	for ch := range l.subscribers {
+		select {
+		case ch <- readings:
+		default:
+			// Too slow to keep up, so misses this poll
+		}
+	}
+	return nil
+}
+
+// subscribe returns a channel of each poll's readings, until unsubscribed
+func (l *latestReadings) subscribe() chan []EnvoyReadings {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch := make(chan []EnvoyReadings, 1)
+	l.subscribers[ch] = true
+	return ch
+}
+
+func (l *latestReadings) unsubscribe(ch chan []EnvoyReadings) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.subscribers, ch)
+}
+
+func (l *latestReadings) Flush() error { return nil }
+func (l *latestReadings) Close() error { return nil }
+
+// get is the latest readings, ordered by site
+func (l *latestReadings) get() []EnvoyReadings {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	readings := []EnvoyReadings{}
+	for _, r := range l.readings {
+		readings = append(readings, r)
+	}
+	sort.Slice(readings, func(i, j int) bool {
+		return readings[i].Site < readings[j].Site
+	})
+	return readings
+}
+
+type dashboardBattery struct {
+	Name string
+	Soc  float64
+}
+
+type dashboardInverter struct {
+	Serial     string
+	Watts      float64
+	MaxWatts   float64
+	LastReport time.Time
+	Status     string // From the inventory, if polled
+	Problem    bool
+}
+
+type dashboardSite struct {
+	EnvoyReadings
+	Batteries []dashboardBattery
+	Inverters []dashboardInverter
+}
+
+// newDashboardSite gathers what the dashboard shows from r
+func newDashboardSite(r EnvoyReadings) dashboardSite {
+	site := dashboardSite{EnvoyReadings: r}
+	for _, st := range r.Storage {
+		if st.ActiveCount > 0 && st.PercentFull > 0 {
+			site.Batteries = append(site.Batteries, dashboardBattery{Name: st.Type, Soc: st.PercentFull})
+		}
+	}
+	if r.Ensemble != nil {
+		for _, inv := range r.Ensemble.Inventory {
+			if inv.Type != "ENCHARGE" {
+				continue
+			}
+			for _, d := range inv.Devices {
+				site.Batteries = append(site.Batteries, dashboardBattery{Name: d.SerialNum, Soc: d.PercentFull})
+			}
+		}
+	}
+
+	devices := map[string]envoy.Device{}
+	for _, inv := range r.Inventory {
+		for _, d := range inv.Devices {
+			devices[d.SerialNum] = d
+		}
+	}
+	for _, inv := range r.Inverters {
+		i := dashboardInverter{
+			Serial:     inv.SerialNumber,
+			Watts:      inv.LastReportWatts,
+			MaxWatts:   inv.MaxReportWatts,
+			LastReport: time.Unix(inv.LastReportDate, 0),
+		}
+		if d, ok := devices[inv.SerialNumber]; ok {
+			switch {
+			case !d.Communicating:
+				i.Status, i.Problem = "not communicating", true
+			case !d.Producing:
+				i.Status, i.Problem = "not producing", true
+			default:
+				i.Status = "producing"
+			}
+		}
+		site.Inverters = append(site.Inverters, i)
+	}
+	sort.Slice(site.Inverters, func(i, j int) bool {
+		return site.Inverters[i].Serial < site.Inverters[j].Serial
+	})
+	return site
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard.html").Funcs(template.FuncMap{
+	"kw": func(w float64) string {
+		return fmt.Sprintf("%.2f kW", w/1000)
+	},
+	"kwh": func(wh float64) string {
+		return fmt.Sprintf("%.1f kWh", wh/1000)
+	},
+}).ParseFS(webFiles, "web/dashboard.html"))
+
+// writeJSON responds with v as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiHandler responds with part of the latest readings for the site given
+// by ?site=, which can be left out when polling one Envoy
+func apiHandler(part func(r EnvoyReadings) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		readings := latest.get()
+		if len(readings) == 0 {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no readings yet"})
+			return
+		}
+		site := req.URL.Query().Get("site")
+		if site == "" && len(readings) > 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "several sites, choose one with ?site="})
+			return
+		}
+		for _, r := range readings {
+			if site == "" || r.Site == site {
+				writeJSON(w, http.StatusOK, part(r))
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no readings for site " + site})
+	}
+}
+
+// streamReadings sends each poll's readings as a server-sent event, with
+// a comment now and then to keep the connection open
+func streamReadings(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := latest.subscribe()
+	defer latest.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case readings := <-ch:
+			data, err := json.Marshal(readings)
+			if err != nil {
+				slog.Error("Encoding stream event failed", "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: readings\ndata: %s\n\n", data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// serveWeb serves the dashboard and API on addr.  The dashboard reloads on
+// each poll's stream event, or without JavaScript, every interval.
+func serveWeb(addr string, interval time.Duration) {
+	refresh := int(interval.Seconds())
+	if refresh < 5 {
+		refresh = 5
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		sites := []dashboardSite{}
+		for _, readings := range latest.get() {
+			sites = append(sites, newDashboardSite(readings))
+		}
+		var page strings.Builder
+		err := dashboardTemplate.Execute(&page, map[string]interface{}{
+			"Refresh": refresh,
+			"Sites":   sites,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page.String())
+	})
+
+	mux.HandleFunc("/api/readings", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, latest.get())
+	})
+	mux.HandleFunc("/api/stream", streamReadings)
+	mux.HandleFunc("/api/sites", func(w http.ResponseWriter, r *http.Request) {
+		sites := []string{}
+		for _, readings := range latest.get() {
+			sites = append(sites, readings.Site)
+		}
+		writeJSON(w, http.StatusOK, sites)
+	})
+	mux.HandleFunc("/api/production", apiHandler(func(r EnvoyReadings) interface{} {
+		return r.Production
+	}))
+	mux.HandleFunc("/api/consumption", apiHandler(func(r EnvoyReadings) interface{} {
+		return r.Consumption
+	}))
+	mux.HandleFunc("/api/storage", apiHandler(func(r EnvoyReadings) interface{} {
+		return r.Storage
+	}))
+	mux.HandleFunc("/api/inverters", apiHandler(func(r EnvoyReadings) interface{} {
+		return r.Inverters
+	}))
+	mux.HandleFunc("/api/meters", apiHandler(func(r EnvoyReadings) interface{} {
+		return r.Meters
+	}))
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		slog.Error("Web listener stopped", "err", err)
+	}()
+}
@@ -0,0 +1,93 @@
+package main
+
+// Webhook output: POSTs each poll's readings, one per Envoy, as a JSON
+// array, the same as the export command prints
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type WebhookWriter struct {
+	url     string
+	headers http.Header
+	retries int
+	client  *http.Client
+}
+
+func NewWebhookWriter(cfg WebhookConfig) *WebhookWriter {
+	headers := http.Header{}
+	for _, h := range cfg.Headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			panic("webhook header " + h + " should be Name: value")
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return &WebhookWriter{
+		url:     cfg.Url,
+		headers: headers,
+		retries: cfg.Retries,
+		client:  &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// post sends body once, returning whether a failure is worth retrying
+func (w *WebhookWriter) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header = w.headers.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		// Only the server having trouble might go better next time
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return false, nil
+}
+
+func (w *WebhookWriter) Write(readings []EnvoyReadings) error {
+	if len(readings) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(readings)
+	if err != nil {
+		return err
+	}
+	return w.send(body)
+}
+
+// send posts body, retrying server errors with a doubling delay
+func (w *WebhookWriter) send(body []byte) error {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil || !retry || attempt >= w.retries {
+			return err
+		}
+		slog.Warn("Webhook failed, retrying", "err", err, "delay", delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Flush is a no-op as each Write is posted straight away
+func (w *WebhookWriter) Flush() error {
+	return nil
+}
+
+func (w *WebhookWriter) Close() error {
+	return nil
+}